@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/libp2p/go-libp2p/core/connmgr"
+	"github.com/libp2p/go-libp2p/core/control"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/event"
 	"github.com/libp2p/go-libp2p/core/host"
@@ -134,6 +135,10 @@ type Config struct {
 	DisableIdentifyAddressDiscovery bool
 
 	EnableAutoNATv2 bool
+	// AutoNATv2DialerMinPort and AutoNATv2DialerMaxPort are the range of ports the autonat v2
+	// dialer host listens on. The range is unset if AutoNATv2DialerMinPort is zero.
+	AutoNATv2DialerMinPort int
+	AutoNATv2DialerMaxPort int
 
 	UDPBlackHoleSuccessCounter        *swarm.BlackHoleSuccessCounter
 	CustomUDPBlackHoleSuccessCounter  bool
@@ -214,20 +219,27 @@ func (cfg *Config) makeAutoNATV2Host() (host.Host, error) {
 		return nil, err
 	}
 
+	gater, rm := cfg.ConnectionGater, cfg.ResourceManager
+	if cfg.AutoNATv2DialerMinPort != 0 {
+		// The dialer host only listens on the port range to dial from it. It must not accept
+		// connections, and it must not use up the host's resources.
+		gater = dialOnlyGater{gater: cfg.ConnectionGater}
+		rm = &network.NullResourceManager{}
+	}
 	autoNatCfg := Config{
 		Transports:                  cfg.Transports,
 		Muxers:                      cfg.Muxers,
 		SecurityTransports:          cfg.SecurityTransports,
 		Insecure:                    cfg.Insecure,
 		PSK:                         cfg.PSK,
-		ConnectionGater:             cfg.ConnectionGater,
+		ConnectionGater:             gater,
 		Reporter:                    cfg.Reporter,
 		PeerKey:                     autonatPrivKey,
 		Peerstore:                   ps,
 		DialRanker:                  swarm.NoDelayDialRanker,
 		UDPBlackHoleSuccessCounter:  cfg.UDPBlackHoleSuccessCounter,
 		IPv6BlackHoleSuccessCounter: cfg.IPv6BlackHoleSuccessCounter,
-		ResourceManager:             cfg.ResourceManager,
+		ResourceManager:             rm,
 		SwarmOpts: []swarm.Option{
 			// Don't update black hole state for failed autonat dials
 			swarm.WithReadOnlyBlackHoleDetector(),
@@ -272,9 +284,102 @@ func (cfg *Config) makeAutoNATV2Host() (host.Host, error) {
 		<-dialerHost.Network().(*swarm.Swarm).Done()
 		app.Stop(context.Background())
 	}()
+	if cfg.AutoNATv2DialerMinPort != 0 {
+		// With port reuse, dials use the listening port as source port.
+		err := listenOnPortRange(dialerHost.Network().(*swarm.Swarm), cfg.AutoNATv2DialerMinPort, cfg.AutoNATv2DialerMaxPort)
+		if err != nil {
+			dialerHost.Close()
+			return nil, fmt.Errorf("failed to listen on autonat v2 dialer port range: %w", err)
+		}
+	}
 	return dialerHost, nil
 }
 
+// listenOnPortRange makes sw listen on the first port in [minPort, maxPort] that is available for
+// all of its TCP and QUIC transports on all IPv4 interfaces. sw also listens on the port on IPv6
+// interfaces if possible.
+func listenOnPortRange(sw *swarm.Swarm, minPort, maxPort int) error {
+	for port := minPort; port <= maxPort; port++ {
+		var ip4Addrs, ip6Addrs []ma.Multiaddr
+		for _, a := range []ma.Multiaddr{
+			ma.StringCast(fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", port)),
+			ma.StringCast(fmt.Sprintf("/ip4/0.0.0.0/udp/%d/quic-v1", port)),
+		} {
+			if sw.TransportForListening(a) != nil {
+				ip4Addrs = append(ip4Addrs, a)
+			}
+		}
+		for _, a := range []ma.Multiaddr{
+			ma.StringCast(fmt.Sprintf("/ip6/::/tcp/%d", port)),
+			ma.StringCast(fmt.Sprintf("/ip6/::/udp/%d/quic-v1", port)),
+		} {
+			if sw.TransportForListening(a) != nil {
+				ip6Addrs = append(ip6Addrs, a)
+			}
+		}
+		if len(ip4Addrs) == 0 {
+			return errors.New("no TCP or QUIC transport")
+		}
+		if !listenOnAll(sw, ip4Addrs) {
+			continue
+		}
+		for _, a := range ip6Addrs {
+			if err := sw.AddListenAddr(a); err != nil {
+				log.Debugf("failed to listen on %s: %s", a, err)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("no port available in [%d, %d]", minPort, maxPort)
+}
+
+// dialOnlyGater rejects all inbound connections. Outbound connections are checked by gater, if set.
+type dialOnlyGater struct {
+	gater connmgr.ConnectionGater
+}
+
+var _ connmgr.ConnectionGater = dialOnlyGater{}
+
+func (g dialOnlyGater) InterceptPeerDial(p peer.ID) bool {
+	return g.gater == nil || g.gater.InterceptPeerDial(p)
+}
+
+func (g dialOnlyGater) InterceptAddrDial(p peer.ID, a ma.Multiaddr) bool {
+	return g.gater == nil || g.gater.InterceptAddrDial(p, a)
+}
+
+func (g dialOnlyGater) InterceptAccept(network.ConnMultiaddrs) bool {
+	return false
+}
+
+func (g dialOnlyGater) InterceptSecured(dir network.Direction, p peer.ID, addrs network.ConnMultiaddrs) bool {
+	if dir == network.DirInbound {
+		return false
+	}
+	return g.gater == nil || g.gater.InterceptSecured(dir, p, addrs)
+}
+
+func (g dialOnlyGater) InterceptUpgraded(c network.Conn) (bool, control.DisconnectReason) {
+	if c.Stat().Direction == network.DirInbound {
+		return false, 0
+	}
+	if g.gater == nil {
+		return true, 0
+	}
+	return g.gater.InterceptUpgraded(c)
+}
+
+// listenOnAll makes sw listen on all addrs. If that fails, sw doesn't listen on any of addrs.
+func listenOnAll(sw *swarm.Swarm, addrs []ma.Multiaddr) bool {
+	for i, a := range addrs {
+		if err := sw.AddListenAddr(a); err != nil {
+			sw.ListenClose(addrs[:i]...)
+			return false
+		}
+	}
+	return true
+}
+
 func (cfg *Config) addTransports() ([]fx.Option, error) {
 	fxopts := []fx.Option{
 		fx.WithLogger(func() fxevent.Logger { return getFXLogger() }),
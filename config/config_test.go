@@ -1,7 +1,17 @@
 package config
 
 import (
+	"context"
+	"net"
+	"strconv"
 	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	swarmt "github.com/libp2p/go-libp2p/p2p/net/swarm/testing"
+
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
 )
 
 func TestNilOption(t *testing.T) {
@@ -21,3 +31,93 @@ func TestNilOption(t *testing.T) {
 		t.Fatalf("expected to have handled 3 options, handled %d", optsRun)
 	}
 }
+
+func TestListenOnPortRange(t *testing.T) {
+	// occupy the first port of the range
+	l, err := net.Listen("tcp4", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	minPort := l.Addr().(*net.TCPAddr).Port
+	maxPort := minPort + 10
+
+	sw := swarmt.GenSwarm(t, swarmt.OptDialOnly)
+	defer sw.Close()
+	if err := listenOnPortRange(sw, minPort, maxPort); err != nil {
+		t.Fatal(err)
+	}
+	var port int
+	for _, a := range sw.ListenAddresses() {
+		_, s, err := manet.DialArgs(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, ps, err := net.SplitHostPort(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		port, err = strconv.Atoi(ps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if port <= minPort || port > maxPort {
+			t.Fatalf("listening on %s, expected a port in (%d, %d]", a, minPort, maxPort)
+		}
+	}
+	if port == 0 {
+		t.Fatal("not listening")
+	}
+
+	// Dials use the listening port as source port
+	remote := swarmt.GenSwarm(t, swarmt.OptDisableQUIC)
+	defer remote.Close()
+	sw.Peerstore().AddAddrs(remote.LocalPeer(), remote.ListenAddresses(), peerstore.PermanentAddrTTL)
+	c, err := sw.DialPeer(context.Background(), remote.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, s, err := manet.DialArgs(c.LocalMultiaddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ps, _ := net.SplitHostPort(s); ps != strconv.Itoa(port) {
+		t.Fatalf("dialed from %s, expected port %d", c.LocalMultiaddr(), port)
+	}
+
+	if err := listenOnPortRange(swarmt.GenSwarm(t, swarmt.OptDialOnly), minPort, minPort); err == nil {
+		t.Fatal("expected listening on a port in use to fail")
+	}
+}
+
+func TestDialOnlyGater(t *testing.T) {
+	gater := swarmt.DefaultMockConnectionGater()
+	sw := swarmt.GenSwarm(t, swarmt.OptDialOnly, swarmt.OptConnGater(dialOnlyGater{gater: gater}))
+	defer sw.Close()
+	if err := sw.Listen(ma.StringCast("/ip4/127.0.0.1/tcp/0")); err != nil {
+		t.Fatal(err)
+	}
+
+	// outbound connections are allowed
+	remote := swarmt.GenSwarm(t, swarmt.OptDisableQUIC)
+	defer remote.Close()
+	sw.Peerstore().AddAddrs(remote.LocalPeer(), remote.ListenAddresses(), peerstore.PermanentAddrTTL)
+	if _, err := sw.DialPeer(context.Background(), remote.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+
+	// inbound connections are rejected
+	other := swarmt.GenSwarm(t, swarmt.OptDisableQUIC)
+	defer other.Close()
+	other.Peerstore().AddAddrs(sw.LocalPeer(), sw.ListenAddresses(), peerstore.PermanentAddrTTL)
+	if _, err := other.DialPeer(context.Background(), sw.LocalPeer()); err == nil {
+		t.Fatal("expected inbound connection to be rejected")
+	}
+
+	// outbound connections are still subject to the wrapped gater
+	gater.PeerDial = func(peer.ID) bool { return false }
+	sw.Peerstore().AddAddrs(other.LocalPeer(), other.ListenAddresses(), peerstore.PermanentAddrTTL)
+	if _, err := sw.DialPeer(context.Background(), other.LocalPeer()); err == nil {
+		t.Fatal("expected outbound connection to be gated")
+	}
+}
@@ -2,6 +2,8 @@ package event
 
 import (
 	"github.com/libp2p/go-libp2p/core/network"
+
+	ma "github.com/multiformats/go-multiaddr"
 )
 
 // EvtLocalReachabilityChanged is an event struct to be emitted when the local's
@@ -11,3 +13,19 @@ import (
 type EvtLocalReachabilityChanged struct {
 	Reachability network.Reachability
 }
+
+// EvtAddrReachabilityChanged is an event struct to be emitted when the reachability of one of the
+// local node's addresses changes state, including when it is determined for the first time. Checks
+// that confirm the current reachability don't emit the event.
+//
+// This event is usually emitted by the AutoNAT v2 subsystem.
+type EvtAddrReachabilityChanged struct {
+	// Addr is the address that was checked
+	Addr ma.Multiaddr
+	// Reachability is the new reachability of Addr. It is either public or private.
+	Reachability network.Reachability
+	// Confirmations is the number of consecutive checks that determined Reachability when the
+	// event was emitted. AutoNAT v2 reports a change as soon as one check determines it, so its
+	// events have one confirmation.
+	Confirmations int
+}
@@ -403,6 +403,17 @@ func TestAutoNATv2Service(t *testing.T) {
 	h.Close()
 }
 
+func TestAutoNATv2DialerPortRange(t *testing.T) {
+	_, err := New(AutoNATv2DialerPortRange(0, 10))
+	require.Error(t, err)
+	_, err = New(AutoNATv2DialerPortRange(20, 10))
+	require.Error(t, err)
+
+	h, err := New(EnableAutoNATv2(), AutoNATv2DialerPortRange(40000, 41000))
+	require.NoError(t, err)
+	h.Close()
+}
+
 func TestDisableIdentifyAddressDiscovery(t *testing.T) {
 	h, err := New(DisableIdentifyAddressDiscovery())
 	require.NoError(t, err)
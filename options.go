@@ -618,6 +618,23 @@ func EnableAutoNATv2() Option {
 	}
 }
 
+// AutoNATv2DialerPortRange makes the host used by autonat v2 for dialing back peers listen on the
+// first port in [minPort, maxPort] that is available for TCP and QUIC on all IPv4 interfaces. It
+// also listens on the port on IPv6 interfaces if possible. With port reuse, which is enabled by
+// default, dial backs use this port as source port. This lets operators behind restrictive
+// firewalls allow the dial backs. The dialer host only listens to dial from the port: it rejects
+// all inbound connections, and uses its own resource manager rather than the host's.
+func AutoNATv2DialerPortRange(minPort, maxPort int) Option {
+	return func(cfg *Config) error {
+		if minPort <= 0 || maxPort > 65535 || minPort > maxPort {
+			return fmt.Errorf("invalid port range [%d, %d]", minPort, maxPort)
+		}
+		cfg.AutoNATv2DialerMinPort = minPort
+		cfg.AutoNATv2DialerMaxPort = maxPort
+		return nil
+	}
+}
+
 // UDPBlackHoleSuccessCounter configures libp2p to use f as the black hole filter for UDP addrs
 func UDPBlackHoleSuccessCounter(f *swarm.BlackHoleSuccessCounter) Option {
 	return func(cfg *Config) error {
@@ -421,6 +421,49 @@ func (s *Swarm) CanDial(p peer.ID, addr ma.Multiaddr) bool {
 	return len(dialable) > 0
 }
 
+// DialAddrDetached dials p on addr, even if the swarm is already connected to p. The dial is subject
+// to the connection gater, the address filters and the dial limiter, like any other dial, but the
+// connection isn't added to the swarm: no notifications are sent, incoming streams aren't handled
+// and the gater's InterceptUpgraded isn't called. The caller must close the connection.
+// Like DialPeer, it refuses proxy addresses, e.g. relay addresses, if network.WithForceDirectDial
+// is used.
+//
+// This is used by the AutoNAT v2 server to dial back peers it is already connected to.
+func (s *Swarm) DialAddrDetached(ctx context.Context, p peer.ID, addr ma.Multiaddr) (transport.CapableConn, error) {
+	if p == s.local {
+		return nil, ErrDialToSelf
+	}
+	if s.gater != nil && !s.gater.InterceptPeerDial(p) {
+		return nil, &DialError{Peer: p, Cause: ErrGaterDisallowedConnection}
+	}
+	good, addrErrs := s.filterKnownUndialables(p, []ma.Multiaddr{addr})
+	if forceDirect, _ := network.GetForceDirectDial(ctx); forceDirect {
+		good = ma.FilterAddrs(good, s.nonProxyAddr)
+	}
+	if len(good) == 0 {
+		return nil, &DialError{Peer: p, DialErrors: addrErrs, Cause: ErrNoGoodAddresses}
+	}
+
+	// The channel must be unbuffered: if ctx is done before we receive the result, the limiter
+	// closes the connection.
+	resch := make(chan transport.DialUpdate)
+	s.limitedDial(ctx, p, addr, resch)
+	for {
+		select {
+		case res := <-resch:
+			if res.Kind == transport.UpdateKindHandshakeProgressed {
+				continue
+			}
+			if res.Err != nil {
+				return nil, &DialError{Peer: p, DialErrors: []TransportError{{Address: addr, Cause: res.Err}}}
+			}
+			return res.Conn, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
 func (s *Swarm) nonProxyAddr(addr ma.Multiaddr) bool {
 	t := s.TransportForDialing(addr)
 	return !t.Proxy()
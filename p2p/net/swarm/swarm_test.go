@@ -416,6 +416,50 @@ func TestPreventDialListenAddr(t *testing.T) {
 	}
 }
 
+func TestDialAddrDetached(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(t, 2)
+	connectSwarms(t, ctx, swarms)
+	s1, s2 := swarms[0], swarms[1]
+	addr := s2.ListenAddresses()[0]
+
+	c, err := s1.DialAddrDetached(ctx, s2.LocalPeer(), addr)
+	require.NoError(t, err)
+	defer c.Close()
+	require.Equal(t, s2.LocalPeer(), c.RemotePeer())
+	// the connection isn't added to the swarm
+	require.Len(t, s1.ConnsToPeer(s2.LocalPeer()), 1)
+
+	t.Run("peer dial gated", func(t *testing.T) {
+		gater := DefaultMockConnectionGater()
+		gater.PeerDial = func(peer.ID) bool { return false }
+		s := GenSwarm(t, OptConnGater(gater))
+		_, err := s.DialAddrDetached(ctx, s2.LocalPeer(), addr)
+		require.ErrorIs(t, err, swarm.ErrGaterDisallowedConnection)
+	})
+
+	t.Run("addr dial gated", func(t *testing.T) {
+		gater := DefaultMockConnectionGater()
+		gater.Dial = func(peer.ID, ma.Multiaddr) bool { return false }
+		s := GenSwarm(t, OptConnGater(gater))
+		_, err := s.DialAddrDetached(ctx, s2.LocalPeer(), addr)
+		require.ErrorIs(t, err, swarm.ErrGaterDisallowedConnection)
+	})
+
+	t.Run("dial to self", func(t *testing.T) {
+		_, err := s1.DialAddrDetached(ctx, s1.LocalPeer(), s1.ListenAddresses()[0])
+		require.ErrorIs(t, err, swarm.ErrDialToSelf)
+	})
+
+	t.Run("force direct dial", func(t *testing.T) {
+		s := GenSwarm(t)
+		require.NoError(t, s.AddTransport(&dummyTransport{protocols: []int{ma.P_CIRCUIT}, proxy: true}))
+		relayAddr := ma.StringCast(fmt.Sprintf("/ip4/1.2.3.4/tcp/1/p2p/%s/p2p-circuit", s1.LocalPeer()))
+		_, err := s.DialAddrDetached(network.WithForceDirectDial(ctx, "test"), s2.LocalPeer(), relayAddr)
+		require.ErrorIs(t, err, swarm.ErrNoGoodAddresses)
+	})
+}
+
 func TestStreamCount(t *testing.T) {
 	s1 := GenSwarm(t)
 	s2 := GenSwarm(t)
@@ -33,18 +33,66 @@ const (
 	dialBackMaxMsgSize    = 1024
 	minHandshakeSizeBytes = 30_000 // for amplification attack prevention
 	maxHandshakeSizeBytes = 100_000
-	// maxPeerAddresses is the number of addresses in a dial request the server
-	// will inspect, rest are ignored.
-	maxPeerAddresses = 50
+	// dialBackResponseTimeout is the time the server waits for the client's response to the
+	// dial back message after closing its side of the dial back stream.
+	dialBackResponseTimeout = 5 * time.Second
+	// defaultMinDialDataChunkSize is the default minimum size of a dial data message. Smaller
+	// messages are rejected to prevent peers from forcing us to do a lot of compute.
+	defaultMinDialDataChunkSize = 100
+	// defaultMaxPeerAddresses is the default number of addresses in a dial request
+	// the server will inspect, rest are ignored.
+	defaultMaxPeerAddresses = 50
+	// excessivePeerAddressesFactor bounds the number of addresses in a dial request relative to
+	// the server's max peer addresses. Requests with fewer addresses are truncated, requests with
+	// more are likely abusive and are rejected.
+	excessivePeerAddressesFactor = 4
+	// defaultMaxAddrBytes is the default maximum length of an address in a dial request. Longer
+	// addresses are skipped without being parsed.
+	defaultMaxAddrBytes = 512
+	// canDialCacheTTL is how long the server caches whether it can dial an address
+	canDialCacheTTL = 10 * time.Second
+	// maxCanDialCacheSize is the maximum number of peer and address pairs in the server's can dial
+	// cache
+	maxCanDialCacheSize = 1000
+	// rateLimiterCleanupInterval is the minimum interval between removing stale requests from the
+	// server's rate limiter. A random jitter of up to half the interval is added.
+	rateLimiterCleanupInterval = time.Second
+	// localFamiliesTTL is how long the server caches the IP families of the host's interface
+	// addresses
+	localFamiliesTTL = time.Minute
 )
 
 var (
 	ErrNoValidPeers = errors.New("no valid peers for autonat v2")
 	ErrDialRefused  = errors.New("dial refused")
+	// ErrPrivateAddrs is returned along with ErrDialRefused when the server refused the
+	// request because none of the addresses were public.
+	ErrPrivateAddrs = errors.New("private addrs")
+	// ErrRequestRejected is returned when the server rejected the request, for example because of
+	// rate limiting.
+	ErrRequestRejected = errors.New("request rejected")
+	// ErrServerBusy is returned along with ErrRequestRejected when the server rejected the request
+	// because it reached its global rate limit.
+	ErrServerBusy = errors.New("server busy")
 
 	log = logging.Logger("autonatv2")
 )
 
+// RefusedAddrsError is returned along with ErrDialRefused when the server reported why it refused
+// each of the addresses it inspected. See WithServerRefusedAddrsReport.
+type RefusedAddrsError struct {
+	// Private are the addresses refused for not being public
+	Private []ma.Multiaddr
+	// Undialable are the addresses the server can't or won't dial
+	Undialable []ma.Multiaddr
+	// Invalid are the addresses the server couldn't parse
+	Invalid []ma.Multiaddr
+}
+
+func (e *RefusedAddrsError) Error() string {
+	return fmt.Sprintf("refused addrs: private: %v, undialable: %v, invalid: %v", e.Private, e.Undialable, e.Invalid)
+}
+
 // Request is the request to verify reachability of a single address
 type Request struct {
 	// Addr is the multiaddr to verify
@@ -61,6 +109,11 @@ type Result struct {
 	Reachability network.Reachability
 	// Status is the outcome of the dialback
 	Status pb.DialStatus
+	// Server is the AutoNAT v2 server that verified the address
+	Server peer.ID
+	// RTT is the time the server reported for dialing back the address and getting the dial back
+	// acknowledged. It is zero if the dial back failed or the server didn't report it.
+	RTT time.Duration
 }
 
 // AutoNAT implements the AutoNAT v2 client and server.
@@ -77,8 +130,16 @@ type AutoNAT struct {
 	srv *server
 	cli *client
 
-	mx    sync.Mutex
-	peers *peersMap
+	mx       sync.Mutex
+	peers    *peersMap
+	selector ServerSelector
+	// addrReachability tracks the last determined reachability of checked addresses. Entries are
+	// removed when the host stops using the address.
+	addrReachability map[string]addrReachability
+	// emitMu serializes updating addrReachability and emitting the resulting events, so that
+	// events for an address are emitted in the order of the updates
+	emitMu  sync.Mutex
+	emitter event.Emitter
 	// allowPrivateAddrs enables using private and localhost addresses for reachability checks.
 	// This is only useful for testing.
 	allowPrivateAddrs bool
@@ -87,6 +148,12 @@ type AutoNAT struct {
 // New returns a new AutoNAT instance.
 // host and dialerHost should have the same dialing capabilities. In case the host doesn't support
 // a transport, dial back requests for address for that transport will be ignored.
+//
+// If dialerHost is nil, the server dials back peers with host's swarm on a transient connection
+// that is never added to the swarm or host's peerstore. The dial back goes through host's
+// connection gater, resource manager and dial limiter. This is simpler to set up but less isolated
+// than using a separate dialer host: dial backs share host's identity and resource limits. This
+// requires host's network to be a swarm.
 func New(host host.Host, dialerHost host.Host, opts ...AutoNATOption) (*AutoNAT, error) {
 	s := defaultSettings()
 	for _, o := range opts {
@@ -94,6 +161,16 @@ func New(host host.Host, dialerHost host.Host, opts ...AutoNATOption) (*AutoNAT,
 			return nil, fmt.Errorf("failed to apply option: %w", err)
 		}
 	}
+	if dialerHost == nil {
+		if _, ok := host.Network().(detachedDialer); !ok {
+			return nil, errors.New("dialer host is required: host's network can't dial detached connections")
+		}
+	}
+
+	emitter, err := host.EventBus().Emitter(new(event.EvtAddrReachabilityChanged))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create emitter: %w", err)
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	an := &AutoNAT{
@@ -101,9 +178,12 @@ func New(host host.Host, dialerHost host.Host, opts ...AutoNATOption) (*AutoNAT,
 		ctx:               ctx,
 		cancel:            cancel,
 		srv:               newServer(host, dialerHost, s),
-		cli:               newClient(host),
+		cli:               newClient(host, s),
 		allowPrivateAddrs: s.allowPrivateAddrs,
 		peers:             newPeersMap(),
+		selector:          s.serverSelector,
+		addrReachability:  make(map[string]addrReachability),
+		emitter:           emitter,
 	}
 	return an, nil
 }
@@ -123,6 +203,8 @@ func (an *AutoNAT) background(sub event.Subscription) {
 				an.updatePeer(evt.Peer)
 			case event.EvtPeerIdentificationCompleted:
 				an.updatePeer(evt.Peer)
+			case event.EvtLocalAddressesUpdated:
+				an.removeAddrReachability(evt.Removed)
 			}
 		}
 	}
@@ -131,10 +213,12 @@ func (an *AutoNAT) background(sub event.Subscription) {
 func (an *AutoNAT) Start() error {
 	// Listen on event.EvtPeerProtocolsUpdated, event.EvtPeerConnectednessChanged
 	// event.EvtPeerIdentificationCompleted to maintain our set of autonat supporting peers.
+	// Listen on event.EvtLocalAddressesUpdated to forget the reachability of removed addresses.
 	sub, err := an.host.EventBus().Subscribe([]interface{}{
 		new(event.EvtPeerProtocolsUpdated),
 		new(event.EvtPeerConnectednessChanged),
 		new(event.EvtPeerIdentificationCompleted),
+		new(event.EvtLocalAddressesUpdated),
 	})
 	if err != nil {
 		return fmt.Errorf("event subscription failed: %w", err)
@@ -152,9 +236,28 @@ func (an *AutoNAT) Close() {
 	an.wg.Wait()
 	an.srv.Close()
 	an.cli.Close()
+	an.emitter.Close()
 	an.peers = nil
 }
 
+// Shutdown is like Close but waits for the server's in progress dial requests to complete. If ctx is
+// done before they complete, the context's error is returned.
+func (an *AutoNAT) Shutdown(ctx context.Context) error {
+	an.cancel()
+	an.wg.Wait()
+	err := an.srv.Shutdown(ctx)
+	an.cli.Close()
+	an.emitter.Close()
+	an.peers = nil
+	return err
+}
+
+// RateLimiterSnapshot returns a snapshot of the state of the server's rate limiter. This is useful
+// for debugging why the server rejects requests.
+func (an *AutoNAT) RateLimiterSnapshot() RateLimiterStats {
+	return an.srv.RateLimiterSnapshot()
+}
+
 // GetReachability makes a single dial request for checking reachability for requested addresses
 func (an *AutoNAT) GetReachability(ctx context.Context, reqs []Request) (Result, error) {
 	if !an.allowPrivateAddrs {
@@ -165,21 +268,83 @@ func (an *AutoNAT) GetReachability(ctx context.Context, reqs []Request) (Result,
 		}
 	}
 	an.mx.Lock()
-	p := an.peers.GetRand()
+	var p peer.ID
+	if len(an.peers.peers) > 0 {
+		p = an.selector.SelectServer(an.peers.peers)
+	}
 	an.mx.Unlock()
 	if p == "" {
 		return Result{}, ErrNoValidPeers
 	}
 
 	res, err := an.cli.GetReachability(ctx, p, reqs)
+	an.mx.Lock()
+	an.selector.UpdateServer(p, res, err)
+	an.mx.Unlock()
 	if err != nil {
 		log.Debugf("reachability check with %s failed, err: %s", p, err)
 		return Result{}, fmt.Errorf("reachability check with %s failed: %w", p, err)
 	}
 	log.Debugf("reachability check with %s successful", p)
+	res.Server = p
+	an.updateAddrReachability(res)
 	return res, nil
 }
 
+// CheckReachability makes a dial request for verifying the reachability of addr. The server used for
+// the request is selected the same way as in GetReachability and is reported in the Result.
+// Dial data is sent if the server requests it.
+func (an *AutoNAT) CheckReachability(ctx context.Context, addr ma.Multiaddr) (Result, error) {
+	return an.GetReachability(ctx, []Request{{Addr: addr, SendDialData: true}})
+}
+
+type addrReachability struct {
+	Reachability  network.Reachability
+	Confirmations int
+}
+
+// updateAddrReachability records the result of a reachability check and emits an
+// EvtAddrReachabilityChanged event if the address's reachability changed.
+func (an *AutoNAT) updateAddrReachability(res Result) {
+	if res.Reachability != network.ReachabilityPublic && res.Reachability != network.ReachabilityPrivate {
+		return
+	}
+	an.emitMu.Lock()
+	defer an.emitMu.Unlock()
+
+	an.mx.Lock()
+	k := string(res.Addr.Bytes())
+	ar := an.addrReachability[k]
+	changed := ar.Reachability != res.Reachability
+	if changed {
+		ar = addrReachability{Reachability: res.Reachability, Confirmations: 1}
+	} else {
+		ar.Confirmations++
+	}
+	an.addrReachability[k] = ar
+	an.mx.Unlock()
+
+	if !changed {
+		return
+	}
+	if err := an.emitter.Emit(event.EvtAddrReachabilityChanged{
+		Addr:          res.Addr,
+		Reachability:  ar.Reachability,
+		Confirmations: ar.Confirmations,
+	}); err != nil {
+		log.Debugf("failed to emit reachability changed event for %s: %s", res.Addr, err)
+	}
+}
+
+// removeAddrReachability forgets the reachability of addrs.
+func (an *AutoNAT) removeAddrReachability(addrs []event.UpdatedAddress) {
+	an.mx.Lock()
+	defer an.mx.Unlock()
+	for _, a := range addrs {
+		delete(an.addrReachability, string(a.Address.Bytes()))
+	}
+}
+
 func (an *AutoNAT) updatePeer(p peer.ID) {
 	an.mx.Lock()
 	defer an.mx.Unlock()
@@ -192,9 +357,20 @@ func (an *AutoNAT) updatePeer(p peer.ID) {
 		an.peers.Put(p)
 	} else {
 		an.peers.Delete(p)
+		an.selector.RemoveServer(p)
 	}
 }
 
+func isRelayAddr(a ma.Multiaddr) bool {
+	_, err := a.ValueForProtocol(ma.P_CIRCUIT)
+	return err == nil
+}
+
+func isIP6ZoneAddr(a ma.Multiaddr) bool {
+	_, err := a.ValueForProtocol(ma.P_IP6ZONE)
+	return err == nil
+}
+
 // peersMap provides random access to a set of peers. This is useful when the map iteration order is
 // not sufficiently random.
 type peersMap struct {
@@ -8,6 +8,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/libp2p/go-libp2p/core/event"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
@@ -551,6 +552,213 @@ func TestEventSubscription(t *testing.T) {
 	}, 5*time.Second, 100*time.Millisecond)
 }
 
+func TestClientDialDataLimits(t *testing.T) {
+	const numBytes = 50_000
+	mt := newMockMetricsTracer()
+	an := newAutoNAT(t, nil, allowPrivateAddrs, WithMetricsTracer(mt),
+		WithServerDataRequestPolicy(func(s network.Stream, dialAddr ma.Multiaddr) bool { return true }),
+		WithServerDialDataSize(func(dialAddr ma.Multiaddr) int { return numBytes }),
+		withAmplificationAttackPreventionDialWait(0),
+	)
+	defer an.Close()
+	defer an.host.Close()
+
+	lastEvent := func() EventDialRequestCompleted {
+		t.Helper()
+		var e EventDialRequestCompleted
+		require.Eventually(t, func() bool {
+			mt.mu.Lock()
+			defer mt.mu.Unlock()
+			if len(mt.completed) == 0 {
+				return false
+			}
+			e = mt.completed[len(mt.completed)-1]
+			mt.completed = nil
+			return true
+		}, 5*time.Second, 10*time.Millisecond)
+		return e
+	}
+
+	t.Run("over the cap", func(t *testing.T) {
+		c := newAutoNAT(t, nil, allowPrivateAddrs, WithClientMaxDialDataBytes(numBytes-1))
+		defer c.Close()
+		defer c.host.Close()
+		idAndWait(t, c, an)
+
+		_, err := c.CheckReachability(context.Background(), c.host.Addrs()[0])
+		require.ErrorContains(t, err, "requested data too high")
+		require.ErrorIs(t, lastEvent().Error, errDialDataRefused)
+	})
+
+	t.Run("within the cap", func(t *testing.T) {
+		c := newAutoNAT(t, nil, allowPrivateAddrs, WithClientMaxDialDataBytes(numBytes))
+		defer c.Close()
+		defer c.host.Close()
+		idAndWait(t, c, an)
+
+		res, err := c.CheckReachability(context.Background(), c.host.Addrs()[0])
+		require.NoError(t, err)
+		require.Equal(t, pb.DialStatus_OK, res.Status)
+		require.NoError(t, lastEvent().Error)
+	})
+
+	for _, consent := range []bool{true, false} {
+		t.Run(fmt.Sprintf("consent %t", consent), func(t *testing.T) {
+			var gotServer peer.ID
+			var gotNumBytes uint64
+			c := newAutoNAT(t, nil, allowPrivateAddrs, WithClientDialDataConsent(func(server peer.ID, n uint64) bool {
+				gotServer, gotNumBytes = server, n
+				return consent
+			}))
+			defer c.Close()
+			defer c.host.Close()
+			idAndWait(t, c, an)
+
+			res, err := c.CheckReachability(context.Background(), c.host.Addrs()[0])
+			require.Equal(t, an.host.ID(), gotServer)
+			require.Equal(t, uint64(numBytes), gotNumBytes)
+			if consent {
+				require.NoError(t, err)
+				require.Equal(t, pb.DialStatus_OK, res.Status)
+				require.NoError(t, lastEvent().Error)
+			} else {
+				require.ErrorContains(t, err, "dial data request refused")
+				require.ErrorIs(t, lastEvent().Error, errDialDataRefused)
+			}
+		})
+	}
+}
+
+func TestCheckReachability(t *testing.T) {
+	an := newAutoNAT(t, nil, allowPrivateAddrs)
+	defer an.Close()
+	defer an.host.Close()
+
+	c := newAutoNAT(t, nil, allowPrivateAddrs)
+	defer c.Close()
+	defer c.host.Close()
+
+	_, err := c.CheckReachability(context.Background(), c.host.Addrs()[0])
+	require.ErrorIs(t, err, ErrNoValidPeers)
+
+	idAndWait(t, c, an)
+
+	for _, a := range c.host.Addrs() {
+		res, err := c.CheckReachability(context.Background(), a)
+		require.NoError(t, err)
+		require.Equal(t, Result{
+			Addr:         a,
+			Reachability: network.ReachabilityPublic,
+			Status:       pb.DialStatus_OK,
+			Server:       an.host.ID(),
+		}, withoutRTT(t, res))
+	}
+
+	res, err := c.CheckReachability(context.Background(), ma.StringCast("/ip4/1.2.3.4/tcp/2"))
+	require.NoError(t, err)
+	require.Equal(t, pb.DialStatus_E_DIAL_ERROR, res.Status)
+	require.Equal(t, network.ReachabilityPrivate, res.Reachability)
+}
+
+func TestAddrReachabilityChangedEvent(t *testing.T) {
+	an := newAutoNAT(t, nil, allowPrivateAddrs)
+	defer an.Close()
+	defer an.host.Close()
+
+	c := newAutoNAT(t, nil, allowPrivateAddrs)
+	defer c.Close()
+	defer c.host.Close()
+
+	idAndWait(t, c, an)
+
+	sub, err := c.host.EventBus().Subscribe(new(event.EvtAddrReachabilityChanged))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	var tcpAddr ma.Multiaddr
+	for _, a := range c.host.Addrs() {
+		if _, err := a.ValueForProtocol(ma.P_TCP); err == nil {
+			tcpAddr = a
+			break
+		}
+	}
+	reqs := newTestRequests([]ma.Multiaddr{tcpAddr}, false)
+
+	expectEvent := func(rch network.Reachability, confirmations int) {
+		t.Helper()
+		select {
+		case e := <-sub.Out():
+			evt := e.(event.EvtAddrReachabilityChanged)
+			require.True(t, tcpAddr.Equal(evt.Addr))
+			require.Equal(t, rch, evt.Reachability)
+			require.Equal(t, confirmations, evt.Confirmations)
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected event")
+		}
+	}
+
+	// first confirmation
+	_, err = c.GetReachability(context.Background(), reqs)
+	require.NoError(t, err)
+	expectEvent(network.ReachabilityPublic, 1)
+
+	// reachability didn't change
+	_, err = c.GetReachability(context.Background(), reqs)
+	require.NoError(t, err)
+	select {
+	case e := <-sub.Out():
+		t.Fatalf("unexpected event: %+v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+	c.mx.Lock()
+	require.Equal(t, 2, c.addrReachability[string(tcpAddr.Bytes())].Confirmations)
+	c.mx.Unlock()
+
+	// flip to private by closing the listener
+	c.host.Network().(*swarm.Swarm).ListenClose(tcpAddr)
+	res, err := c.GetReachability(context.Background(), reqs)
+	require.NoError(t, err)
+	require.Equal(t, network.ReachabilityPrivate, res.Reachability)
+	expectEvent(network.ReachabilityPrivate, 1)
+}
+
+func TestAddrReachabilityRemovedAddrs(t *testing.T) {
+	an := newAutoNAT(t, nil, allowPrivateAddrs)
+	defer an.Close()
+	defer an.host.Close()
+
+	c := newAutoNAT(t, nil, allowPrivateAddrs)
+	defer c.Close()
+	defer c.host.Close()
+
+	idAndWait(t, c, an)
+
+	addrs := c.host.Addrs()
+	for _, a := range addrs {
+		_, err := c.CheckReachability(context.Background(), a)
+		require.NoError(t, err)
+	}
+	c.mx.Lock()
+	require.Len(t, c.addrReachability, len(addrs))
+	c.mx.Unlock()
+
+	em, err := c.host.EventBus().Emitter(new(event.EvtLocalAddressesUpdated))
+	require.NoError(t, err)
+	defer em.Close()
+	require.NoError(t, em.Emit(event.EvtLocalAddressesUpdated{
+		Diffs:   true,
+		Current: []event.UpdatedAddress{{Address: addrs[1], Action: event.Maintained}},
+		Removed: []event.UpdatedAddress{{Address: addrs[0], Action: event.Removed}},
+	}))
+
+	require.Eventually(t, func() bool {
+		c.mx.Lock()
+		defer c.mx.Unlock()
+		_, ok := c.addrReachability[string(addrs[0].Bytes())]
+		return !ok && len(c.addrReachability) == len(addrs)-1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
 func TestPeersMap(t *testing.T) {
 	emptyPeerID := peer.ID("")
 
@@ -3,6 +3,7 @@ package autonatv2
 import (
 	"context"
 	"fmt"
+	"io"
 	"sync"
 	"time"
 
@@ -23,6 +24,12 @@ type client struct {
 	host               host.Host
 	dialData           []byte
 	normalizeMultiaddr func(ma.Multiaddr) ma.Multiaddr
+	// maxDialDataBytes is the maximum amount of dial data the client sends for a request
+	maxDialDataBytes uint64
+	// dialDataConsent decides whether to send the requested dial data to a server. When nil, all dial
+	// data requests within maxDialDataBytes are accepted.
+	dialDataConsent dialDataConsentFunc
+	clock           Clock
 
 	mu sync.Mutex
 	// dialBackQueues maps nonce to the channel for providing the local multiaddr of the connection
@@ -30,11 +37,13 @@ type client struct {
 	dialBackQueues map[uint64]chan ma.Multiaddr
 }
 
+type dialDataConsentFunc = func(server peer.ID, numBytes uint64) bool
+
 type normalizeMultiaddrer interface {
 	NormalizeMultiaddr(ma.Multiaddr) ma.Multiaddr
 }
 
-func newClient(h host.Host) *client {
+func newClient(h host.Host, s *autoNATSettings) *client {
 	normalizeMultiaddr := func(a ma.Multiaddr) ma.Multiaddr { return a }
 	if hn, ok := h.(normalizeMultiaddrer); ok {
 		normalizeMultiaddr = hn.NormalizeMultiaddr
@@ -43,6 +52,9 @@ func newClient(h host.Host) *client {
 		host:               h,
 		dialData:           make([]byte, 4000),
 		normalizeMultiaddr: normalizeMultiaddr,
+		maxDialDataBytes:   s.clientMaxDialDataBytes,
+		dialDataConsent:    s.clientDialDataConsent,
+		clock:              s.clock,
 		dialBackQueues:     make(map[uint64]chan ma.Multiaddr),
 	}
 }
@@ -57,7 +69,7 @@ func (ac *client) Close() {
 
 // GetReachability verifies address reachability with a AutoNAT v2 server p.
 func (ac *client) GetReachability(ctx context.Context, p peer.ID, reqs []Request) (Result, error) {
-	ctx, cancel := context.WithTimeout(ctx, streamTimeout)
+	ctx, cancel := contextWithTimeout(ctx, ac.clock, streamTimeout)
 	defer cancel()
 
 	s, err := ac.host.NewStream(ctx, p, DialProtocol)
@@ -76,7 +88,9 @@ func (ac *client) GetReachability(ctx context.Context, p peer.ID, reqs []Request
 	}
 	defer s.Scope().ReleaseMemory(maxMsgSize)
 
-	s.SetDeadline(time.Now().Add(streamTimeout))
+	deadline := newStreamDeadline(ac.clock, s)
+	deadline.Set(streamTimeout)
+	defer deadline.Stop()
 	defer s.Close()
 
 	nonce := rand.Uint64()
@@ -108,8 +122,8 @@ func (ac *client) GetReachability(ctx context.Context, p peer.ID, reqs []Request
 		break
 	// provide dial data if appropriate
 	case msg.GetDialDataRequest() != nil:
-		if err := ac.validateDialDataRequest(reqs, &msg); err != nil {
-			s.Reset()
+		if err := ac.validateDialDataRequest(p, reqs, &msg); err != nil {
+			refuseDialData(s)
 			return Result{}, fmt.Errorf("invalid dial data request: %w", err)
 		}
 		// dial data request is valid and we want to send data
@@ -135,7 +149,22 @@ func (ac *client) GetReachability(ctx context.Context, p peer.ID, reqs []Request
 		// E_DIAL_REFUSED has implication for deciding future address verificiation priorities
 		// wrap a distinct error for convenient errors.Is usage
 		if resp.GetStatus() == pb.DialResponse_E_DIAL_REFUSED {
-			return Result{}, fmt.Errorf("dial request failed: %w", ErrDialRefused)
+			err := ErrDialRefused
+			if resp.GetAllAddrsPrivate() {
+				err = fmt.Errorf("%w: %w", ErrDialRefused, ErrPrivateAddrs)
+			}
+			if rerr := newRefusedAddrsError(resp, reqs); rerr != nil {
+				return Result{}, fmt.Errorf("dial request failed: %w: %w", err, rerr)
+			}
+			return Result{}, fmt.Errorf("dial request failed: %w", err)
+		}
+		if resp.GetStatus() == pb.DialResponse_E_REQUEST_REJECTED {
+			if resp.GetBusy() {
+				return Result{}, fmt.Errorf("dial request failed: response status %d %s: %w: %w", resp.GetStatus(),
+					pb.DialResponse_ResponseStatus_name[int32(resp.GetStatus())], ErrRequestRejected, ErrServerBusy)
+			}
+			return Result{}, fmt.Errorf("dial request failed: response status %d %s: %w", resp.GetStatus(),
+				pb.DialResponse_ResponseStatus_name[int32(resp.GetStatus())], ErrRequestRejected)
 		}
 		return Result{}, fmt.Errorf("dial request failed: response status %d %s", resp.GetStatus(),
 			pb.DialResponse_ResponseStatus_name[int32(resp.GetStatus())])
@@ -150,29 +179,42 @@ func (ac *client) GetReachability(ctx context.Context, p peer.ID, reqs []Request
 	// wait for nonce from the server
 	var dialBackAddr ma.Multiaddr
 	if resp.GetDialStatus() == pb.DialStatus_OK {
-		timer := time.NewTimer(dialBackStreamTimeout)
+		timer := ac.clock.InstantTimer(ac.clock.Now().Add(dialBackStreamTimeout))
 		select {
 		case at := <-ch:
 			dialBackAddr = at
 		case <-ctx.Done():
-		case <-timer.C:
+		case <-timer.Ch():
 		}
 		timer.Stop()
 	}
 	return ac.newResult(resp, reqs, dialBackAddr)
 }
 
-func (ac *client) validateDialDataRequest(reqs []Request, msg *pb.Message) error {
+// refuseDialData ends the stream after refusing a dial data request. Instead of resetting the stream
+// right away, the client closes its side and waits for the server to end the request, so that a
+// request sent right after this one isn't rejected by the server's per peer concurrency limit.
+func refuseDialData(s network.Stream) {
+	s.CloseWrite()
+	io.Copy(io.Discard, io.LimitReader(s, maxMsgSize))
+	s.Reset()
+}
+
+func (ac *client) validateDialDataRequest(p peer.ID, reqs []Request, msg *pb.Message) error {
 	idx := int(msg.GetDialDataRequest().AddrIdx)
+	numBytes := msg.GetDialDataRequest().NumBytes
 	if idx >= len(reqs) { // invalid address index
 		return fmt.Errorf("addr index out of range: %d [0-%d)", idx, len(reqs))
 	}
-	if msg.GetDialDataRequest().NumBytes > maxHandshakeSizeBytes { // data request is too high
-		return fmt.Errorf("requested data too high: %d", msg.GetDialDataRequest().NumBytes)
+	if numBytes > ac.maxDialDataBytes { // data request is too high
+		return fmt.Errorf("requested data too high: %d", numBytes)
 	}
 	if !reqs[idx].SendDialData { // low priority addr
 		return fmt.Errorf("low priority addr: %s index %d", reqs[idx].Addr, idx)
 	}
+	if ac.dialDataConsent != nil && !ac.dialDataConsent(p, numBytes) {
+		return fmt.Errorf("dial data request refused: %d bytes", numBytes)
+	}
 	return nil
 }
 
@@ -207,13 +249,41 @@ func (ac *client) newResult(resp *pb.DialResponse, reqs []Request, dialBackAddr
 		return Result{}, fmt.Errorf("invalid response: invalid status code for addr %s: %d", addr, resp.DialStatus)
 	}
 
+	var rtt time.Duration
+	if resp.DialStatus == pb.DialStatus_OK {
+		rtt = time.Duration(resp.DialBackRTTMicros) * time.Microsecond
+	}
 	return Result{
 		Addr:         addr,
 		Reachability: rch,
 		Status:       resp.DialStatus,
+		RTT:          rtt,
 	}, nil
 }
 
+// newRefusedAddrsError returns the refused addresses reported in resp, or nil if the server didn't
+// report them. Indexes out of range of reqs are ignored.
+func newRefusedAddrsError(resp *pb.DialResponse, reqs []Request) *RefusedAddrsError {
+	addrs := func(idxs []uint32) []ma.Multiaddr {
+		var res []ma.Multiaddr
+		for _, idx := range idxs {
+			if int(idx) < len(reqs) {
+				res = append(res, reqs[idx].Addr)
+			}
+		}
+		return res
+	}
+	e := &RefusedAddrsError{
+		Private:    addrs(resp.GetPrivateAddrIdxs()),
+		Undialable: addrs(resp.GetUndialableAddrIdxs()),
+		Invalid:    addrs(resp.GetInvalidAddrIdxs()),
+	}
+	if len(e.Private) == 0 && len(e.Undialable) == 0 && len(e.Invalid) == 0 {
+		return nil
+	}
+	return e
+}
+
 func sendDialData(dialData []byte, numBytes int, w pbio.Writer, msg *pb.Message) (err error) {
 	ddResp := &pb.DialDataResponse{Data: dialData}
 	*msg = pb.Message{
@@ -263,7 +333,9 @@ func (ac *client) handleDialBack(s network.Stream) {
 	}
 	defer s.Scope().ReleaseMemory(dialBackMaxMsgSize)
 
-	s.SetDeadline(time.Now().Add(dialBackStreamTimeout))
+	deadline := newStreamDeadline(ac.clock, s)
+	deadline.Set(dialBackStreamTimeout)
+	defer deadline.Stop()
 	defer s.Close()
 
 	r := pbio.NewDelimitedReader(s, dialBackMaxMsgSize)
@@ -280,18 +352,28 @@ func (ac *client) handleDialBack(s network.Stream) {
 	ac.mu.Unlock()
 	if ch == nil {
 		log.Debugf("dialback received with invalid nonce: localAdds: %s peer: %s nonce: %d", s.Conn().LocalMultiaddr(), s.Conn().RemotePeer(), nonce)
-		s.Reset()
+		w := pbio.NewDelimitedWriter(s)
+		if err := w.WriteMsg(&pb.DialBackResponse{Status: pb.DialBackResponse_E_INVALID_NONCE, Nonce: nonce}); err != nil {
+			log.Debugf("failed to write dialback response: %s", err)
+			s.Reset()
+		}
 		return
 	}
+	localAddr := s.Conn().LocalMultiaddr()
+	if isRelayAddr(s.Conn().RemoteMultiaddr()) {
+		// For relayed connections, the local address is the address of our connection to the relay.
+		// The dialed address is the relay's circuit address, which is what the remote multiaddr is.
+		localAddr = s.Conn().RemoteMultiaddr()
+	}
 	select {
-	case ch <- s.Conn().LocalMultiaddr():
+	case ch <- localAddr:
 	default:
 		log.Debugf("multiple dialbacks received: localAddr: %s peer: %s", s.Conn().LocalMultiaddr(), s.Conn().RemotePeer())
 		s.Reset()
 		return
 	}
 	w := pbio.NewDelimitedWriter(s)
-	res := pb.DialBackResponse{}
+	res := pb.DialBackResponse{Nonce: nonce}
 	if err := w.WriteMsg(&res); err != nil {
 		log.Debugf("failed to write dialback response: %s", err)
 		s.Reset()
@@ -0,0 +1,127 @@
+package autonatv2
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// InstantTimer is a timer that triggers at some instant rather than some duration
+type InstantTimer interface {
+	Reset(d time.Time) bool
+	Stop() bool
+	Ch() <-chan time.Time
+}
+
+// Clock is the clock AutoNAT uses for rate limiting, measuring dial back RTTs and timeouts. It can
+// create timers that trigger at some instant rather than some duration.
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	InstantTimer(when time.Time) InstantTimer
+}
+
+type RealTimer struct{ t *time.Timer }
+
+var _ InstantTimer = (*RealTimer)(nil)
+
+func (t RealTimer) Ch() <-chan time.Time {
+	return t.t.C
+}
+
+func (t RealTimer) Reset(d time.Time) bool {
+	return t.t.Reset(time.Until(d))
+}
+
+func (t RealTimer) Stop() bool {
+	return t.t.Stop()
+}
+
+type RealClock struct{}
+
+var _ Clock = RealClock{}
+
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+func (RealClock) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+func (RealClock) InstantTimer(when time.Time) InstantTimer {
+	t := time.NewTimer(time.Until(when))
+	return &RealTimer{t}
+}
+
+// contextWithTimeout is like context.WithTimeout, but the timeout is measured by cl.
+func contextWithTimeout(ctx context.Context, cl Clock, d time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := cl.(RealClock); ok {
+		return context.WithTimeout(ctx, d)
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	t := cl.InstantTimer(cl.Now().Add(d))
+	go func() {
+		defer t.Stop()
+		select {
+		case <-t.Ch():
+			cancel(context.DeadlineExceeded)
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() { cancel(context.Canceled) }
+}
+
+// deadlineStream is a stream whose deadline can be set
+type deadlineStream interface {
+	SetDeadline(time.Time) error
+	Reset() error
+}
+
+// streamDeadline sets deadlines measured by a Clock on a stream. Stream deadlines use the wall
+// clock, so for clocks other than RealClock, the stream is reset when the clock reaches the
+// deadline instead.
+type streamDeadline struct {
+	cl Clock
+	s  deadlineStream
+
+	mu    sync.Mutex
+	timer InstantTimer
+	done  chan struct{}
+}
+
+func newStreamDeadline(cl Clock, s deadlineStream) *streamDeadline {
+	return &streamDeadline{cl: cl, s: s, done: make(chan struct{})}
+}
+
+// Set sets the stream's deadline to d from now, replacing the previous deadline.
+func (sd *streamDeadline) Set(d time.Duration) {
+	if _, ok := sd.cl.(RealClock); ok {
+		sd.s.SetDeadline(time.Now().Add(d))
+		return
+	}
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	deadline := sd.cl.Now().Add(d)
+	if sd.timer != nil {
+		sd.timer.Reset(deadline)
+		return
+	}
+	t := sd.cl.InstantTimer(deadline)
+	sd.timer = t
+	go func() {
+		select {
+		case <-t.Ch():
+			sd.s.Reset()
+		case <-sd.done:
+		}
+	}()
+}
+
+// Stop stops enforcing the deadline. It must be called once the stream is no longer used.
+func (sd *streamDeadline) Stop() {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	if sd.timer != nil {
+		sd.timer.Stop()
+	}
+	close(sd.done)
+}
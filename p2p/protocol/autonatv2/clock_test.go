@@ -0,0 +1,200 @@
+package autonatv2
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/test"
+	bhost "github.com/libp2p/go-libp2p/p2p/host/blank"
+	swarmt "github.com/libp2p/go-libp2p/p2p/net/swarm/testing"
+	"github.com/libp2p/go-libp2p/p2p/protocol/autonatv2/pb"
+
+	"github.com/libp2p/go-msgio/pbio"
+	"github.com/stretchr/testify/require"
+)
+
+type mockClock struct {
+	*test.MockClock
+}
+
+func (c mockClock) InstantTimer(when time.Time) InstantTimer {
+	return c.MockClock.InstantTimer(when)
+}
+
+func newMockClock() mockClock {
+	return mockClock{test.NewMockClock()}
+}
+
+// advanceUntil advances cl by d until cond is true. The clock is advanced repeatedly as timers
+// created after an advance only trigger on the next one.
+func advanceUntil(t *testing.T, cl mockClock, d time.Duration, cond func() bool) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		cl.AdvanceBy(d)
+		return cond()
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+type resetCountingStream struct {
+	resets atomic.Int32
+}
+
+func (s *resetCountingStream) SetDeadline(time.Time) error { return nil }
+
+func (s *resetCountingStream) Reset() error {
+	s.resets.Add(1)
+	return nil
+}
+
+func TestContextWithTimeout(t *testing.T) {
+	cl := newMockClock()
+	ctx, cancel := contextWithTimeout(context.Background(), cl, time.Second)
+	defer cancel()
+
+	cl.AdvanceBy(time.Second - 1)
+	select {
+	case <-ctx.Done():
+		t.Fatal("context done before the timeout")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cl.AdvanceBy(1)
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("context not done after the timeout")
+	}
+	require.ErrorIs(t, context.Cause(ctx), context.DeadlineExceeded)
+
+	ctx, cancel = contextWithTimeout(context.Background(), cl, time.Second)
+	cancel()
+	require.ErrorIs(t, context.Cause(ctx), context.Canceled)
+}
+
+func TestStreamDeadline(t *testing.T) {
+	t.Run("reset on deadline", func(t *testing.T) {
+		cl := newMockClock()
+		s := &resetCountingStream{}
+		sd := newStreamDeadline(cl, s)
+		defer sd.Stop()
+
+		sd.Set(time.Second)
+		cl.AdvanceBy(time.Second - 1)
+		time.Sleep(50 * time.Millisecond)
+		require.Zero(t, s.resets.Load())
+
+		cl.AdvanceBy(1)
+		require.Eventually(t, func() bool { return s.resets.Load() == 1 }, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("extended deadline", func(t *testing.T) {
+		cl := newMockClock()
+		s := &resetCountingStream{}
+		sd := newStreamDeadline(cl, s)
+		defer sd.Stop()
+
+		sd.Set(time.Second)
+		cl.AdvanceBy(time.Second / 2)
+		sd.Set(time.Second)
+		cl.AdvanceBy(time.Second / 2)
+		time.Sleep(50 * time.Millisecond)
+		require.Zero(t, s.resets.Load())
+
+		cl.AdvanceBy(time.Second / 2)
+		require.Eventually(t, func() bool { return s.resets.Load() == 1 }, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("stopped", func(t *testing.T) {
+		cl := newMockClock()
+		s := &resetCountingStream{}
+		sd := newStreamDeadline(cl, s)
+
+		sd.Set(time.Second)
+		sd.Stop()
+		cl.AdvanceBy(time.Second)
+		time.Sleep(50 * time.Millisecond)
+		require.Zero(t, s.resets.Load())
+	})
+}
+
+func TestServerStreamTimeoutWithClock(t *testing.T) {
+	cl := newMockClock()
+	an := newAutoNAT(t, nil, allowPrivateAddrs, WithClock(cl))
+	defer an.Close()
+	defer an.host.Close()
+
+	c := newAutoNAT(t, nil, allowPrivateAddrs)
+	defer c.Close()
+	defer c.host.Close()
+
+	idAndWait(t, c, an)
+
+	// Open a dial request stream and never send the request. The server resets the stream once
+	// the mock clock passes streamTimeout.
+	s, err := c.host.NewStream(context.Background(), an.host.ID(), DialProtocol)
+	require.NoError(t, err)
+	defer s.Reset()
+	// Write something so that the stream is opened on the server.
+	_, err = s.Write([]byte{1})
+	require.NoError(t, err)
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := s.Read(make([]byte, 1))
+		readErr <- err
+	}()
+
+	advanceUntil(t, cl, streamTimeout, func() bool {
+		select {
+		case err = <-readErr:
+			return true
+		default:
+			return false
+		}
+	})
+	require.ErrorIs(t, err, network.ErrReset)
+}
+
+func TestClientStreamTimeoutWithClock(t *testing.T) {
+	cl := newMockClock()
+	an := newAutoNAT(t, nil, allowPrivateAddrs, WithClock(cl))
+	defer an.Close()
+	defer an.host.Close()
+
+	b := bhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer b.Close()
+	idAndConnect(t, an.host, b)
+	waitForPeer(t, an)
+
+	// The server reads the request but never responds.
+	b.SetStreamHandler(DialProtocol, func(s network.Stream) {
+		defer s.Reset()
+		r := pbio.NewDelimitedReader(s, maxMsgSize)
+		var msg pb.Message
+		if err := r.ReadMsg(&msg); err != nil {
+			return
+		}
+		s.Read(make([]byte, 1))
+	})
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := an.GetReachability(context.Background(), newTestRequests(an.host.Addrs(), false))
+		errCh <- err
+	}()
+
+	var err error
+	advanceUntil(t, cl, streamTimeout, func() bool {
+		select {
+		case err = <-errCh:
+			return true
+		default:
+			return false
+		}
+	})
+	require.Error(t, err)
+	require.ErrorContains(t, err, "stream reset")
+}
@@ -11,6 +11,21 @@ type MetricsTracer interface {
 	CompletedRequest(EventDialRequestCompleted)
 }
 
+// ServerMetricsTracer is implemented by MetricsTracers that also track the server's rate limiting
+// and dial backs. The server checks whether the tracer set with WithMetricsTracer implements it.
+type ServerMetricsTracer interface {
+	MetricsTracer
+	// AcceptedRequest is called when a dial request is accepted by the rate limiter
+	AcceptedRequest()
+	// RejectedRequest is called when a dial request is rejected by the rate limiter or the request
+	// gate
+	RejectedRequest(dialDataRequired bool)
+	// RefusedRequest is called when a dial request has no dialable address
+	RefusedRequest()
+	// CompletedDialBack is called when a dial back attempt finishes
+	CompletedDialBack(status pb.DialStatus)
+}
+
 const metricNamespace = "libp2p_autonatv2"
 
 var (
@@ -22,13 +37,53 @@ var (
 		},
 		[]string{"server_error", "response_status", "dial_status", "dial_data_required", "ip_or_dns_version", "transport"},
 	)
+	requestsAccepted = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Name:      "requests_accepted_total",
+			Help:      "Requests Accepted by the Rate Limiter",
+		},
+	)
+	requestsRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Name:      "requests_rejected_total",
+			Help:      "Requests Rejected by the Rate Limiter",
+		},
+		[]string{"dial_data_required"},
+	)
+	requestsRefused = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Name:      "requests_refused_total",
+			Help:      "Requests Refused for having no Dialable Address",
+		},
+	)
+	dialBacksCompleted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Name:      "dial_backs_completed_total",
+			Help:      "Dial Backs Completed",
+		},
+		[]string{"dial_status"},
+	)
+
+	collectors = []prometheus.Collector{
+		requestsCompleted,
+		requestsAccepted,
+		requestsRejected,
+		requestsRefused,
+		dialBacksCompleted,
+	}
 )
 
 type metricsTracer struct {
 }
 
+var _ MetricsTracer = &metricsTracer{}
+
 func NewMetricsTracer(reg prometheus.Registerer) MetricsTracer {
-	metricshelper.RegisterCollectors(reg, requestsCompleted)
+	metricshelper.RegisterCollectors(reg, collectors...)
 	return &metricsTracer{}
 }
 
@@ -60,6 +115,62 @@ func (m *metricsTracer) CompletedRequest(e EventDialRequestCompleted) {
 	requestsCompleted.WithLabelValues(*labels...).Inc()
 }
 
+func (m *metricsTracer) AcceptedRequest() {
+	requestsAccepted.Inc()
+}
+
+func (m *metricsTracer) RejectedRequest(dialDataRequired bool) {
+	dialData := "false"
+	if dialDataRequired {
+		dialData = "true"
+	}
+	requestsRejected.WithLabelValues(dialData).Inc()
+}
+
+func (m *metricsTracer) RefusedRequest() {
+	requestsRefused.Inc()
+}
+
+func (m *metricsTracer) CompletedDialBack(status pb.DialStatus) {
+	dialBacksCompleted.WithLabelValues(pb.DialStatus_name[int32(status)]).Inc()
+}
+
+var _ ServerMetricsTracer = &metricsTracer{}
+
+// noopMetricsTracer is the ServerMetricsTracer used when no tracer is configured
+type noopMetricsTracer struct{}
+
+var _ ServerMetricsTracer = noopMetricsTracer{}
+
+func (noopMetricsTracer) CompletedRequest(EventDialRequestCompleted) {}
+func (noopMetricsTracer) AcceptedRequest()                           {}
+func (noopMetricsTracer) RejectedRequest(bool)                       {}
+func (noopMetricsTracer) RefusedRequest()                            {}
+func (noopMetricsTracer) CompletedDialBack(pb.DialStatus)            {}
+
+// serverMetricsTracer adds no-op server metrics to a MetricsTracer that doesn't implement
+// ServerMetricsTracer.
+type serverMetricsTracer struct {
+	MetricsTracer
+}
+
+func (serverMetricsTracer) AcceptedRequest()                {}
+func (serverMetricsTracer) RejectedRequest(bool)            {}
+func (serverMetricsTracer) RefusedRequest()                 {}
+func (serverMetricsTracer) CompletedDialBack(pb.DialStatus) {}
+
+// toServerMetricsTracer returns mt as a ServerMetricsTracer. It doesn't report server metrics if
+// mt doesn't implement ServerMetricsTracer.
+func toServerMetricsTracer(mt MetricsTracer) ServerMetricsTracer {
+	if mt == nil {
+		return noopMetricsTracer{}
+	}
+	if smt, ok := mt.(ServerMetricsTracer); ok {
+		return smt
+	}
+	return serverMetricsTracer{mt}
+}
+
 func getIPOrDNSVersion(a ma.Multiaddr) string {
 	if a == nil {
 		return ""
@@ -11,7 +11,7 @@ import (
 )
 
 func TestMetricsNoAllocNoCover(t *testing.T) {
-	mt := NewMetricsTracer(prometheus.DefaultRegisterer)
+	mt := NewMetricsTracer(prometheus.DefaultRegisterer).(ServerMetricsTracer)
 	respStatuses := []pb.DialResponse_ResponseStatus{
 		pb.DialResponse_E_DIAL_REFUSED,
 		pb.DialResponse_OK,
@@ -41,6 +41,12 @@ func TestMetricsNoAllocNoCover(t *testing.T) {
 				DialedAddr:       addrs[rand.Intn(len(addrs))],
 			})
 		},
+		"AcceptedRequest": func() { mt.AcceptedRequest() },
+		"RejectedRequest": func() { mt.RejectedRequest(rand.Intn(2) == 1) },
+		"RefusedRequest":  func() { mt.RefusedRequest() },
+		"CompletedDialBack": func() {
+			mt.CompletedDialBack(dialStatuses[rand.Intn(len(dialStatuses))])
+		},
 	}
 	for method, f := range tests {
 		allocs := testing.AllocsPerRun(10000, f)
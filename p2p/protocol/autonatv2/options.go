@@ -1,28 +1,80 @@
 package autonatv2
 
-import "time"
+import (
+	"errors"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"go.opentelemetry.io/otel/trace"
+)
 
 // autoNATSettings is used to configure AutoNAT
 type autoNATSettings struct {
 	allowPrivateAddrs                    bool
+	allowCircuitAddrs                    bool
+	serverDialBackFallback               bool
+	serverRequireDialBackNonce           bool
+	serverBusyHint                       bool
+	serverReportRefusedAddrs             bool
+	serverLocalFamiliesFilter            bool
+	serverDialBackFunc                   DialBackFunc
+	requestGate                          requestGateFunc
+	dialBackTransportFilter              DialBackTransportFilter
+	onDialBackComplete                   DialBackCompleteFunc
 	serverRPM                            int
 	serverPerPeerRPM                     int
+	serverPerIPRPM                       int
 	serverDialDataRPM                    int
-	dataRequestPolicy                    dataRequestPolicyFunc
-	now                                  func() time.Time
+	serverDialDataBytesPerWindow         int
+	serverRateLimitWindow                time.Duration
+	serverMaxConcurrentPerPeer           int
+	serverDialBackWorkers                int
+	serverDialBackQueueLen               int
+	serverDialBackQueueTimeout           time.Duration
+	serverRateLimitBackoffBase           time.Duration
+	serverRateLimitBackoffMax            time.Duration
+	serverMaxPeerAddrs                   int
+	serverMaxAddrBytes                   int
+	serverStreamTimeout                  time.Duration
+	serverDialBackDialTimeout            time.Duration
+	serverDialBackStreamTimeout          time.Duration
+	serverDialBackResponseTimeout        time.Duration
+	clientMaxDialDataBytes               uint64
+	clientDialDataConsent                dialDataConsentFunc
+	serverSelector                       ServerSelector
+	dataRequestPolicy                    DataRequestPolicyFunc
+	dialDataSize                         dialDataSizeFunc
+	clock                                Clock
 	amplificatonAttackPreventionDialWait time.Duration
+	minDialDataChunkSize                 int
 	metricsTracer                        MetricsTracer
+	tracerProvider                       trace.TracerProvider
 }
 
 func defaultSettings() *autoNATSettings {
 	return &autoNATSettings{
 		allowPrivateAddrs:                    false,
+		serverLocalFamiliesFilter:            true,
 		serverRPM:                            60, // 1 every second
 		serverPerPeerRPM:                     12, // 1 every 5 seconds
 		serverDialDataRPM:                    12, // 1 every 5 seconds
-		dataRequestPolicy:                    amplificationAttackPrevention,
+		serverRateLimitWindow:                time.Minute,
+		serverMaxConcurrentPerPeer:           1,
+		serverMaxPeerAddrs:                   defaultMaxPeerAddresses,
+		serverMaxAddrBytes:                   defaultMaxAddrBytes,
+		serverStreamTimeout:                  streamTimeout,
+		serverDialBackDialTimeout:            dialBackDialTimeout,
+		serverDialBackStreamTimeout:          dialBackStreamTimeout,
+		serverDialBackResponseTimeout:        dialBackResponseTimeout,
+		clientMaxDialDataBytes:               maxHandshakeSizeBytes,
+		serverSelector:                       NewWeightedServerSelector(),
+		dataRequestPolicy:                    AmplificationAttackPrevention,
+		dialDataSize:                         randomDialDataSize,
 		amplificatonAttackPreventionDialWait: 3 * time.Second,
-		now:                                  time.Now,
+		minDialDataChunkSize:                 defaultMinDialDataChunkSize,
+		clock:                                RealClock{},
 	}
 }
 
@@ -37,6 +89,287 @@ func WithServerRateLimit(rpm, perPeerRPM, dialDataRPM int) AutoNATOption {
 	}
 }
 
+// WithServerPerIPRateLimit sets the number of requests per rate limit window the server accepts
+// from a single remote IP address, across all peers using that address. Many peers may share an IP
+// address behind a CGNAT, so the limit should be set well above the per peer limit. Zero, the
+// default, disables the limit.
+func WithServerPerIPRateLimit(perIPRPM int) AutoNATOption {
+	return func(s *autoNATSettings) error {
+		if perIPRPM < 0 {
+			return errors.New("per IP rate limit must not be negative")
+		}
+		s.serverPerIPRPM = perIPRPM
+		return nil
+	}
+}
+
+// WithServerDialDataBytesRateLimit sets the total number of bytes of dial data per rate limit window
+// the server requests across all peers. Dial data requests beyond this budget are rejected. Zero,
+// the default, disables the limit.
+func WithServerDialDataBytesRateLimit(bytesPerWindow int) AutoNATOption {
+	return func(s *autoNATSettings) error {
+		if bytesPerWindow < 0 {
+			return errors.New("dial data bytes rate limit must not be negative")
+		}
+		s.serverDialDataBytesPerWindow = bytesPerWindow
+		return nil
+	}
+}
+
+// WithServerRateLimitWindow sets the duration of the sliding window used by the server rate limiter.
+// The limits set with WithServerRateLimit are interpreted as requests per window.
+func WithServerRateLimitWindow(d time.Duration) AutoNATOption {
+	return func(s *autoNATSettings) error {
+		if d <= 0 {
+			return errors.New("rate limit window must be positive")
+		}
+		s.serverRateLimitWindow = d
+		return nil
+	}
+}
+
+// WithServerRateLimitBackoff makes the server reject all requests from a peer for a cooldown period
+// after it hits the rate limit. The cooldown starts at base and doubles with every consecutive
+// rejection, up to max. It is reset once a request from the peer is accepted. Backoff is disabled by
+// default.
+func WithServerRateLimitBackoff(base, max time.Duration) AutoNATOption {
+	return func(s *autoNATSettings) error {
+		if base <= 0 {
+			return errors.New("rate limit backoff base must be positive")
+		}
+		if max < base {
+			return errors.New("rate limit backoff max must not be less than base")
+		}
+		s.serverRateLimitBackoffBase = base
+		s.serverRateLimitBackoffMax = max
+		return nil
+	}
+}
+
+// WithServerMaxConcurrentRequestsPerPeer sets the number of concurrent dial requests the server
+// handles for a single peer.
+func WithServerMaxConcurrentRequestsPerPeer(n int) AutoNATOption {
+	return func(s *autoNATSettings) error {
+		if n <= 0 {
+			return errors.New("max concurrent requests per peer must be positive")
+		}
+		s.serverMaxConcurrentPerPeer = n
+		return nil
+	}
+}
+
+// WithServerDialBackWorkers bounds the number of dial backs the server makes concurrently to
+// workers. Requests that are ready to be dialed back while all workers are busy wait in a queue of
+// up to queueLen requests for at most queueTimeout. Requests that don't fit in the queue or time
+// out are rejected with E_REQUEST_REJECTED. By default dial backs aren't bounded.
+func WithServerDialBackWorkers(workers, queueLen int, queueTimeout time.Duration) AutoNATOption {
+	return func(s *autoNATSettings) error {
+		if workers <= 0 {
+			return errors.New("dial back workers must be positive")
+		}
+		if queueLen < 0 {
+			return errors.New("dial back queue length must not be negative")
+		}
+		if queueTimeout < 0 {
+			return errors.New("dial back queue timeout must not be negative")
+		}
+		s.serverDialBackWorkers = workers
+		s.serverDialBackQueueLen = queueLen
+		s.serverDialBackQueueTimeout = queueTimeout
+		return nil
+	}
+}
+
+// WithServerMaxPeerAddresses sets the number of addresses in a dial request the server will
+// inspect. Addresses beyond this limit are ignored. Requests with more than 4 times as many
+// addresses are rejected with E_REQUEST_REJECTED.
+func WithServerMaxPeerAddresses(n int) AutoNATOption {
+	return func(s *autoNATSettings) error {
+		if n <= 0 {
+			return errors.New("max peer addresses must be positive")
+		}
+		s.serverMaxPeerAddrs = n
+		return nil
+	}
+}
+
+// WithServerMaxAddrBytes sets the maximum length in bytes of an address in a dial request. Longer
+// addresses are skipped without being parsed, to bound the work spent on a request. It defaults to
+// 512 bytes.
+func WithServerMaxAddrBytes(n int) AutoNATOption {
+	return func(s *autoNATSettings) error {
+		if n <= 0 {
+			return errors.New("max address bytes must be positive")
+		}
+		s.serverMaxAddrBytes = n
+		return nil
+	}
+}
+
+// WithServerAllowCircuitAddrs allows the server to dial back relay addresses through the relay.
+// This is only useful for testbeds that want to verify relay reachability.
+func WithServerAllowCircuitAddrs() AutoNATOption {
+	return func(s *autoNATSettings) error {
+		s.allowCircuitAddrs = true
+		return nil
+	}
+}
+
+// WithServerDialBackFallback makes the server dial back the next dialable address in a request
+// when dialing the first one fails, for example when the server's IPv6 connectivity is broken but
+// the client also provided an IPv4 address. All attempts share the dial back dial timeout. The
+// response reports the index of the last address dialed.
+func WithServerDialBackFallback() AutoNATOption {
+	return func(s *autoNATSettings) error {
+		s.serverDialBackFallback = true
+		return nil
+	}
+}
+
+// WithServerRequireDialBackNonce makes the server reject dial back responses that don't echo the
+// nonce with E_DIAL_BACK_ERROR. By default responses without the nonce are accepted, as clients
+// that predate echoing the nonce don't send it. Responses with a wrong nonce are always rejected.
+func WithServerRequireDialBackNonce() AutoNATOption {
+	return func(s *autoNATSettings) error {
+		s.serverRequireDialBackNonce = true
+		return nil
+	}
+}
+
+// WithServerBusyHint makes the server mark its E_REQUEST_REJECTED responses as busy when it
+// rejects a request because it reached its global rate limit. Clients use the hint to prefer other
+// servers. By default, rejections don't reveal whether the server is saturated.
+func WithServerBusyHint() AutoNATOption {
+	return func(s *autoNATSettings) error {
+		s.serverBusyHint = true
+		return nil
+	}
+}
+
+// WithServerRefusedAddrsReport makes the server report, when it refuses a request because none of
+// the addresses can be dialed, which addresses were refused for being private, undialable or
+// invalid. Clients get the report as a RefusedAddrsError and can use it to fix the addresses they
+// advertise. By default, the server only reports that the request was refused.
+func WithServerRefusedAddrsReport() AutoNATOption {
+	return func(s *autoNATSettings) error {
+		s.serverReportRefusedAddrs = true
+		return nil
+	}
+}
+
+// WithServerLocalFamiliesFilter sets whether the server refuses to dial back public addresses of an
+// IP family the dialing host has no interface address for, like IPv6 addresses on an IPv4 only
+// network, instead of dialing them until the dial back times out. The dialing host is the dialer
+// host, or the host if there is no dialer host. The filter is enabled by default.
+func WithServerLocalFamiliesFilter(enabled bool) AutoNATOption {
+	return func(s *autoNATSettings) error {
+		s.serverLocalFamiliesFilter = enabled
+		return nil
+	}
+}
+
+// WithServerDialBackFunc makes the server call f instead of dialing the client back. The server
+// still handles the request fully, including rate limiting and dial data, and responds with the
+// status returned by f. This is meant for tests and staging environments.
+func WithServerDialBackFunc(f DialBackFunc) AutoNATOption {
+	return func(s *autoNATSettings) error {
+		if f == nil {
+			return errors.New("dial back func must not be nil")
+		}
+		s.serverDialBackFunc = f
+		return nil
+	}
+}
+
+// WithServerTracerProvider sets the OpenTelemetry tracer provider used to create spans for the dial
+// requests the server handles and the dial backs it makes. A nil provider disables tracing, which
+// is the default.
+func WithServerTracerProvider(tp trace.TracerProvider) AutoNATOption {
+	return func(s *autoNATSettings) error {
+		s.tracerProvider = tp
+		return nil
+	}
+}
+
+// WithServerTimeouts sets the timeouts used by the server.
+// streamTimeout bounds handling a dial request stream, dialBackDialTimeout bounds dialing the client
+// back, dialBackStreamTimeout bounds the dial back stream and dialBackResponseTimeout bounds waiting
+// for the client's response to the dial back message.
+func WithServerTimeouts(streamTimeout, dialBackDialTimeout, dialBackStreamTimeout, dialBackResponseTimeout time.Duration) AutoNATOption {
+	return func(s *autoNATSettings) error {
+		if streamTimeout <= 0 || dialBackDialTimeout <= 0 || dialBackStreamTimeout <= 0 || dialBackResponseTimeout <= 0 {
+			return errors.New("server timeouts must be positive")
+		}
+		s.serverStreamTimeout = streamTimeout
+		s.serverDialBackDialTimeout = dialBackDialTimeout
+		s.serverDialBackStreamTimeout = dialBackStreamTimeout
+		s.serverDialBackResponseTimeout = dialBackResponseTimeout
+		return nil
+	}
+}
+
+// WithServerRequestGate sets a function that decides whether the server serves dial requests
+// from peer p. Requests from denied peers are rejected before rate limiting.
+// By default requests from all peers are served.
+func WithServerRequestGate(gate func(p peer.ID, s network.Stream) bool) AutoNATOption {
+	return func(s *autoNATSettings) error {
+		s.requestGate = gate
+		return nil
+	}
+}
+
+// WithServerDialBackTransportFilter sets a filter that decides which of the requested addresses the
+// server may dial back. Addresses rejected by the filter are skipped like undialable addresses.
+// This lets a server validate the reachability of only some transports, for example only QUIC.
+// By default all transports are dialed.
+func WithServerDialBackTransportFilter(f DialBackTransportFilter) AutoNATOption {
+	return func(s *autoNATSettings) error {
+		s.dialBackTransportFilter = f
+		return nil
+	}
+}
+
+// WithServerOnDialBackComplete sets a function called whenever the server completes handling a
+// dial request, whether the client was dialed back or not. It is meant for keeping an audit log of
+// reachability checks. By default no function is called.
+func WithServerOnDialBackComplete(f DialBackCompleteFunc) AutoNATOption {
+	return func(s *autoNATSettings) error {
+		s.onDialBackComplete = f
+		return nil
+	}
+}
+
+// WithClientMaxDialDataBytes sets the maximum amount of dial data the client sends for a request.
+// Requests from servers for more data are refused.
+func WithClientMaxDialDataBytes(n uint64) AutoNATOption {
+	return func(s *autoNATSettings) error {
+		s.clientMaxDialDataBytes = n
+		return nil
+	}
+}
+
+// WithClientDialDataConsent sets a function that decides whether the client sends numBytes of dial
+// data requested by server. It is only consulted for requests within the limit set by
+// WithClientMaxDialDataBytes.
+func WithClientDialDataConsent(consent func(server peer.ID, numBytes uint64) bool) AutoNATOption {
+	return func(s *autoNATSettings) error {
+		s.clientDialDataConsent = consent
+		return nil
+	}
+}
+
+// WithClientServerSelector sets the ServerSelector the client uses to pick the server for a
+// reachability check. It defaults to NewWeightedServerSelector.
+func WithClientServerSelector(ss ServerSelector) AutoNATOption {
+	return func(s *autoNATSettings) error {
+		if ss == nil {
+			return errors.New("server selector must not be nil")
+		}
+		s.serverSelector = ss
+		return nil
+	}
+}
+
 func WithMetricsTracer(m MetricsTracer) AutoNATOption {
 	return func(s *autoNATSettings) error {
 		s.metricsTracer = m
@@ -44,13 +377,77 @@ func WithMetricsTracer(m MetricsTracer) AutoNATOption {
 	}
 }
 
-func withDataRequestPolicy(drp dataRequestPolicyFunc) AutoNATOption {
+// WithServerDataRequestPolicy sets the policy used to decide whether the server requests dial data
+// before dialing an address. It defaults to AmplificationAttackPrevention. Use AnyPolicy and
+// AllPolicies to combine it with other policies.
+func WithServerDataRequestPolicy(drp DataRequestPolicyFunc) AutoNATOption {
 	return func(s *autoNATSettings) error {
+		if drp == nil {
+			return errors.New("data request policy must not be nil")
+		}
 		s.dataRequestPolicy = drp
 		return nil
 	}
 }
 
+// WithServerDialDataSize sets the function used to decide how many bytes of dial data the server
+// requests before dialing an address. Clients refuse requests for more than 100kB of dial data.
+// Sizes outside [1, 100kB] are clamped to that range.
+func WithServerDialDataSize(f func(dialAddr ma.Multiaddr) int) AutoNATOption {
+	return func(s *autoNATSettings) error {
+		if f == nil {
+			return errors.New("dial data size func must not be nil")
+		}
+		s.dialDataSize = f
+		return nil
+	}
+}
+
+// WithServerMinDialDataChunkSize sets the minimum size of a dial data message the server accepts.
+// Clients sending smaller messages before all the requested data is received are rejected.
+func WithServerMinDialDataChunkSize(n int) AutoNATOption {
+	return func(s *autoNATSettings) error {
+		if n < 0 {
+			return errors.New("min dial data chunk size must not be negative")
+		}
+		s.minDialDataChunkSize = n
+		return nil
+	}
+}
+
+// WithAllowPrivateAddrs allows checking the reachability of private and loopback addresses, and
+// makes the server dial back such addresses. This is intended for private networks and for tests
+// over in-memory networks. IPv6 addresses with a zone are scoped to an interface of the client and
+// are never dialed back.
+func WithAllowPrivateAddrs() AutoNATOption {
+	return allowPrivateAddrs
+}
+
+// WithClock sets the clock used for rate limiting, measuring the dial back RTT, and for the server's
+// and client's timeouts. This allows testing AutoNAT deterministically with a mock clock. With a
+// clock other than RealClock, streams are reset when their timeout expires on the clock, instead
+// of relying on stream deadlines. It defaults to RealClock.
+func WithClock(cl Clock) AutoNATOption {
+	return func(s *autoNATSettings) error {
+		if cl == nil {
+			return errors.New("clock must not be nil")
+		}
+		s.clock = cl
+		return nil
+	}
+}
+
+// WithServerDialWait sets the maximum random delay before the server dials back an address after
+// receiving dial data. The delay mitigates amplification attacks. It defaults to 3 seconds.
+func WithServerDialWait(d time.Duration) AutoNATOption {
+	return func(s *autoNATSettings) error {
+		if d < 0 {
+			return errors.New("dial wait must not be negative")
+		}
+		return withAmplificationAttackPreventionDialWait(d)(s)
+	}
+}
+
 func allowPrivateAddrs(s *autoNATSettings) error {
 	s.allowPrivateAddrs = true
 	return nil
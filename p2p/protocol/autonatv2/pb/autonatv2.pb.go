@@ -128,15 +128,20 @@ type DialBackResponse_DialBackStatus int32
 
 const (
 	DialBackResponse_OK DialBackResponse_DialBackStatus = 0
+	// E_INVALID_NONCE is sent when the nonce doesn't belong to any ongoing
+	// request of the client.
+	DialBackResponse_E_INVALID_NONCE DialBackResponse_DialBackStatus = 1
 )
 
 // Enum value maps for DialBackResponse_DialBackStatus.
 var (
 	DialBackResponse_DialBackStatus_name = map[int32]string{
 		0: "OK",
+		1: "E_INVALID_NONCE",
 	}
 	DialBackResponse_DialBackStatus_value = map[string]int32{
-		"OK": 0,
+		"OK":              0,
+		"E_INVALID_NONCE": 1,
 	}
 )
 
@@ -394,6 +399,24 @@ type DialResponse struct {
 	Status     DialResponse_ResponseStatus `protobuf:"varint,1,opt,name=status,proto3,enum=autonatv2.pb.DialResponse_ResponseStatus" json:"status,omitempty"`
 	AddrIdx    uint32                      `protobuf:"varint,2,opt,name=addrIdx,proto3" json:"addrIdx,omitempty"`
 	DialStatus DialStatus                  `protobuf:"varint,3,opt,name=dialStatus,proto3,enum=autonatv2.pb.DialStatus" json:"dialStatus,omitempty"`
+	// dialBackRTTMicros is the time the server took to dial back the address and
+	// get the dial back acknowledged, in microseconds. It is only set when the
+	// dial back succeeded.
+	DialBackRTTMicros uint64 `protobuf:"varint,4,opt,name=dialBackRTTMicros,proto3" json:"dialBackRTTMicros,omitempty"`
+	// busy is set on E_REQUEST_REJECTED responses when the server rejected the
+	// request because it reached its global rate limit. Clients should prefer
+	// other servers for a while.
+	Busy bool `protobuf:"varint,5,opt,name=busy,proto3" json:"busy,omitempty"`
+	// privateAddrIdxs, undialableAddrIdxs and invalidAddrIdxs are the indexes
+	// of the refused addresses in the DialRequest, by the reason they were
+	// refused. They are only set on E_DIAL_REFUSED responses by servers
+	// configured to report them.
+	PrivateAddrIdxs    []uint32 `protobuf:"varint,6,rep,packed,name=privateAddrIdxs,proto3" json:"privateAddrIdxs,omitempty"`
+	UndialableAddrIdxs []uint32 `protobuf:"varint,7,rep,packed,name=undialableAddrIdxs,proto3" json:"undialableAddrIdxs,omitempty"`
+	InvalidAddrIdxs    []uint32 `protobuf:"varint,8,rep,packed,name=invalidAddrIdxs,proto3" json:"invalidAddrIdxs,omitempty"`
+	// allAddrsPrivate is set on E_DIAL_REFUSED responses when all the addresses
+	// were refused for not being public addresses.
+	AllAddrsPrivate bool `protobuf:"varint,9,opt,name=allAddrsPrivate,proto3" json:"allAddrsPrivate,omitempty"`
 }
 
 func (x *DialResponse) Reset() {
@@ -449,6 +472,48 @@ func (x *DialResponse) GetDialStatus() DialStatus {
 	return DialStatus_UNUSED
 }
 
+func (x *DialResponse) GetDialBackRTTMicros() uint64 {
+	if x != nil {
+		return x.DialBackRTTMicros
+	}
+	return 0
+}
+
+func (x *DialResponse) GetBusy() bool {
+	if x != nil {
+		return x.Busy
+	}
+	return false
+}
+
+func (x *DialResponse) GetPrivateAddrIdxs() []uint32 {
+	if x != nil {
+		return x.PrivateAddrIdxs
+	}
+	return nil
+}
+
+func (x *DialResponse) GetUndialableAddrIdxs() []uint32 {
+	if x != nil {
+		return x.UndialableAddrIdxs
+	}
+	return nil
+}
+
+func (x *DialResponse) GetInvalidAddrIdxs() []uint32 {
+	if x != nil {
+		return x.InvalidAddrIdxs
+	}
+	return nil
+}
+
+func (x *DialResponse) GetAllAddrsPrivate() bool {
+	if x != nil {
+		return x.AllAddrsPrivate
+	}
+	return false
+}
+
 type DialDataResponse struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -549,6 +614,9 @@ type DialBackResponse struct {
 	unknownFields protoimpl.UnknownFields
 
 	Status DialBackResponse_DialBackStatus `protobuf:"varint,1,opt,name=status,proto3,enum=autonatv2.pb.DialBackResponse_DialBackStatus" json:"status,omitempty"`
+	// nonce echoes the nonce of the DialBack message. A zero nonce is treated as
+	// not set, for compatibility with clients that don't echo the nonce.
+	Nonce uint64 `protobuf:"fixed64,2,opt,name=nonce,proto3" json:"nonce,omitempty"`
 }
 
 func (x *DialBackResponse) Reset() {
@@ -590,6 +658,13 @@ func (x *DialBackResponse) GetStatus() DialBackResponse_DialBackStatus {
 	return DialBackResponse_OK
 }
 
+func (x *DialBackResponse) GetNonce() uint64 {
+	if x != nil {
+		return x.Nonce
+	}
+	return 0
+}
+
 var File_pb_autonatv2_proto protoreflect.FileDescriptor
 
 var file_pb_autonatv2_proto_rawDesc = []byte{
@@ -622,7 +697,7 @@ var file_pb_autonatv2_proto_rawDesc = []byte{
 	0x07, 0x61, 0x64, 0x64, 0x72, 0x49, 0x64, 0x78, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x07,
 	0x61, 0x64, 0x64, 0x72, 0x49, 0x64, 0x78, 0x12, 0x1a, 0x0a, 0x08, 0x6e, 0x75, 0x6d, 0x42, 0x79,
 	0x74, 0x65, 0x73, 0x18, 0x02, 0x20, 0x01, 0x28, 0x04, 0x52, 0x08, 0x6e, 0x75, 0x6d, 0x42, 0x79,
-	0x74, 0x65, 0x73, 0x22, 0x82, 0x02, 0x0a, 0x0c, 0x44, 0x69, 0x61, 0x6c, 0x52, 0x65, 0x73, 0x70,
+	0x74, 0x65, 0x73, 0x22, 0xf2, 0x03, 0x0a, 0x0c, 0x44, 0x69, 0x61, 0x6c, 0x52, 0x65, 0x73, 0x70,
 	0x6f, 0x6e, 0x73, 0x65, 0x12, 0x41, 0x0a, 0x06, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73, 0x18, 0x01,
 	0x20, 0x01, 0x28, 0x0e, 0x32, 0x29, 0x2e, 0x61, 0x75, 0x74, 0x6f, 0x6e, 0x61, 0x74, 0x76, 0x32,
 	0x2e, 0x70, 0x62, 0x2e, 0x44, 0x69, 0x61, 0x6c, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65,
@@ -632,7 +707,22 @@ var file_pb_autonatv2_proto_rawDesc = []byte{
 	0x78, 0x12, 0x38, 0x0a, 0x0a, 0x64, 0x69, 0x61, 0x6c, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x18,
 	0x03, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x18, 0x2e, 0x61, 0x75, 0x74, 0x6f, 0x6e, 0x61, 0x74, 0x76,
 	0x32, 0x2e, 0x70, 0x62, 0x2e, 0x44, 0x69, 0x61, 0x6c, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x52,
-	0x0a, 0x64, 0x69, 0x61, 0x6c, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x22, 0x5b, 0x0a, 0x0e, 0x52,
+	0x0a, 0x64, 0x69, 0x61, 0x6c, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x12, 0x2c, 0x0a, 0x11, 0x64,
+	0x69, 0x61, 0x6c, 0x42, 0x61, 0x63, 0x6b, 0x52, 0x54, 0x54, 0x4d, 0x69, 0x63, 0x72, 0x6f, 0x73,
+	0x18, 0x04, 0x20, 0x01, 0x28, 0x04, 0x52, 0x11, 0x64, 0x69, 0x61, 0x6c, 0x42, 0x61, 0x63, 0x6b,
+	0x52, 0x54, 0x54, 0x4d, 0x69, 0x63, 0x72, 0x6f, 0x73, 0x12, 0x12, 0x0a, 0x04, 0x62, 0x75, 0x73,
+	0x79, 0x18, 0x05, 0x20, 0x01, 0x28, 0x08, 0x52, 0x04, 0x62, 0x75, 0x73, 0x79, 0x12, 0x28, 0x0a,
+	0x0f, 0x70, 0x72, 0x69, 0x76, 0x61, 0x74, 0x65, 0x41, 0x64, 0x64, 0x72, 0x49, 0x64, 0x78, 0x73,
+	0x18, 0x06, 0x20, 0x03, 0x28, 0x0d, 0x52, 0x0f, 0x70, 0x72, 0x69, 0x76, 0x61, 0x74, 0x65, 0x41,
+	0x64, 0x64, 0x72, 0x49, 0x64, 0x78, 0x73, 0x12, 0x2e, 0x0a, 0x12, 0x75, 0x6e, 0x64, 0x69, 0x61,
+	0x6c, 0x61, 0x62, 0x6c, 0x65, 0x41, 0x64, 0x64, 0x72, 0x49, 0x64, 0x78, 0x73, 0x18, 0x07, 0x20,
+	0x03, 0x28, 0x0d, 0x52, 0x12, 0x75, 0x6e, 0x64, 0x69, 0x61, 0x6c, 0x61, 0x62, 0x6c, 0x65, 0x41,
+	0x64, 0x64, 0x72, 0x49, 0x64, 0x78, 0x73, 0x12, 0x28, 0x0a, 0x0f, 0x69, 0x6e, 0x76, 0x61, 0x6c,
+	0x69, 0x64, 0x41, 0x64, 0x64, 0x72, 0x49, 0x64, 0x78, 0x73, 0x18, 0x08, 0x20, 0x03, 0x28, 0x0d,
+	0x52, 0x0f, 0x69, 0x6e, 0x76, 0x61, 0x6c, 0x69, 0x64, 0x41, 0x64, 0x64, 0x72, 0x49, 0x64, 0x78,
+	0x73, 0x12, 0x28, 0x0a, 0x0f, 0x61, 0x6c, 0x6c, 0x41, 0x64, 0x64, 0x72, 0x73, 0x50, 0x72, 0x69,
+	0x76, 0x61, 0x74, 0x65, 0x18, 0x09, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0f, 0x61, 0x6c, 0x6c, 0x41,
+	0x64, 0x64, 0x72, 0x73, 0x50, 0x72, 0x69, 0x76, 0x61, 0x74, 0x65, 0x22, 0x5b, 0x0a, 0x0e, 0x52,
 	0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x12, 0x14, 0x0a,
 	0x10, 0x45, 0x5f, 0x49, 0x4e, 0x54, 0x45, 0x52, 0x4e, 0x41, 0x4c, 0x5f, 0x45, 0x52, 0x52, 0x4f,
 	0x52, 0x10, 0x00, 0x12, 0x16, 0x0a, 0x12, 0x45, 0x5f, 0x52, 0x45, 0x51, 0x55, 0x45, 0x53, 0x54,
@@ -643,19 +733,22 @@ var file_pb_autonatv2_proto_rawDesc = []byte{
 	0x64, 0x61, 0x74, 0x61, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x64, 0x61, 0x74, 0x61,
 	0x22, 0x20, 0x0a, 0x08, 0x44, 0x69, 0x61, 0x6c, 0x42, 0x61, 0x63, 0x6b, 0x12, 0x14, 0x0a, 0x05,
 	0x6e, 0x6f, 0x6e, 0x63, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x06, 0x52, 0x05, 0x6e, 0x6f, 0x6e,
-	0x63, 0x65, 0x22, 0x73, 0x0a, 0x10, 0x44, 0x69, 0x61, 0x6c, 0x42, 0x61, 0x63, 0x6b, 0x52, 0x65,
-	0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x45, 0x0a, 0x06, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73,
-	0x18, 0x01, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x2d, 0x2e, 0x61, 0x75, 0x74, 0x6f, 0x6e, 0x61, 0x74,
-	0x76, 0x32, 0x2e, 0x70, 0x62, 0x2e, 0x44, 0x69, 0x61, 0x6c, 0x42, 0x61, 0x63, 0x6b, 0x52, 0x65,
-	0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x2e, 0x44, 0x69, 0x61, 0x6c, 0x42, 0x61, 0x63, 0x6b, 0x53,
-	0x74, 0x61, 0x74, 0x75, 0x73, 0x52, 0x06, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73, 0x22, 0x18, 0x0a,
-	0x0e, 0x44, 0x69, 0x61, 0x6c, 0x42, 0x61, 0x63, 0x6b, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x12,
-	0x06, 0x0a, 0x02, 0x4f, 0x4b, 0x10, 0x00, 0x2a, 0x4a, 0x0a, 0x0a, 0x44, 0x69, 0x61, 0x6c, 0x53,
-	0x74, 0x61, 0x74, 0x75, 0x73, 0x12, 0x0a, 0x0a, 0x06, 0x55, 0x4e, 0x55, 0x53, 0x45, 0x44, 0x10,
-	0x00, 0x12, 0x10, 0x0a, 0x0c, 0x45, 0x5f, 0x44, 0x49, 0x41, 0x4c, 0x5f, 0x45, 0x52, 0x52, 0x4f,
-	0x52, 0x10, 0x64, 0x12, 0x15, 0x0a, 0x11, 0x45, 0x5f, 0x44, 0x49, 0x41, 0x4c, 0x5f, 0x42, 0x41,
-	0x43, 0x4b, 0x5f, 0x45, 0x52, 0x52, 0x4f, 0x52, 0x10, 0x65, 0x12, 0x07, 0x0a, 0x02, 0x4f, 0x4b,
-	0x10, 0xc8, 0x01, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x63, 0x65, 0x22, 0x9e, 0x01, 0x0a, 0x10, 0x44, 0x69, 0x61, 0x6c, 0x42, 0x61, 0x63, 0x6b, 0x52,
+	0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x45, 0x0a, 0x06, 0x73, 0x74, 0x61, 0x74, 0x75,
+	0x73, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x2d, 0x2e, 0x61, 0x75, 0x74, 0x6f, 0x6e, 0x61,
+	0x74, 0x76, 0x32, 0x2e, 0x70, 0x62, 0x2e, 0x44, 0x69, 0x61, 0x6c, 0x42, 0x61, 0x63, 0x6b, 0x52,
+	0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x2e, 0x44, 0x69, 0x61, 0x6c, 0x42, 0x61, 0x63, 0x6b,
+	0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x52, 0x06, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73, 0x12, 0x14,
+	0x0a, 0x05, 0x6e, 0x6f, 0x6e, 0x63, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x06, 0x52, 0x05, 0x6e,
+	0x6f, 0x6e, 0x63, 0x65, 0x22, 0x2d, 0x0a, 0x0e, 0x44, 0x69, 0x61, 0x6c, 0x42, 0x61, 0x63, 0x6b,
+	0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x12, 0x06, 0x0a, 0x02, 0x4f, 0x4b, 0x10, 0x00, 0x12, 0x13,
+	0x0a, 0x0f, 0x45, 0x5f, 0x49, 0x4e, 0x56, 0x41, 0x4c, 0x49, 0x44, 0x5f, 0x4e, 0x4f, 0x4e, 0x43,
+	0x45, 0x10, 0x01, 0x2a, 0x4a, 0x0a, 0x0a, 0x44, 0x69, 0x61, 0x6c, 0x53, 0x74, 0x61, 0x74, 0x75,
+	0x73, 0x12, 0x0a, 0x0a, 0x06, 0x55, 0x4e, 0x55, 0x53, 0x45, 0x44, 0x10, 0x00, 0x12, 0x10, 0x0a,
+	0x0c, 0x45, 0x5f, 0x44, 0x49, 0x41, 0x4c, 0x5f, 0x45, 0x52, 0x52, 0x4f, 0x52, 0x10, 0x64, 0x12,
+	0x15, 0x0a, 0x11, 0x45, 0x5f, 0x44, 0x49, 0x41, 0x4c, 0x5f, 0x42, 0x41, 0x43, 0x4b, 0x5f, 0x45,
+	0x52, 0x52, 0x4f, 0x52, 0x10, 0x65, 0x12, 0x07, 0x0a, 0x02, 0x4f, 0x4b, 0x10, 0xc8, 0x01, 0x62,
+	0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
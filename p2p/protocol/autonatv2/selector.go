@@ -0,0 +1,140 @@
+package autonatv2
+
+import (
+	"errors"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/exp/rand"
+)
+
+const (
+	// rejectedServerBackoff is how long the default server selector avoids a server after it
+	// rejected a request
+	rejectedServerBackoff = time.Minute
+	// successfulServerTTL is how long a successful request makes the default server selector favor
+	// a server
+	successfulServerTTL = 10 * time.Minute
+	// successfulServerWeight is the additional weight of a server with a recent successful request
+	// and a negligible dial back RTT. The weight of other servers is 1.
+	successfulServerWeight = 3
+	// referenceRTT is the dial back RTT at which the additional weight of a successful server is
+	// halved
+	referenceRTT = 100 * time.Millisecond
+)
+
+// ServerSelector selects the AutoNAT v2 server used for a reachability check.
+// AutoNAT serializes calls to the selector.
+type ServerSelector interface {
+	// SelectServer returns the server to use from servers. servers is never empty and must not be
+	// modified.
+	SelectServer(servers []peer.ID) peer.ID
+	// UpdateServer is called with the outcome of a reachability check with server.
+	UpdateServer(server peer.ID, res Result, err error)
+	// RemoveServer is called when server is no longer available.
+	RemoveServer(server peer.ID)
+}
+
+type serverStats struct {
+	// lastSuccess is the time of the last successful request
+	lastSuccess time.Time
+	// rtt is the dial back RTT reported on the last successful request. It is zero if the server
+	// didn't report it.
+	rtt time.Duration
+	// rejectedUntil is the time until which the server is avoided after rejecting a request
+	rejectedUntil time.Time
+}
+
+// weightedServerSelector picks a random server weighted in favor of servers with recent successful
+// requests and low dial back RTTs. Servers that rejected a request are avoided for a while unless
+// there are no other servers.
+type weightedServerSelector struct {
+	now     func() time.Time
+	servers map[peer.ID]*serverStats
+}
+
+var _ ServerSelector = (*weightedServerSelector)(nil)
+
+// NewWeightedServerSelector returns the default ServerSelector. It picks a random server, favoring
+// servers that recently completed a request with a low dial back RTT. Servers that rejected a
+// request are avoided for a minute unless there are no other servers.
+func NewWeightedServerSelector() ServerSelector {
+	return newWeightedServerSelector(time.Now)
+}
+
+func newWeightedServerSelector(now func() time.Time) *weightedServerSelector {
+	return &weightedServerSelector{
+		now:     now,
+		servers: make(map[peer.ID]*serverStats),
+	}
+}
+
+func (ss *weightedServerSelector) SelectServer(servers []peer.ID) peer.ID {
+	now := ss.now()
+	weights := make([]float64, len(servers))
+	var total float64
+	for i, p := range servers {
+		weights[i] = ss.weight(p, now)
+		total += weights[i]
+	}
+	if total == 0 {
+		// all servers rejected a request recently
+		return servers[rand.Intn(len(servers))]
+	}
+	x := rand.Float64() * total
+	for i, w := range weights {
+		if x < w {
+			return servers[i]
+		}
+		x -= w
+	}
+	// rounding errors
+	for i := len(servers) - 1; i >= 0; i-- {
+		if weights[i] > 0 {
+			return servers[i]
+		}
+	}
+	return servers[len(servers)-1]
+}
+
+func (ss *weightedServerSelector) weight(p peer.ID, now time.Time) float64 {
+	st, ok := ss.servers[p]
+	if !ok {
+		return 1
+	}
+	if now.Before(st.rejectedUntil) {
+		return 0
+	}
+	if st.lastSuccess.IsZero() || now.Sub(st.lastSuccess) > successfulServerTTL {
+		return 1
+	}
+	rtt := st.rtt
+	if rtt == 0 {
+		// the server didn't report the RTT
+		rtt = referenceRTT
+	}
+	return 1 + successfulServerWeight*float64(referenceRTT)/float64(referenceRTT+rtt)
+}
+
+func (ss *weightedServerSelector) UpdateServer(p peer.ID, res Result, err error) {
+	st, ok := ss.servers[p]
+	if !ok {
+		st = &serverStats{}
+		ss.servers[p] = st
+	}
+	switch {
+	case err == nil:
+		st.lastSuccess = ss.now()
+		st.rtt = res.RTT
+		st.rejectedUntil = time.Time{}
+	case errors.Is(err, ErrRequestRejected):
+		st.rejectedUntil = ss.now().Add(rejectedServerBackoff)
+		st.lastSuccess = time.Time{}
+	default:
+		st.lastSuccess = time.Time{}
+	}
+}
+
+func (ss *weightedServerSelector) RemoveServer(p peer.ID) {
+	delete(ss.servers, p)
+}
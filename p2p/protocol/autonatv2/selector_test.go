@@ -0,0 +1,119 @@
+package autonatv2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWeightedServerSelector(t *testing.T) {
+	now := time.Now()
+	ss := newWeightedServerSelector(func() time.Time { return now })
+	servers := []peer.ID{"p1", "p2", "p3"}
+
+	t.Run("distributes", func(t *testing.T) {
+		counts := make(map[peer.ID]int)
+		for i := 0; i < 300; i++ {
+			counts[ss.SelectServer(servers)]++
+		}
+		for _, p := range servers {
+			require.Greater(t, counts[p], 50, "%s: %v", p, counts)
+		}
+	})
+
+	t.Run("avoids rejected", func(t *testing.T) {
+		ss.UpdateServer("p1", Result{}, fmt.Errorf("dial request failed: %w", ErrRequestRejected))
+		for i := 0; i < 100; i++ {
+			require.NotEqual(t, peer.ID("p1"), ss.SelectServer(servers))
+		}
+		// rejected servers are used if there's no other server
+		require.Equal(t, peer.ID("p1"), ss.SelectServer([]peer.ID{"p1"}))
+
+		// the rejection expires
+		now = now.Add(rejectedServerBackoff)
+		counts := make(map[peer.ID]int)
+		for i := 0; i < 300; i++ {
+			counts[ss.SelectServer(servers)]++
+		}
+		require.Greater(t, counts["p1"], 50, counts)
+	})
+
+	t.Run("favors successful low latency", func(t *testing.T) {
+		ss.UpdateServer("p1", Result{RTT: 10 * time.Millisecond}, nil)
+		ss.UpdateServer("p2", Result{RTT: time.Second}, nil)
+		require.Greater(t, ss.weight("p1", now), ss.weight("p2", now))
+		require.Greater(t, ss.weight("p2", now), ss.weight("p3", now))
+
+		counts := make(map[peer.ID]int)
+		for i := 0; i < 1000; i++ {
+			counts[ss.SelectServer(servers)]++
+		}
+		require.Greater(t, counts["p1"], counts["p3"], counts)
+
+		// failures and old successes aren't favored
+		ss.UpdateServer("p1", Result{}, errors.New("stream reset"))
+		require.Equal(t, ss.weight("p3", now), ss.weight("p1", now))
+		require.Equal(t, ss.weight("p3", now), ss.weight("p2", now.Add(successfulServerTTL+time.Second)))
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		ss.RemoveServer("p2")
+		require.NotContains(t, ss.servers, peer.ID("p2"))
+	})
+}
+
+func TestClientServerSelection(t *testing.T) {
+	const numServers = 3
+	c := newAutoNAT(t, nil, allowPrivateAddrs)
+	defer c.Close()
+	defer c.host.Close()
+
+	servers := make([]*AutoNAT, numServers)
+	for i := range servers {
+		opts := []AutoNATOption{allowPrivateAddrs, WithServerRateLimit(100, 100, 100)}
+		if i == 0 {
+			// reject all requests
+			opts = append(opts, WithServerRateLimit(0, 0, 0))
+		}
+		servers[i] = newAutoNAT(t, nil, opts...)
+		defer servers[i].Close()
+		defer servers[i].host.Close()
+		idAndWait(t, c, servers[i])
+	}
+	require.Eventually(t, func() bool {
+		c.mx.Lock()
+		defer c.mx.Unlock()
+		return len(c.peers.peers) == numServers
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Probe until the rejecting server has been tried
+	rejecting := servers[0].host.ID()
+	counts := make(map[peer.ID]int)
+	rejected := false
+	for i := 0; i < 100 && !rejected; i++ {
+		res, err := c.GetReachability(context.Background(), newTestRequests(c.host.Addrs(), false))
+		if err != nil {
+			require.ErrorIs(t, err, ErrRequestRejected)
+			rejected = true
+			continue
+		}
+		counts[res.Server]++
+	}
+	require.True(t, rejected)
+
+	// The rejecting server is avoided and the others share the probes
+	for i := 0; i < 30; i++ {
+		res, err := c.GetReachability(context.Background(), newTestRequests(c.host.Addrs(), false))
+		require.NoError(t, err)
+		require.NotEqual(t, rejecting, res.Server)
+		counts[res.Server]++
+	}
+	for _, s := range servers[1:] {
+		require.NotZero(t, counts[s.host.ID()], counts)
+	}
+}
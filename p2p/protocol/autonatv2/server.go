@@ -5,14 +5,19 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/netip"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/hashicorp/golang-lru/v2/simplelru"
 	pool "github.com/libp2p/go-buffer-pool"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/transport"
 	"github.com/libp2p/go-libp2p/p2p/protocol/autonatv2/pb"
 	"github.com/libp2p/go-msgio/pbio"
 
@@ -20,59 +25,199 @@ import (
 
 	ma "github.com/multiformats/go-multiaddr"
 	manet "github.com/multiformats/go-multiaddr/net"
+	msmux "github.com/multiformats/go-multistream"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
+// tracerName is the name of the tracer used for the server's spans
+const tracerName = "github.com/libp2p/go-libp2p/p2p/protocol/autonatv2"
+
 var (
 	errResourceLimitExceeded = errors.New("resource limit exceeded")
 	errBadRequest            = errors.New("bad request")
 	errDialDataRefused       = errors.New("dial data refused")
 )
 
-type dataRequestPolicyFunc = func(s network.Stream, dialAddr ma.Multiaddr) bool
+// DataRequestPolicyFunc decides whether the server requests dial data from the client on stream s
+// before dialing dialAddr.
+type DataRequestPolicyFunc = func(s network.Stream, dialAddr ma.Multiaddr) bool
+
+type dialDataSizeFunc = func(dialAddr ma.Multiaddr) int
+
+// DialBackTransportFilter decides whether the server dials back dialAddr. It allows a server to
+// only validate the reachability of some transports.
+type DialBackTransportFilter = func(dialAddr ma.Multiaddr) bool
+
+type requestGateFunc = func(p peer.ID, s network.Stream) bool
+
+// DialBackFunc replaces the server's dial back to peer p on addr. It returns the dial status to
+// report to the client. It is intended for exercising the reachability logic in tests without a
+// real network.
+type DialBackFunc = func(p peer.ID, addr ma.Multiaddr) pb.DialStatus
+
+// DialBackCompleteFunc is called when the server completes handling a dial request from requester.
+// addr is the address selected for the dial back, nil if there was none, and status is the result
+// of the dial back, UNUSED if the server didn't dial back, for example because the request was rate
+// limited. dialDataBytes is the number of bytes of dial data received from requester.
+type DialBackCompleteFunc = func(requester peer.ID, addr ma.Multiaddr, status pb.DialStatus, dialDataBytes int)
 
 type EventDialRequestCompleted struct {
 	Error            error
 	ResponseStatus   pb.DialResponse_ResponseStatus
 	DialStatus       pb.DialStatus
 	DialDataRequired bool
+	DialDataBytes    int
 	DialedAddr       ma.Multiaddr
 }
 
+// detachedDialer is implemented by networks that can dial a connection without adding it to the
+// network, like the swarm. It is used to dial back peers in single host mode.
+type detachedDialer interface {
+	DialAddrDetached(ctx context.Context, p peer.ID, addr ma.Multiaddr) (transport.CapableConn, error)
+}
+
 // server implements the AutoNATv2 server.
 // It can ask client to provide dial data before attempting the requested dial.
 // It rate limits requests on a global level, per peer level and on whether the request requires dial data.
 type server struct {
-	host       host.Host
+	host host.Host
+	// dialerHost is used for dialing back peers. If nil, the server dials back using host's
+	// transports directly.
 	dialerHost host.Host
 	limiter    *rateLimiter
 
 	// dialDataRequestPolicy is used to determine whether dialing the address requires receiving
 	// dial data. It is set to amplification attack prevention by default.
-	dialDataRequestPolicy                dataRequestPolicyFunc
+	dialDataRequestPolicy DataRequestPolicyFunc
+	// dialDataSize is used to determine the number of bytes of dial data to request for dialing the
+	// address. It is set to a random size in [minHandshakeSizeBytes, maxHandshakeSizeBytes) by default.
+	dialDataSize                         dialDataSizeFunc
 	amplificatonAttackPreventionDialWait time.Duration
-	metricsTracer                        MetricsTracer
+	// minDialDataChunkSize is the minimum size of a dial data message the server accepts
+	minDialDataChunkSize int
+	metricsTracer        ServerMetricsTracer
+	tracer               trace.Tracer
+	// maxPeerAddresses is the number of addresses in a dial request the server will inspect
+	maxPeerAddresses int
+	// maxAddrBytes is the maximum length of an address in a dial request. Longer addresses are
+	// skipped.
+	maxAddrBytes int
+
+	streamTimeout           time.Duration
+	dialBackDialTimeout     time.Duration
+	dialBackStreamTimeout   time.Duration
+	dialBackResponseTimeout time.Duration
+
+	// allowCircuitAddrs allows dialing back relay addresses
+	allowCircuitAddrs bool
+	// dialBackFunc dials back the peer on addr and returns the dial status and the dial back RTT.
+	// Defaults to dialBack.
+	dialBackFunc func(ctx context.Context, p peer.ID, addr ma.Multiaddr, nonce uint64) (pb.DialStatus, time.Duration)
+	// dialBackFallback makes the server dial the next dialable address if dialing back the
+	// first one fails
+	dialBackFallback bool
+	// requireDialBackNonce rejects dial back responses without a nonce, as sent by clients that
+	// predate echoing the nonce
+	requireDialBackNonce bool
+	// busyHint marks rejections caused by the global rate limit as busy
+	busyHint bool
+	// reportRefusedAddrs makes dial refused responses include the indexes of the refused
+	// addresses by reason
+	reportRefusedAddrs bool
+	// requestGate decides whether to serve requests from a peer. All peers are served when nil.
+	requestGate requestGateFunc
+	// dialBackTransportFilter decides whether an address is dialed back. All addresses are
+	// dialed when nil.
+	dialBackTransportFilter DialBackTransportFilter
+	// onDialBackComplete is called when a dial request completes. It isn't called when nil.
+	onDialBackComplete DialBackCompleteFunc
+	// dialBackPool bounds the number of concurrent dial backs. Dial backs aren't bounded when nil.
+	dialBackPool *dialBackPool
+	// canDialCache caches the result of checking whether an address can be dialed
+	canDialCache *canDialCache
+	// localFamilies tracks the IP families the dialing host has interface addresses for. It is nil if
+	// the filter is disabled.
+	localFamilies *localFamilies
+
+	// wg tracks the in progress dial request handlers
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	closed bool
+
+	clock Clock
 
 	// for tests
-	now               func() time.Time
 	allowPrivateAddrs bool
 }
 
 func newServer(host, dialer host.Host, s *autoNATSettings) *server {
-	return &server{
+	mt := toServerMetricsTracer(s.metricsTracer)
+	as := &server{
 		dialerHost:                           dialer,
 		host:                                 host,
 		dialDataRequestPolicy:                s.dataRequestPolicy,
+		dialDataSize:                         s.dialDataSize,
 		amplificatonAttackPreventionDialWait: s.amplificatonAttackPreventionDialWait,
+		minDialDataChunkSize:                 s.minDialDataChunkSize,
 		allowPrivateAddrs:                    s.allowPrivateAddrs,
+		allowCircuitAddrs:                    s.allowCircuitAddrs,
+		dialBackFallback:                     s.serverDialBackFallback,
+		requireDialBackNonce:                 s.serverRequireDialBackNonce,
+		busyHint:                             s.serverBusyHint,
+		reportRefusedAddrs:                   s.serverReportRefusedAddrs,
+		requestGate:                          s.requestGate,
+		dialBackTransportFilter:              s.dialBackTransportFilter,
+		onDialBackComplete:                   s.onDialBackComplete,
+		maxPeerAddresses:                     s.serverMaxPeerAddrs,
+		maxAddrBytes:                         s.serverMaxAddrBytes,
+		streamTimeout:                        s.serverStreamTimeout,
+		dialBackDialTimeout:                  s.serverDialBackDialTimeout,
+		dialBackStreamTimeout:                s.serverDialBackStreamTimeout,
+		dialBackResponseTimeout:              s.serverDialBackResponseTimeout,
 		limiter: &rateLimiter{
-			RPM:         s.serverRPM,
-			PerPeerRPM:  s.serverPerPeerRPM,
-			DialDataRPM: s.serverDialDataRPM,
-			now:         s.now,
+			RPM:                    s.serverRPM,
+			PerPeerRPM:             s.serverPerPeerRPM,
+			PerIPRPM:               s.serverPerIPRPM,
+			DialDataRPM:            s.serverDialDataRPM,
+			DialDataBytesPerWindow: s.serverDialDataBytesPerWindow,
+			Window:                 s.serverRateLimitWindow,
+			MaxConcurrentPerPeer:   s.serverMaxConcurrentPerPeer,
+			BackoffBase:            s.serverRateLimitBackoffBase,
+			BackoffMax:             s.serverRateLimitBackoffMax,
+			now:                    s.clock.Now,
 		},
-		now:           s.now,
-		metricsTracer: s.metricsTracer,
+		clock:         s.clock,
+		metricsTracer: mt,
+		canDialCache:  newCanDialCache(s.clock.Now),
+	}
+	if s.serverLocalFamiliesFilter {
+		dialingHost := dialer
+		if dialingHost == nil {
+			dialingHost = host
+		}
+		as.localFamilies = newLocalFamilies(s.clock.Now, hostInterfaceAddrs(dialingHost))
 	}
+	if s.serverDialBackWorkers > 0 {
+		as.dialBackPool = newDialBackPool(s.clock, s.serverDialBackWorkers, s.serverDialBackQueueLen, s.serverDialBackQueueTimeout)
+	}
+	tp := s.tracerProvider
+	if tp == nil {
+		tp = noop.NewTracerProvider()
+	}
+	as.tracer = tp.Tracer(tracerName)
+	as.dialBackFunc = as.dialBack
+	if s.serverDialBackFunc != nil {
+		f := s.serverDialBackFunc
+		as.dialBackFunc = func(_ context.Context, p peer.ID, addr ma.Multiaddr, _ uint64) (pb.DialStatus, time.Duration) {
+			status := f(p, addr)
+			as.metricsTracer.CompletedDialBack(status)
+			return status, 0
+		}
+	}
+	return as
 }
 
 // Enable attaches the stream handler to the host.
@@ -80,23 +225,102 @@ func (as *server) Start() {
 	as.host.SetStreamHandler(DialProtocol, as.handleDialRequest)
 }
 
+// Close stops the server without waiting for in progress requests to complete.
 func (as *server) Close() {
-	as.host.RemoveStreamHandler(DialProtocol)
-	as.dialerHost.Close()
+	as.stopAccepting()
+	as.closeDialer()
 	as.limiter.Close()
 }
 
+// Shutdown stops accepting new requests and waits for in progress requests to complete before
+// closing the server. If ctx is done before the requests complete, the server is closed anyway and
+// the context's error is returned.
+func (as *server) Shutdown(ctx context.Context) error {
+	as.stopAccepting()
+	done := make(chan struct{})
+	go func() {
+		as.wg.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	as.closeDialer()
+	as.limiter.Close()
+	return err
+}
+
+// RateLimiterSnapshot returns a snapshot of the state of the server's rate limiter.
+func (as *server) RateLimiterSnapshot() RateLimiterStats {
+	return as.limiter.Stats()
+}
+
+// closeDialer closes the dialer host. In single host mode the host is owned by the caller and
+// isn't closed.
+func (as *server) closeDialer() {
+	if as.dialerHost != nil {
+		as.dialerHost.Close()
+	}
+}
+
+// dialNetwork returns the network used for dialing back peers.
+func (as *server) dialNetwork() network.Network {
+	if as.dialerHost == nil {
+		return as.host.Network()
+	}
+	return as.dialerHost.Network()
+}
+
+func (as *server) stopAccepting() {
+	as.host.RemoveStreamHandler(DialProtocol)
+	as.mu.Lock()
+	as.closed = true
+	as.mu.Unlock()
+}
+
 // handleDialRequest is the dial-request protocol stream handler
 func (as *server) handleDialRequest(s network.Stream) {
-	evt := as.serveDialRequest(s)
+	as.mu.Lock()
+	if as.closed {
+		as.mu.Unlock()
+		s.Reset()
+		return
+	}
+	as.wg.Add(1)
+	as.mu.Unlock()
+	defer as.wg.Done()
+
+	ctx, span := as.tracer.Start(context.Background(), "autonatv2.DialRequest",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("peer.id", s.Conn().RemotePeer().String())))
+	defer span.End()
+
+	evt := as.serveDialRequest(ctx, s)
+	if span.IsRecording() {
+		span.SetAttributes(
+			attribute.Bool("dial_data_required", evt.DialDataRequired),
+			attribute.String("response_status", evt.ResponseStatus.String()),
+			attribute.String("dial_status", evt.DialStatus.String()),
+		)
+		if evt.DialedAddr != nil {
+			span.SetAttributes(attribute.String("addr", evt.DialedAddr.String()))
+		}
+		if evt.Error != nil {
+			span.SetStatus(codes.Error, evt.Error.Error())
+		}
+	}
 	log.Debugf("completed dial-request from %s, response status: %s, dial status: %s, err: %s",
 		s.Conn().RemotePeer(), evt.ResponseStatus, evt.DialStatus, evt.Error)
-	if as.metricsTracer != nil {
-		as.metricsTracer.CompletedRequest(evt)
+	as.metricsTracer.CompletedRequest(evt)
+	if as.onDialBackComplete != nil {
+		as.onDialBackComplete(s.Conn().RemotePeer(), evt.DialedAddr, evt.DialStatus, evt.DialDataBytes)
 	}
 }
 
-func (as *server) serveDialRequest(s network.Stream) EventDialRequestCompleted {
+func (as *server) serveDialRequest(ctx context.Context, s network.Stream) EventDialRequestCompleted {
 	if err := s.Scope().SetService(ServiceName); err != nil {
 		s.Reset()
 		log.Debugf("failed to attach stream to %s service: %w", ServiceName, err)
@@ -112,22 +336,52 @@ func (as *server) serveDialRequest(s network.Stream) EventDialRequestCompleted {
 	}
 	defer s.Scope().ReleaseMemory(maxMsgSize)
 
-	deadline := as.now().Add(streamTimeout)
-	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	ctx, cancel := contextWithTimeout(ctx, as.clock, as.streamTimeout)
 	defer cancel()
-	s.SetDeadline(as.now().Add(streamTimeout))
+	deadline := newStreamDeadline(as.clock, s)
+	deadline.Set(as.streamTimeout)
+	defer deadline.Stop()
 	defer s.Close()
 
 	p := s.Conn().RemotePeer()
+	ip := remoteIP(s)
 
 	var msg pb.Message
 	w := pbio.NewDelimitedWriter(s)
+	// Check whether the peer is allowed before rate limiting and parsing the request
+	if as.requestGate != nil && !as.requestGate(p, s) {
+		as.metricsTracer.RejectedRequest(false)
+		// Read the request before responding, like for rate limited requests.
+		pbio.NewDelimitedReader(s, maxMsgSize).ReadMsg(&msg)
+		msg = pb.Message{
+			Msg: &pb.Message_DialResponse{
+				DialResponse: &pb.DialResponse{
+					Status: pb.DialResponse_E_REQUEST_REJECTED,
+				},
+			},
+		}
+		if err := w.WriteMsg(&msg); err != nil {
+			s.Reset()
+			log.Debugf("failed to write request rejected response to %s: %s", p, err)
+			return EventDialRequestCompleted{
+				ResponseStatus: pb.DialResponse_E_REQUEST_REJECTED,
+				Error:          fmt.Errorf("write failed: %w", err),
+			}
+		}
+		log.Debugf("rejected request from %s: denied by request gate", p)
+		return EventDialRequestCompleted{ResponseStatus: pb.DialResponse_E_REQUEST_REJECTED}
+	}
 	// Check for rate limit before parsing the request
-	if !as.limiter.Accept(p) {
+	if !as.limiter.Accept(p, ip) {
+		as.metricsTracer.RejectedRequest(false)
+		// Read the request before responding. Closing the stream with the request unread resets
+		// it, and the client would see the reset instead of the response.
+		pbio.NewDelimitedReader(s, maxMsgSize).ReadMsg(&msg)
 		msg = pb.Message{
 			Msg: &pb.Message_DialResponse{
 				DialResponse: &pb.DialResponse{
 					Status: pb.DialResponse_E_REQUEST_REJECTED,
+					Busy:   as.busyHint && as.limiter.Busy(),
 				},
 			},
 		}
@@ -142,50 +396,161 @@ func (as *server) serveDialRequest(s network.Stream) EventDialRequestCompleted {
 		log.Debugf("rejected request from %s: rate limit exceeded", p)
 		return EventDialRequestCompleted{ResponseStatus: pb.DialResponse_E_REQUEST_REJECTED}
 	}
-	defer as.limiter.CompleteRequest(p)
+	// The request is completed before writing the final response or resetting the stream, so that
+	// a client sending its next request as soon as this one ends isn't rejected by the per peer
+	// limit.
+	completed := false
+	completeRequest := func() {
+		if !completed {
+			completed = true
+			as.limiter.CompleteRequest(p)
+		}
+	}
+	defer completeRequest()
+	as.metricsTracer.AcceptedRequest()
 
 	r := pbio.NewDelimitedReader(s, maxMsgSize)
 	if err := r.ReadMsg(&msg); err != nil {
+		completeRequest()
 		s.Reset()
 		log.Debugf("failed to read request from %s: %s", p, err)
 		return EventDialRequestCompleted{Error: fmt.Errorf("read failed: %w", err)}
 	}
 	if msg.GetDialRequest() == nil {
-		s.Reset()
-		log.Debugf("invalid message type from %s: %T expected: DialRequest", p, msg.Msg)
-		return EventDialRequestCompleted{Error: errBadRequest}
+		// Reject the request instead of resetting the stream, so that clients sending message types
+		// introduced in newer versions of the protocol learn why the request failed. Message types
+		// unknown to us are reported as <nil>.
+		log.Debugf("rejecting request from %s: invalid message type: %T expected: DialRequest", p, msg.Msg)
+		msg = pb.Message{
+			Msg: &pb.Message_DialResponse{
+				DialResponse: &pb.DialResponse{
+					Status: pb.DialResponse_E_REQUEST_REJECTED,
+				},
+			},
+		}
+		completeRequest()
+		if err := w.WriteMsg(&msg); err != nil {
+			s.Reset()
+			log.Debugf("failed to write request rejected response to %s: %s", p, err)
+			return EventDialRequestCompleted{
+				ResponseStatus: pb.DialResponse_E_REQUEST_REJECTED,
+				Error:          fmt.Errorf("write failed: %w", err),
+			}
+		}
+		return EventDialRequestCompleted{
+			ResponseStatus: pb.DialResponse_E_REQUEST_REJECTED,
+			Error:          errBadRequest,
+		}
+	}
+
+	// Reject requests with many more addresses than we'd inspect without parsing them. Clients
+	// send their own addresses, so such requests are likely abusive.
+	if n := len(msg.GetDialRequest().GetAddrs()); n > excessivePeerAddressesFactor*as.maxPeerAddresses {
+		log.Debugf("rejecting request from %s: too many addresses: %d, max: %d", p, n, as.maxPeerAddresses)
+		msg = pb.Message{
+			Msg: &pb.Message_DialResponse{
+				DialResponse: &pb.DialResponse{
+					Status: pb.DialResponse_E_REQUEST_REJECTED,
+				},
+			},
+		}
+		completeRequest()
+		if err := w.WriteMsg(&msg); err != nil {
+			s.Reset()
+			log.Debugf("failed to write request rejected response to %s: %s", p, err)
+			return EventDialRequestCompleted{
+				ResponseStatus: pb.DialResponse_E_REQUEST_REJECTED,
+				Error:          fmt.Errorf("write failed: %w", err),
+			}
+		}
+		return EventDialRequestCompleted{
+			ResponseStatus: pb.DialResponse_E_REQUEST_REJECTED,
+			Error:          fmt.Errorf("%w: too many addresses: %d", errBadRequest, n),
+		}
 	}
 
 	// parse peer's addresses
 	var dialAddr ma.Multiaddr
 	var addrIdx int
+	// candidates are the dialable addresses in the order they were requested. Only the first
+	// one is dialed unless dial back fallback is enabled.
+	var candidates []dialCandidate
+	// indexes of the addresses skipped for each reason. Used to pick the most informative response
+	// status when there's no dialable address.
+	var invalidIdxs, privateIdxs, undialableIdxs []uint32
+	// seen tracks the addresses already evaluated. Duplicates are skipped, the indexes of the
+	// remaining addresses are unchanged.
+	seen := make(map[string]struct{})
 	for i, ab := range msg.GetDialRequest().GetAddrs() {
-		if i >= maxPeerAddresses {
+		if i >= as.maxPeerAddresses {
 			break
 		}
+		if len(ab) > as.maxAddrBytes {
+			invalidIdxs = append(invalidIdxs, uint32(i))
+			continue
+		}
+		if _, ok := seen[string(ab)]; ok {
+			continue
+		}
+		seen[string(ab)] = struct{}{}
 		a, err := ma.NewMultiaddrBytes(ab)
 		if err != nil {
+			invalidIdxs = append(invalidIdxs, uint32(i))
+			continue
+		}
+		if !as.allowCircuitAddrs && isRelayAddr(a) {
+			undialableIdxs = append(undialableIdxs, uint32(i))
+			continue
+		}
+		// Addresses with an IPv6 zone are scoped to one of the client's interfaces and can't be
+		// dialed by a remote peer. They're rejected even when private addresses are allowed.
+		if isIP6ZoneAddr(a) {
+			undialableIdxs = append(undialableIdxs, uint32(i))
 			continue
 		}
 		if !as.allowPrivateAddrs && !manet.IsPublicAddr(a) {
+			privateIdxs = append(privateIdxs, uint32(i))
+			continue
+		}
+		if as.dialBackTransportFilter != nil && !as.dialBackTransportFilter(a) {
+			undialableIdxs = append(undialableIdxs, uint32(i))
 			continue
 		}
-		if !as.dialerHost.Network().CanDial(p, a) {
+		// Dial backs to public addresses of an IP family the dialing host has no interface address
+		// for, like IPv6 addresses on an IPv4 only network, would fail after timing out.
+		if as.localFamilies != nil && manet.IsPublicAddr(a) && !as.localFamilies.CanDial(a) {
+			undialableIdxs = append(undialableIdxs, uint32(i))
 			continue
 		}
-		dialAddr = a
-		addrIdx = i
-		break
+		if !as.canDial(p, a) {
+			undialableIdxs = append(undialableIdxs, uint32(i))
+			continue
+		}
+		candidates = append(candidates, dialCandidate{Addr: a, Idx: i})
+		if !as.dialBackFallback {
+			break
+		}
 	}
 	// No dialable address
-	if dialAddr == nil {
+	if len(candidates) == 0 {
+		as.metricsTracer.RefusedRequest()
+		log.Debugf("refusing request from %s: no dialable address: invalid: %d, private: %d, undialable: %d",
+			p, len(invalidIdxs), len(privateIdxs), len(undialableIdxs))
+		resp := &pb.DialResponse{
+			Status:          pb.DialResponse_E_DIAL_REFUSED,
+			AllAddrsPrivate: len(privateIdxs) > 0 && len(invalidIdxs) == 0 && len(undialableIdxs) == 0,
+		}
+		if as.reportRefusedAddrs {
+			resp.PrivateAddrIdxs = privateIdxs
+			resp.UndialableAddrIdxs = undialableIdxs
+			resp.InvalidAddrIdxs = invalidIdxs
+		}
 		msg = pb.Message{
 			Msg: &pb.Message_DialResponse{
-				DialResponse: &pb.DialResponse{
-					Status: pb.DialResponse_E_DIAL_REFUSED,
-				},
+				DialResponse: resp,
 			},
 		}
+		completeRequest()
 		if err := w.WriteMsg(&msg); err != nil {
 			s.Reset()
 			log.Debugf("failed to write dial refused response to %s: %s", p, err)
@@ -199,10 +564,17 @@ func (as *server) serveDialRequest(s network.Stream) EventDialRequestCompleted {
 		}
 	}
 
+	dialAddr, addrIdx = candidates[0].Addr, candidates[0].Idx
 	nonce := msg.GetDialRequest().Nonce
 
 	isDialDataRequired := as.dialDataRequestPolicy(s, dialAddr)
-	if isDialDataRequired && !as.limiter.AcceptDialDataRequest(p) {
+	var dialDataBytes int
+	if isDialDataRequired {
+		// clamp the size so that a bad size func can't break the rate limiter's byte accounting
+		dialDataBytes = min(max(as.dialDataSize(dialAddr), 1), maxHandshakeSizeBytes)
+	}
+	if isDialDataRequired && !as.limiter.AcceptDialDataRequest(p, dialDataBytes) {
+		as.metricsTracer.RejectedRequest(true)
 		msg = pb.Message{
 			Msg: &pb.Message_DialResponse{
 				DialResponse: &pb.DialResponse{
@@ -210,6 +582,7 @@ func (as *server) serveDialRequest(s network.Stream) EventDialRequestCompleted {
 				},
 			},
 		}
+		completeRequest()
 		if err := w.WriteMsg(&msg); err != nil {
 			s.Reset()
 			log.Debugf("failed to write request rejected response to %s: %s", p, err)
@@ -227,7 +600,9 @@ func (as *server) serveDialRequest(s network.Stream) EventDialRequestCompleted {
 	}
 
 	if isDialDataRequired {
-		if err := getDialData(w, s, &msg, addrIdx); err != nil {
+		trace.SpanFromContext(ctx).SetAttributes(attribute.Int("dial_data_bytes", dialDataBytes))
+		if err := getDialData(w, s, &msg, addrIdx, dialDataBytes, as.minDialDataChunkSize); err != nil {
+			completeRequest()
 			s.Reset()
 			log.Debugf("%s refused dial data request: %s", p, err)
 			return EventDialRequestCompleted{
@@ -238,27 +613,97 @@ func (as *server) serveDialRequest(s network.Stream) EventDialRequestCompleted {
 		}
 		// wait for a bit to prevent thundering herd style attacks on a victim
 		waitTime := time.Duration(rand.Intn(int(as.amplificatonAttackPreventionDialWait) + 1)) // the range is [0, n)
-		t := time.NewTimer(waitTime)
-		defer t.Stop()
-		select {
-		case <-ctx.Done():
-			s.Reset()
-			log.Debugf("rejecting request without dialing: %s %p ", p, ctx.Err())
-			return EventDialRequestCompleted{Error: ctx.Err(), DialDataRequired: true, DialedAddr: dialAddr}
-		case <-t.C:
+		// Timers of a mock clock only fire when the clock is advanced, even if they're already due.
+		if waitTime > 0 {
+			t := as.clock.InstantTimer(as.clock.Now().Add(waitTime))
+			defer t.Stop()
+			select {
+			case <-ctx.Done():
+				completeRequest()
+				s.Reset()
+				log.Debugf("rejecting request without dialing: %s %p ", p, ctx.Err())
+				return EventDialRequestCompleted{Error: ctx.Err(), DialDataRequired: true, DialDataBytes: dialDataBytes, DialedAddr: dialAddr}
+			case <-t.Ch():
+			}
 		}
 	}
 
-	dialStatus := as.dialBack(ctx, s.Conn().RemotePeer(), dialAddr, nonce)
+	// Wait for a dial back worker, shedding the request if there are too many dial backs in
+	// progress.
+	if as.dialBackPool != nil {
+		if !as.dialBackPool.Acquire(ctx) {
+			as.metricsTracer.RejectedRequest(isDialDataRequired)
+			msg = pb.Message{
+				Msg: &pb.Message_DialResponse{
+					DialResponse: &pb.DialResponse{
+						Status: pb.DialResponse_E_REQUEST_REJECTED,
+						Busy:   as.busyHint,
+					},
+				},
+			}
+			completeRequest()
+			if err := w.WriteMsg(&msg); err != nil {
+				s.Reset()
+				log.Debugf("failed to write request rejected response to %s: %s", p, err)
+				return EventDialRequestCompleted{
+					ResponseStatus:   pb.DialResponse_E_REQUEST_REJECTED,
+					Error:            fmt.Errorf("write failed: %w", err),
+					DialDataRequired: isDialDataRequired,
+					DialDataBytes:    dialDataBytes,
+				}
+			}
+			log.Debugf("rejected request from %s: too many dial backs in progress", p)
+			return EventDialRequestCompleted{
+				ResponseStatus:   pb.DialResponse_E_REQUEST_REJECTED,
+				DialDataRequired: isDialDataRequired,
+				DialDataBytes:    dialDataBytes,
+			}
+		}
+		defer as.dialBackPool.Release()
+	}
+
+	// Stop dialing back if the client resets the stream or closes the connection, there's no
+	// point in completing the dial back if we can't send the response.
+	dialCtx, stopWatching := watchStreamReset(ctx, s)
+	var dialStatus pb.DialStatus
+	var rtt time.Duration
+	if len(candidates) == 1 {
+		dialStatus, rtt = as.dialBackFunc(dialCtx, p, dialAddr, nonce)
+	} else {
+		if !isDialDataRequired {
+			// Without dial data, only fall back to addresses that don't require it.
+			candidates = slices.DeleteFunc(candidates[1:], func(c dialCandidate) bool {
+				return as.dialDataRequestPolicy(s, c.Addr)
+			})
+			candidates = append([]dialCandidate{{Addr: dialAddr, Idx: addrIdx}}, candidates...)
+		}
+		var c dialCandidate
+		dialStatus, rtt, c = as.dialBackWithFallback(dialCtx, p, candidates, nonce)
+		dialAddr, addrIdx = c.Addr, c.Idx
+	}
+	if err := stopWatching(); err != nil {
+		completeRequest()
+		s.Reset()
+		log.Debugf("stream from %s closed during dial back: %s", p, err)
+		return EventDialRequestCompleted{
+			DialStatus:       dialStatus,
+			Error:            fmt.Errorf("stream closed during dial back: %w", err),
+			DialDataRequired: isDialDataRequired,
+			DialDataBytes:    dialDataBytes,
+			DialedAddr:       dialAddr,
+		}
+	}
 	msg = pb.Message{
 		Msg: &pb.Message_DialResponse{
 			DialResponse: &pb.DialResponse{
-				Status:     pb.DialResponse_OK,
-				DialStatus: dialStatus,
-				AddrIdx:    uint32(addrIdx),
+				Status:            pb.DialResponse_OK,
+				DialStatus:        dialStatus,
+				AddrIdx:           uint32(addrIdx),
+				DialBackRTTMicros: uint64(rtt.Microseconds()),
 			},
 		},
 	}
+	completeRequest()
 	if err := w.WriteMsg(&msg); err != nil {
 		s.Reset()
 		log.Debugf("failed to write response to %s: %s", p, err)
@@ -267,6 +712,7 @@ func (as *server) serveDialRequest(s network.Stream) EventDialRequestCompleted {
 			DialStatus:       dialStatus,
 			Error:            fmt.Errorf("write failed: %w", err),
 			DialDataRequired: isDialDataRequired,
+			DialDataBytes:    dialDataBytes,
 			DialedAddr:       dialAddr,
 		}
 	}
@@ -275,13 +721,211 @@ func (as *server) serveDialRequest(s network.Stream) EventDialRequestCompleted {
 		DialStatus:       dialStatus,
 		Error:            nil,
 		DialDataRequired: isDialDataRequired,
+		DialDataBytes:    dialDataBytes,
 		DialedAddr:       dialAddr,
 	}
 }
 
-// getDialData gets data from the client for dialing the address
-func getDialData(w pbio.Writer, s network.Stream, msg *pb.Message, addrIdx int) error {
-	numBytes := minHandshakeSizeBytes + rand.Intn(maxHandshakeSizeBytes-minHandshakeSizeBytes)
+// canDial reports whether the server can dial back peer p on a. The result is cached by peer and
+// address for canDialCacheTTL, as the network's check depends on the peer through the connection
+// gater.
+func (as *server) canDial(p peer.ID, a ma.Multiaddr) bool {
+	if ok, found := as.canDialCache.Get(p, a); found {
+		return ok
+	}
+	ok := as.dialNetwork().CanDial(p, a)
+	as.canDialCache.Put(p, a, ok)
+	return ok
+}
+
+// canDialCache caches whether addresses can be dialed for a peer, sparing the network's checks for
+// addresses that are requested repeatedly. Once the cache is full, the least recently used result
+// is evicted.
+type canDialCache struct {
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries *simplelru.LRU[canDialKey, canDialEntry]
+}
+
+type canDialKey struct {
+	p    peer.ID
+	addr string
+}
+
+type canDialEntry struct {
+	OK      bool
+	Expires time.Time
+}
+
+func newCanDialCache(now func() time.Time) *canDialCache {
+	entries, err := simplelru.NewLRU[canDialKey, canDialEntry](maxCanDialCacheSize, nil)
+	if err != nil {
+		// only happens for a non-positive size
+		panic(err)
+	}
+	return &canDialCache{
+		now:     now,
+		entries: entries,
+	}
+}
+
+// Get returns the cached result for p and a. found is false if there is no result or it expired.
+func (c *canDialCache) Get(p peer.ID, a ma.Multiaddr) (ok, found bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k := canDialKey{p: p, addr: string(a.Bytes())}
+	e, found := c.entries.Get(k)
+	if !found {
+		return false, false
+	}
+	if !c.now().Before(e.Expires) {
+		c.entries.Remove(k)
+		return false, false
+	}
+	return e.OK, true
+}
+
+// Put caches the result for p and a, evicting the least recently used result if the cache is full.
+func (c *canDialCache) Put(p peer.ID, a ma.Multiaddr, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries.Add(canDialKey{p: p, addr: string(a.Bytes())}, canDialEntry{OK: ok, Expires: c.now().Add(canDialCacheTTL)})
+}
+
+// localFamilies tracks whether the dialing host has IPv4 and IPv6 interface addresses, other than
+// loopback and link local addresses. Without one, the host can't reach public addresses of that
+// family.
+type localFamilies struct {
+	now            func() time.Time
+	interfaceAddrs func() ([]ma.Multiaddr, error)
+
+	mu      sync.Mutex
+	expires time.Time
+	hasIP4  bool
+	hasIP6  bool
+}
+
+func newLocalFamilies(now func() time.Time, interfaceAddrs func() ([]ma.Multiaddr, error)) *localFamilies {
+	return &localFamilies{now: now, interfaceAddrs: interfaceAddrs}
+}
+
+// CanDial reports whether the host has an interface address of a's IP family. It returns true for
+// addresses that don't start with an IP address. The interface addresses are cached for
+// localFamiliesTTL.
+func (f *localFamilies) CanDial(a ma.Multiaddr) bool {
+	first, _ := ma.SplitFirst(a)
+	if first == nil {
+		return true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := f.now()
+	if !now.Before(f.expires) {
+		f.refresh()
+		f.expires = now.Add(localFamiliesTTL)
+	}
+	switch first.Protocol().Code {
+	case ma.P_IP4:
+		return f.hasIP4
+	case ma.P_IP6:
+		return f.hasIP6
+	default:
+		return true
+	}
+}
+
+// hostInterfaceAddrs returns a function returning the interface addresses h listens on. A host
+// listening on an unspecified address can dial from all interface addresses of that family, and a
+// host only listening on IPv4 can't dial IPv6 addresses with port reuse. If h doesn't listen on
+// any address other than loopback and link local addresses, it dials from any interface address,
+// so the function returns all of them.
+func hostInterfaceAddrs(h host.Host) func() ([]ma.Multiaddr, error) {
+	return func() ([]ma.Multiaddr, error) {
+		if n, ok := h.Network().(interface {
+			InterfaceListenAddresses() ([]ma.Multiaddr, error)
+		}); ok {
+			addrs, err := n.InterfaceListenAddresses()
+			if err != nil {
+				return nil, err
+			}
+			addrs = ma.FilterAddrs(addrs, func(a ma.Multiaddr) bool {
+				return !manet.IsIPLoopback(a) && !manet.IsIP6LinkLocal(a)
+			})
+			if len(addrs) > 0 {
+				return addrs, nil
+			}
+		}
+		return manet.InterfaceMultiaddrs()
+	}
+}
+
+// refresh must be called with mu held.
+func (f *localFamilies) refresh() {
+	addrs, err := f.interfaceAddrs()
+	if err != nil {
+		log.Debugf("failed to get interface addresses: %s", err)
+		f.hasIP4, f.hasIP6 = true, true
+		return
+	}
+	f.hasIP4, f.hasIP6 = false, false
+	for _, a := range addrs {
+		if manet.IsIPLoopback(a) || manet.IsIP6LinkLocal(a) {
+			continue
+		}
+		first, _ := ma.SplitFirst(a)
+		if first == nil {
+			continue
+		}
+		switch first.Protocol().Code {
+		case ma.P_IP4:
+			f.hasIP4 = true
+		case ma.P_IP6:
+			f.hasIP6 = true
+		}
+	}
+}
+
+// watchStreamReset returns a context that is canceled when s is reset or its connection is closed.
+// The client doesn't send anything on s while waiting for the response, so it reads s in the
+// background to detect this. stop stops watching s and returns the error that canceled the
+// context, if any. It must be called before s is used again. If s doesn't support read deadlines,
+// stop closes the read side of s, so s can only be written to afterwards.
+func watchStreamReset(ctx context.Context, s network.Stream) (_ context.Context, stop func() error) {
+	ctx, cancel := context.WithCancel(ctx)
+	var stopped atomic.Bool
+	var readErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b := make([]byte, 1)
+		for {
+			if _, err := s.Read(b); err != nil {
+				// The client may close its side of the stream after sending the request.
+				if !stopped.Load() && !errors.Is(err, io.EOF) {
+					readErr = err
+					cancel()
+				}
+				return
+			}
+		}
+	}()
+	return ctx, func() error {
+		stopped.Store(true)
+		if err := s.SetReadDeadline(time.Now()); err != nil {
+			// The pending read can't be interrupted with a deadline, closing the read side
+			// unblocks it.
+			s.CloseRead()
+		}
+		<-done
+		cancel()
+		return readErr
+	}
+}
+
+// getDialData gets numBytes of data from the client for dialing the address. Dial data messages
+// smaller than minChunkSize are rejected.
+func getDialData(w pbio.Writer, s network.Stream, msg *pb.Message, addrIdx int, numBytes int, minChunkSize int) error {
 	*msg = pb.Message{
 		Msg: &pb.Message_DialDataRequest{
 			DialDataRequest: &pb.DialDataRequest{
@@ -296,10 +940,10 @@ func getDialData(w pbio.Writer, s network.Stream, msg *pb.Message, addrIdx int)
 	// pbio.Reader that we used so far on this stream is buffered. But at this point
 	// there is nothing unread on the stream. So it is safe to use the raw stream to
 	// read, reducing allocations.
-	return readDialData(numBytes, s)
+	return readDialData(numBytes, minChunkSize, s)
 }
 
-func readDialData(numBytes int, r io.Reader) error {
+func readDialData(numBytes int, minChunkSize int, r io.Reader) error {
 	mr := &msgReader{R: r, Buf: pool.Get(maxMsgSize)}
 	defer pool.Put(mr.Buf)
 	for remain := numBytes; remain > 0; {
@@ -322,19 +966,69 @@ func readDialData(numBytes int, r io.Reader) error {
 			remain -= bytesLen
 		}
 		// Check if the peer is not sending too little data forcing us to just do a lot of compute
-		if bytesLen < 100 && remain > 0 {
+		if bytesLen < minChunkSize && remain > 0 {
 			return fmt.Errorf("dial data msg too small: %d", bytesLen)
 		}
 	}
 	return nil
 }
 
-func (as *server) dialBack(ctx context.Context, p peer.ID, addr ma.Multiaddr, nonce uint64) pb.DialStatus {
-	ctx, cancel := context.WithTimeout(ctx, dialBackDialTimeout)
-	ctx = network.WithForceDirectDial(ctx, "autonatv2")
+// dialCandidate is a dialable address from a dial request.
+type dialCandidate struct {
+	Addr ma.Multiaddr
+	// Idx is the index of the address in the request
+	Idx int
+}
+
+// dialBackWithFallback dials back the candidates in order until one of them can be dialed, all
+// within a single dialBackDialTimeout. It returns the dial status and dial back RTT of the last
+// candidate dialed and the candidate itself.
+func (as *server) dialBackWithFallback(ctx context.Context, p peer.ID, candidates []dialCandidate, nonce uint64) (pb.DialStatus, time.Duration, dialCandidate) {
+	ctx, cancel := contextWithTimeout(ctx, as.clock, as.dialBackDialTimeout)
+	defer cancel()
+	var status pb.DialStatus
+	var rtt time.Duration
+	var c dialCandidate
+	for _, c = range candidates {
+		status, rtt = as.dialBackFunc(ctx, p, c.Addr, nonce)
+		// E_DIAL_BACK_ERROR means the address is reachable, so only dial errors warrant
+		// trying the next address.
+		if status != pb.DialStatus_E_DIAL_ERROR || ctx.Err() != nil {
+			break
+		}
+		log.Debugf("dial back to %s failed on %s, trying next address", p, c.Addr)
+	}
+	return status, rtt, c
+}
+
+// dialBack dials back peer p on addr and sends it the nonce. It returns the dial status and the time
+// from the start of the dial until the peer acknowledged the dial back. The RTT is zero if the dial
+// back failed.
+func (as *server) dialBack(ctx context.Context, p peer.ID, addr ma.Multiaddr, nonce uint64) (status pb.DialStatus, rtt time.Duration) {
+	ctx, span := as.tracer.Start(ctx, "autonatv2.DialBack",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("peer.id", p.String()), attribute.String("addr", addr.String())))
+	defer func() {
+		span.SetAttributes(attribute.String("dial_status", status.String()))
+		span.End()
+		as.metricsTracer.CompletedDialBack(status)
+	}()
+
+	ctx, cancel := contextWithTimeout(ctx, as.clock, as.dialBackDialTimeout)
+	defer cancel()
+	start := as.clock.Now()
+	if isRelayAddr(addr) {
+		// relay addresses can only be dialed through the relay and result in a limited connection
+		ctx = network.WithAllowLimitedConn(ctx, "autonatv2")
+	} else {
+		ctx = network.WithForceDirectDial(ctx, "autonatv2")
+	}
+	if as.dialerHost == nil {
+		return as.dialBackTransient(ctx, p, addr, nonce, start)
+	}
+
 	as.dialerHost.Peerstore().AddAddr(p, addr, peerstore.TempAddrTTL)
 	defer func() {
-		cancel()
 		as.dialerHost.Network().ClosePeer(p)
 		as.dialerHost.Peerstore().ClearAddrs(p)
 		as.dialerHost.Peerstore().RemovePeer(p)
@@ -342,65 +1036,234 @@ func (as *server) dialBack(ctx context.Context, p peer.ID, addr ma.Multiaddr, no
 
 	err := as.dialerHost.Connect(ctx, peer.AddrInfo{ID: p})
 	if err != nil {
-		return pb.DialStatus_E_DIAL_ERROR
+		return pb.DialStatus_E_DIAL_ERROR, 0
 	}
 
 	s, err := as.dialerHost.NewStream(ctx, p, DialBackProtocol)
 	if err != nil {
-		return pb.DialStatus_E_DIAL_BACK_ERROR
+		return pb.DialStatus_E_DIAL_BACK_ERROR, 0
 	}
 
 	defer s.Close()
-	s.SetDeadline(as.now().Add(dialBackStreamTimeout))
+	deadline := newStreamDeadline(as.clock, s)
+	defer deadline.Stop()
+	deadline.Set(as.dialBackStreamTimeout)
+	return as.sendDialBack(s, deadline, nonce, start)
+}
 
+// dialBackTransient dials back the peer with the host's swarm on a connection that isn't added to
+// the swarm. The dial is subject to the host's connection gater, resource manager and dial limiter,
+// but nothing is added to the host's peerstore and the host's existing connection to the peer is
+// left alone. The connection is closed once the dial back completes.
+func (as *server) dialBackTransient(ctx context.Context, p peer.ID, addr ma.Multiaddr, nonce uint64, start time.Time) (pb.DialStatus, time.Duration) {
+	dd, ok := as.host.Network().(detachedDialer)
+	if !ok {
+		return pb.DialStatus_E_DIAL_ERROR, 0
+	}
+	c, err := dd.DialAddrDetached(ctx, p, addr)
+	if err != nil {
+		log.Debugf("dial back to %s on %s failed: %s", p, addr, err)
+		return pb.DialStatus_E_DIAL_ERROR, 0
+	}
+	defer c.Close()
+
+	// The transport accounts the connection in the resource manager. Account the stream as well,
+	// as the swarm would.
+	scope, err := as.host.Network().ResourceManager().OpenStream(p, network.DirOutbound)
+	if err != nil {
+		log.Debugf("failed to open dial back stream scope for %s: %s", p, err)
+		return pb.DialStatus_E_DIAL_BACK_ERROR, 0
+	}
+	defer scope.Done()
+	if err := scope.SetProtocol(DialBackProtocol); err != nil {
+		log.Debugf("failed to set dial back stream protocol for %s: %s", p, err)
+		return pb.DialStatus_E_DIAL_BACK_ERROR, 0
+	}
+	if err := scope.SetService(ServiceName); err != nil {
+		log.Debugf("failed to attach dial back stream for %s to the %s service: %s", p, ServiceName, err)
+		return pb.DialStatus_E_DIAL_BACK_ERROR, 0
+	}
+
+	s, err := c.OpenStream(ctx)
+	if err != nil {
+		return pb.DialStatus_E_DIAL_BACK_ERROR, 0
+	}
+	defer s.Close()
+	deadline := newStreamDeadline(as.clock, s)
+	defer deadline.Stop()
+	deadline.Set(as.dialBackStreamTimeout)
+	if err := msmux.SelectProtoOrFail(DialBackProtocol, s); err != nil {
+		s.Reset()
+		return pb.DialStatus_E_DIAL_BACK_ERROR, 0
+	}
+	return as.sendDialBack(s, deadline, nonce, start)
+}
+
+// sendDialBack sends the dial back message with nonce on s and waits for the peer's DialBackResponse.
+// deadline is s's deadline. It returns the time since start at which the peer acknowledged the
+// message. If the peer doesn't acknowledge the message or reports an error, the status is
+// E_DIAL_BACK_ERROR.
+func (as *server) sendDialBack(s network.MuxedStream, deadline *streamDeadline, nonce uint64, start time.Time) (pb.DialStatus, time.Duration) {
 	w := pbio.NewDelimitedWriter(s)
 	if err := w.WriteMsg(&pb.DialBack{Nonce: nonce}); err != nil {
 		s.Reset()
-		return pb.DialStatus_E_DIAL_BACK_ERROR
+		return pb.DialStatus_E_DIAL_BACK_ERROR, 0
 	}
 
-	// Since the underlying connection is on a separate dialer, it'll be closed after this
-	// function returns. Connection close will drop all the queued writes. To ensure message
-	// delivery, do a CloseWrite and read a byte from the stream. The peer actually sends a
-	// response of type DialBackResponse but we only care about the fact that the DialBack
-	// message has reached the peer. So we ignore that message on the read side.
+	// The underlying connection is closed after the dial back, either by closing the peer on the
+	// dialer host or by closing the transient connection. Connection close will drop all the
+	// queued writes. To ensure message delivery, do a CloseWrite and wait for the response.
 	s.CloseWrite()
-	s.SetDeadline(as.now().Add(5 * time.Second)) // 5 is a magic number
-	b := make([]byte, 1)                         // Read 1 byte here because 0 len reads are free to return (0, nil) immediately
-	s.Read(b)
+	deadline.Set(as.dialBackResponseTimeout)
+	r := pbio.NewDelimitedReader(s, dialBackMaxMsgSize)
+	var res pb.DialBackResponse
+	if err := r.ReadMsg(&res); err != nil {
+		log.Debugf("failed to read dial back response: %s", err)
+		s.Reset()
+		return pb.DialStatus_E_DIAL_BACK_ERROR, 0
+	}
+	rtt := as.clock.Since(start)
+	if res.GetStatus() != pb.DialBackResponse_OK {
+		log.Debugf("dial back failed: peer responded with %s", res.GetStatus())
+		return pb.DialStatus_E_DIAL_BACK_ERROR, 0
+	}
+	// Clients that don't echo the nonce send 0.
+	if (res.GetNonce() != 0 || as.requireDialBackNonce) && res.GetNonce() != nonce {
+		log.Debugf("dial back failed: peer responded with nonce %d, expected %d", res.GetNonce(), nonce)
+		return pb.DialStatus_E_DIAL_BACK_ERROR, 0
+	}
+	return pb.DialStatus_OK, rtt
+}
 
-	return pb.DialStatus_OK
+// dialBackPool bounds the number of concurrent dial backs to the number of workers. Dial backs
+// beyond that wait in a queue of bounded length for a worker to become available.
+type dialBackPool struct {
+	// workers has a slot for every dial back in progress
+	workers      chan struct{}
+	maxQueued    int
+	queueTimeout time.Duration
+	clock        Clock
+
+	mu     sync.Mutex
+	queued int
+}
+
+func newDialBackPool(cl Clock, workers, queueLen int, queueTimeout time.Duration) *dialBackPool {
+	return &dialBackPool{
+		clock:        cl,
+		workers:      make(chan struct{}, workers),
+		maxQueued:    queueLen,
+		queueTimeout: queueTimeout,
+	}
 }
 
-// rateLimiter implements a sliding window rate limit of requests per minute. It allows 1 concurrent request
-// per peer. It rate limits requests globally, at a peer level and depending on whether it requires dial data.
+// Acquire waits for a worker for the dial back. It returns false without waiting if the queue is
+// full, and returns false if no worker becomes available within the queue timeout or before ctx is
+// done. Release must be called after the dial back if Acquire returns true.
+func (p *dialBackPool) Acquire(ctx context.Context) bool {
+	select {
+	case p.workers <- struct{}{}:
+		return true
+	default:
+	}
+
+	p.mu.Lock()
+	if p.queued >= p.maxQueued {
+		p.mu.Unlock()
+		return false
+	}
+	p.queued++
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		p.queued--
+		p.mu.Unlock()
+	}()
+
+	t := p.clock.InstantTimer(p.clock.Now().Add(p.queueTimeout))
+	defer t.Stop()
+	select {
+	case p.workers <- struct{}{}:
+		return true
+	case <-t.Ch():
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Release frees the worker acquired for a dial back.
+func (p *dialBackPool) Release() {
+	<-p.workers
+}
+
+// rateLimiter implements a sliding window rate limit of requests per window. It allows MaxConcurrentPerPeer
+// concurrent requests per peer. It rate limits requests globally, at a peer level and depending on whether it requires dial data.
 type rateLimiter struct {
-	// PerPeerRPM is the rate limit per peer
+	// PerPeerRPM is the rate limit per peer, in requests per Window
 	PerPeerRPM int
-	// RPM is the global rate limit
+	// PerIPRPM is the rate limit per remote IP address, in requests per Window. Zero disables the
+	// limit.
+	PerIPRPM int
+	// RPM is the global rate limit, in requests per Window
 	RPM int
-	// DialDataRPM is the rate limit for requests that require dial data
+	// DialDataRPM is the rate limit for requests that require dial data, in requests per Window
 	DialDataRPM int
+	// DialDataBytesPerWindow is the limit on the total dial data requested from all peers, in bytes
+	// per Window. There's no limit if unset.
+	DialDataBytesPerWindow int
+	// Window is the duration of the sliding window. Defaults to 1 minute if unset.
+	Window time.Duration
+	// MaxConcurrentPerPeer is the number of concurrent requests allowed per peer. Defaults to 1 if unset.
+	MaxConcurrentPerPeer int
+	// BackoffBase is the cooldown applied to a peer after its first rejected request. Each
+	// consecutive rejection doubles the cooldown, up to BackoffMax. Backoff is disabled if unset.
+	BackoffBase time.Duration
+	// BackoffMax is the maximum cooldown applied to a peer. Defaults to BackoffBase if unset.
+	BackoffMax time.Duration
 
 	mu           sync.Mutex
 	closed       bool
 	reqs         []entry
 	peerReqs     map[peer.ID][]time.Time
-	dialDataReqs []time.Time
-	// ongoingReqs tracks in progress requests. This is used to disallow multiple concurrent requests by the
-	// same peer
-	// TODO: Should we allow a few concurrent requests per peer?
-	ongoingReqs map[peer.ID]struct{}
+	ipReqs       map[netip.Addr][]time.Time
+	dialDataReqs []dialDataEntry
+	// dialDataBytes is the total number of bytes requested by dialDataReqs
+	dialDataBytes int
+	// ongoingReqs tracks the number of in progress requests per peer. This is used to limit concurrent
+	// requests by the same peer
+	ongoingReqs map[peer.ID]int
+	// backoffs tracks the peers that were rejected consecutively
+	backoffs map[peer.ID]backoff
+	// nextCleanup is the time after which stale requests are removed. Until then the request
+	// counts may include stale requests.
+	nextCleanup time.Time
 
 	now func() time.Time // for tests
 }
 
+// backoff is the rate limiter penalty state of a peer.
+type backoff struct {
+	// Rejections is the number of consecutive rejected requests
+	Rejections int
+	// Until is the time until which all requests from the peer are rejected
+	Until time.Time
+}
+
 type entry struct {
 	PeerID peer.ID
+	IP     netip.Addr
 	Time   time.Time
 }
 
-func (r *rateLimiter) Accept(p peer.ID) bool {
+type dialDataEntry struct {
+	Time  time.Time
+	Bytes int
+}
+
+// Accept reports whether a new request from peer p is allowed. ip is the remote IP address of the
+// request's connection. The per IP limit is not applied if ip is the zero value.
+func (r *rateLimiter) Accept(p peer.ID, ip netip.Addr) bool {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	if r.closed {
@@ -408,26 +1271,59 @@ func (r *rateLimiter) Accept(p peer.ID) bool {
 	}
 	if r.peerReqs == nil {
 		r.peerReqs = make(map[peer.ID][]time.Time)
-		r.ongoingReqs = make(map[peer.ID]struct{})
+		r.ipReqs = make(map[netip.Addr][]time.Time)
+		r.ongoingReqs = make(map[peer.ID]int)
+		r.backoffs = make(map[peer.ID]backoff)
 	}
 
 	nw := r.now()
-	r.cleanup(nw)
-
-	if _, ok := r.ongoingReqs[p]; ok {
+	// Peers in their cooldown period are rejected without updating the sliding windows.
+	if nw.Before(r.backoffs[p].Until) {
 		return false
 	}
-	if len(r.reqs) >= r.RPM || len(r.peerReqs[p]) >= r.PerPeerRPM {
+	cleaned := r.maybeCleanup(nw)
+
+	if r.ongoingReqs[p] >= r.maxConcurrentPerPeer() {
+		r.penalize(p, nw)
 		return false
 	}
+	if r.limited(p, ip) {
+		// The counts may include stale requests.
+		if !cleaned {
+			r.cleanup(nw)
+		}
+		if r.limited(p, ip) {
+			r.penalize(p, nw)
+			return false
+		}
+	}
 
-	r.ongoingReqs[p] = struct{}{}
-	r.reqs = append(r.reqs, entry{PeerID: p, Time: nw})
+	delete(r.backoffs, p)
+	r.ongoingReqs[p]++
+	r.reqs = append(r.reqs, entry{PeerID: p, IP: ip, Time: nw})
 	r.peerReqs[p] = append(r.peerReqs[p], nw)
+	if r.PerIPRPM > 0 && ip.IsValid() {
+		r.ipReqs[ip] = append(r.ipReqs[ip], nw)
+	}
 	return true
 }
 
-func (r *rateLimiter) AcceptDialDataRequest(p peer.ID) bool {
+// Busy reports whether the global rate limit is reached.
+func (r *rateLimiter) Busy() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return false
+	}
+	nw := r.now()
+	if !r.maybeCleanup(nw) && len(r.reqs) >= r.RPM {
+		r.cleanup(nw)
+	}
+	return len(r.reqs) >= r.RPM
+}
+
+// AcceptDialDataRequest reports whether the server may request numBytes of dial data from peer p.
+func (r *rateLimiter) AcceptDialDataRequest(p peer.ID, numBytes int) bool {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	if r.closed {
@@ -435,14 +1331,46 @@ func (r *rateLimiter) AcceptDialDataRequest(p peer.ID) bool {
 	}
 	if r.peerReqs == nil {
 		r.peerReqs = make(map[peer.ID][]time.Time)
-		r.ongoingReqs = make(map[peer.ID]struct{})
+		r.ipReqs = make(map[netip.Addr][]time.Time)
+		r.ongoingReqs = make(map[peer.ID]int)
+		r.backoffs = make(map[peer.ID]backoff)
 	}
 	nw := r.now()
-	r.cleanup(nw)
+	if !r.maybeCleanup(nw) && r.dialDataLimited(numBytes) {
+		r.cleanup(nw)
+	}
+	if r.dialDataLimited(numBytes) {
+		return false
+	}
+	r.dialDataReqs = append(r.dialDataReqs, dialDataEntry{Time: nw, Bytes: numBytes})
+	r.dialDataBytes += numBytes
+	return true
+}
+
+// limited reports whether a request from p and ip exceeds the request limits.
+func (r *rateLimiter) limited(p peer.ID, ip netip.Addr) bool {
+	if len(r.reqs) >= r.RPM || len(r.peerReqs[p]) >= r.PerPeerRPM {
+		return true
+	}
+	return r.PerIPRPM > 0 && ip.IsValid() && len(r.ipReqs[ip]) >= r.PerIPRPM
+}
+
+// dialDataLimited reports whether requesting numBytes of dial data exceeds the dial data limits.
+func (r *rateLimiter) dialDataLimited(numBytes int) bool {
 	if len(r.dialDataReqs) >= r.DialDataRPM {
+		return true
+	}
+	return r.DialDataBytesPerWindow > 0 && r.dialDataBytes+numBytes > r.DialDataBytesPerWindow
+}
+
+// maybeCleanup removes stale requests if the cleanup interval has elapsed, and reports whether it
+// did. Between cleanups the counts only overestimate the requests in the window, so callers must
+// clean up before rejecting a request.
+func (r *rateLimiter) maybeCleanup(now time.Time) bool {
+	if now.Before(r.nextCleanup) {
 		return false
 	}
-	r.dialDataReqs = append(r.dialDataReqs, nw)
+	r.cleanup(now)
 	return true
 }
 
@@ -451,12 +1379,14 @@ func (r *rateLimiter) AcceptDialDataRequest(p peer.ID) bool {
 // This is fast enough in rate limited cases and the state is small enough to
 // clean up quickly when blocking requests.
 func (r *rateLimiter) cleanup(now time.Time) {
+	r.nextCleanup = now.Add(rateLimiterCleanupInterval + time.Duration(rand.Int63n(int64(rateLimiterCleanupInterval/2))))
+	window := r.window()
 	idx := len(r.reqs)
 	for i, e := range r.reqs {
-		if now.Sub(e.Time) >= time.Minute {
+		if now.Sub(e.Time) >= window {
 			pi := len(r.peerReqs[e.PeerID])
 			for j, t := range r.peerReqs[e.PeerID] {
-				if now.Sub(t) < time.Minute {
+				if now.Sub(t) < window {
 					pi = j
 					break
 				}
@@ -465,6 +1395,19 @@ func (r *rateLimiter) cleanup(now time.Time) {
 			if len(r.peerReqs[e.PeerID]) == 0 {
 				delete(r.peerReqs, e.PeerID)
 			}
+			if e.IP.IsValid() {
+				ii := len(r.ipReqs[e.IP])
+				for j, t := range r.ipReqs[e.IP] {
+					if now.Sub(t) < window {
+						ii = j
+						break
+					}
+				}
+				r.ipReqs[e.IP] = r.ipReqs[e.IP][ii:]
+				if len(r.ipReqs[e.IP]) == 0 {
+					delete(r.ipReqs, e.IP)
+				}
+			}
 		} else {
 			idx = i
 			break
@@ -473,19 +1416,116 @@ func (r *rateLimiter) cleanup(now time.Time) {
 	r.reqs = r.reqs[idx:]
 
 	idx = len(r.dialDataReqs)
-	for i, t := range r.dialDataReqs {
-		if now.Sub(t) < time.Minute {
+	for i, e := range r.dialDataReqs {
+		if now.Sub(e.Time) < window {
 			idx = i
 			break
 		}
+		r.dialDataBytes -= e.Bytes
 	}
 	r.dialDataReqs = r.dialDataReqs[idx:]
+
+	// Forget the rejections of peers that haven't been rejected for a full window after their
+	// cooldown expired.
+	for p, b := range r.backoffs {
+		if now.Sub(b.Until) >= window {
+			delete(r.backoffs, p)
+		}
+	}
+}
+
+// penalize records a rejected request from p and starts its cooldown period. Must be called
+// with the lock held.
+func (r *rateLimiter) penalize(p peer.ID, now time.Time) {
+	if r.BackoffBase <= 0 {
+		return
+	}
+	b := r.backoffs[p]
+	// The rejections are forgotten a full window after the cooldown expired, even if the peer
+	// wasn't cleaned up yet.
+	if now.Sub(b.Until) >= r.window() {
+		b = backoff{}
+	}
+	b.Rejections++
+	b.Until = now.Add(r.backoffDuration(b.Rejections))
+	r.backoffs[p] = b
+}
+
+// backoffDuration returns the cooldown after n consecutive rejections.
+func (r *rateLimiter) backoffDuration(n int) time.Duration {
+	maxBackoff := r.BackoffMax
+	if maxBackoff < r.BackoffBase {
+		maxBackoff = r.BackoffBase
+	}
+	d := r.BackoffBase
+	for i := 1; i < n && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
+
+func (r *rateLimiter) window() time.Duration {
+	if r.Window <= 0 {
+		return time.Minute
+	}
+	return r.Window
+}
+
+func (r *rateLimiter) maxConcurrentPerPeer() int {
+	if r.MaxConcurrentPerPeer <= 0 {
+		return 1
+	}
+	return r.MaxConcurrentPerPeer
 }
 
 func (r *rateLimiter) CompleteRequest(p peer.ID) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	delete(r.ongoingReqs, p)
+	if r.ongoingReqs[p] <= 1 {
+		delete(r.ongoingReqs, p)
+		return
+	}
+	r.ongoingReqs[p]--
+}
+
+// RateLimiterStats is a snapshot of the state of the AutoNAT v2 server's rate limiter.
+type RateLimiterStats struct {
+	// Requests is the number of requests accepted in the current window
+	Requests int
+	// PeerRequests is the number of requests accepted from each peer in the current window
+	PeerRequests map[peer.ID]int
+	// DialDataRequests is the number of requests for dial data in the current window
+	DialDataRequests int
+	// DialDataBytes is the number of dial data bytes requested in the current window
+	DialDataBytes int
+	// OngoingRequests is the number of in progress requests of each peer
+	OngoingRequests map[peer.ID]int
+}
+
+// Stats returns a snapshot of the rate limiter's state.
+func (r *rateLimiter) Stats() RateLimiterStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.closed {
+		r.cleanup(r.now())
+	}
+	st := RateLimiterStats{
+		Requests:         len(r.reqs),
+		PeerRequests:     make(map[peer.ID]int, len(r.peerReqs)),
+		DialDataRequests: len(r.dialDataReqs),
+		DialDataBytes:    r.dialDataBytes,
+		OngoingRequests:  make(map[peer.ID]int, len(r.ongoingReqs)),
+	}
+	for p, reqs := range r.peerReqs {
+		st.PeerRequests[p] = len(reqs)
+	}
+	for p, n := range r.ongoingReqs {
+		st.OngoingRequests[p] = n
+	}
+	return st
 }
 
 func (r *rateLimiter) Close() {
@@ -493,13 +1533,33 @@ func (r *rateLimiter) Close() {
 	defer r.mu.Unlock()
 	r.closed = true
 	r.peerReqs = nil
+	r.ipReqs = nil
 	r.ongoingReqs = nil
 	r.dialDataReqs = nil
+	r.dialDataBytes = 0
+	r.backoffs = nil
 }
 
-// amplificationAttackPrevention is a dialDataRequestPolicy which requests data when the peer's observed
-// IP address is different from the dial back IP address
-func amplificationAttackPrevention(s network.Stream, dialAddr ma.Multiaddr) bool {
+// remoteIP returns the IP address of the remote end of the stream's connection. It returns the zero
+// value if the remote multiaddr is not an IP multiaddr.
+func remoteIP(s network.Stream) netip.Addr {
+	connIP, err := manet.ToIP(s.Conn().RemoteMultiaddr())
+	if err != nil {
+		return netip.Addr{}
+	}
+	ip, _ := netip.AddrFromSlice(connIP)
+	return ip.Unmap()
+}
+
+// randomDialDataSize is a dialDataSizeFunc which requests a random amount of data in
+// [minHandshakeSizeBytes, maxHandshakeSizeBytes)
+func randomDialDataSize(_ ma.Multiaddr) int {
+	return minHandshakeSizeBytes + rand.Intn(maxHandshakeSizeBytes-minHandshakeSizeBytes)
+}
+
+// AmplificationAttackPrevention is a DataRequestPolicyFunc which requests data when the peer's
+// observed IP address is different from the dial back IP address. It is the server's default policy.
+func AmplificationAttackPrevention(s network.Stream, dialAddr ma.Multiaddr) bool {
 	connIP, err := manet.ToIP(s.Conn().RemoteMultiaddr())
 	if err != nil {
 		return true
@@ -507,3 +1567,29 @@ func amplificationAttackPrevention(s network.Stream, dialAddr ma.Multiaddr) bool
 	dialIP, _ := manet.ToIP(s.Conn().LocalMultiaddr()) // must be an IP multiaddr
 	return !connIP.Equal(dialIP)
 }
+
+// AnyPolicy returns a DataRequestPolicyFunc which requests dial data if any of policies does.
+// It never requests dial data if policies is empty.
+func AnyPolicy(policies ...DataRequestPolicyFunc) DataRequestPolicyFunc {
+	return func(s network.Stream, dialAddr ma.Multiaddr) bool {
+		for _, p := range policies {
+			if p(s, dialAddr) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// AllPolicies returns a DataRequestPolicyFunc which requests dial data only if all of policies do.
+// It always requests dial data if policies is empty.
+func AllPolicies(policies ...DataRequestPolicyFunc) DataRequestPolicyFunc {
+	return func(s network.Stream, dialAddr ma.Multiaddr) bool {
+		for _, p := range policies {
+			if !p(s, dialAddr) {
+				return false
+			}
+		}
+		return true
+	}
+}
@@ -0,0 +1,98 @@
+// Package testing provides helpers to run an AutoNAT v2 client and server over an in-memory
+// network, without using the OS network stack.
+package testing
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/test"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/libp2p/go-libp2p/p2p/protocol/autonatv2"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+// MockNetwork is an AutoNAT client and server connected over a mocknet.
+type MockNetwork struct {
+	Client *autonatv2.AutoNAT
+	Server *autonatv2.AutoNAT
+	// ClientHost and ServerHost are the hosts the client and the server run on. Each AutoNAT
+	// also has a separate dialer host.
+	ClientHost host.Host
+	ServerHost host.Host
+	// Clock is the server's clock. Advancing it moves the server's rate limit windows and
+	// expires its timeouts.
+	Clock *test.MockClock
+}
+
+// mockClock adapts test.MockClock to autonatv2.Clock.
+type mockClock struct {
+	*test.MockClock
+}
+
+func (c mockClock) InstantTimer(when time.Time) autonatv2.InstantTimer {
+	return c.MockClock.InstantTimer(when)
+}
+
+// NewMockNetwork creates an AutoNAT client and server on a mocknet, and connects the client to the
+// server. Mocknet addresses aren't public, so both allow private addresses. The server doesn't
+// request dial data and dials back without delay, unless changed by serverOpts.
+// The network is closed when t finishes.
+func NewMockNetwork(t testing.TB, serverOpts ...autonatv2.AutoNATOption) *MockNetwork {
+	t.Helper()
+	mn := mocknet.New()
+	t.Cleanup(func() { mn.Close() })
+	hosts := make([]host.Host, 4)
+	for i := range hosts {
+		h, err := mn.GenPeer()
+		require.NoError(t, err)
+		hosts[i] = h
+	}
+	require.NoError(t, mn.LinkAll())
+
+	cl := test.NewMockClock()
+	opts := append([]autonatv2.AutoNATOption{
+		autonatv2.WithAllowPrivateAddrs(),
+		autonatv2.WithClock(mockClock{cl}),
+		autonatv2.WithServerDialWait(0),
+		autonatv2.WithServerDataRequestPolicy(func(network.Stream, ma.Multiaddr) bool { return false }),
+	}, serverOpts...)
+	srv, err := autonatv2.New(hosts[0], hosts[1], opts...)
+	require.NoError(t, err)
+	require.NoError(t, srv.Start())
+	t.Cleanup(srv.Close)
+
+	cli, err := autonatv2.New(hosts[2], hosts[3], autonatv2.WithAllowPrivateAddrs())
+	require.NoError(t, err)
+	require.NoError(t, cli.Start())
+	t.Cleanup(cli.Close)
+
+	hosts[2].Peerstore().AddAddrs(hosts[0].ID(), hosts[0].Addrs(), peerstore.PermanentAddrTTL)
+	require.NoError(t, hosts[2].Connect(context.Background(), peer.AddrInfo{ID: hosts[0].ID()}))
+	return &MockNetwork{Client: cli, Server: srv, ClientHost: hosts[2], ServerHost: hosts[0], Clock: cl}
+}
+
+// GetReachability is like Client.GetReachability, but waits until the client has learnt that the
+// server supports AutoNAT v2, which happens once identify completes.
+func (n *MockNetwork) GetReachability(ctx context.Context, reqs []autonatv2.Request) (autonatv2.Result, error) {
+	t := time.NewTicker(10 * time.Millisecond)
+	defer t.Stop()
+	for {
+		res, err := n.Client.GetReachability(ctx, reqs)
+		if err != autonatv2.ErrNoValidPeers {
+			return res, err
+		}
+		select {
+		case <-ctx.Done():
+			return autonatv2.Result{}, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
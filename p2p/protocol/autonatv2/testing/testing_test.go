@@ -0,0 +1,85 @@
+package testing
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/p2p/protocol/autonatv2"
+	"github.com/libp2p/go-libp2p/p2p/protocol/autonatv2/pb"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMockNetwork(t *testing.T) {
+	t.Run("dial back", func(t *testing.T) {
+		n := NewMockNetwork(t)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		addr := n.ClientHost.Addrs()[0]
+		res, err := n.GetReachability(ctx, []autonatv2.Request{{Addr: addr}})
+		require.NoError(t, err)
+		require.Equal(t, pb.DialStatus_OK, res.Status)
+		require.Equal(t, network.ReachabilityPublic, res.Reachability)
+		require.True(t, res.Addr.Equal(addr))
+		require.Equal(t, n.ServerHost.ID(), res.Server)
+	})
+
+	t.Run("dial data", func(t *testing.T) {
+		n := NewMockNetwork(t, autonatv2.WithServerDataRequestPolicy(func(network.Stream, ma.Multiaddr) bool { return true }))
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		res, err := n.GetReachability(ctx, []autonatv2.Request{{Addr: n.ClientHost.Addrs()[0], SendDialData: true}})
+		require.NoError(t, err)
+		require.Equal(t, pb.DialStatus_OK, res.Status)
+		require.Equal(t, network.ReachabilityPublic, res.Reachability)
+	})
+
+	t.Run("clock", func(t *testing.T) {
+		n := NewMockNetwork(t, autonatv2.WithServerRateLimit(10, 1, 10))
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		reqs := []autonatv2.Request{{Addr: n.ClientHost.Addrs()[0]}}
+		_, err := n.GetReachability(ctx, reqs)
+		require.NoError(t, err)
+		_, err = n.GetReachability(ctx, reqs)
+		require.Error(t, err)
+
+		// The per peer limit allows another request once the window has passed on the server's
+		// clock.
+		n.Clock.AdvanceBy(time.Minute + time.Second)
+		res, err := n.GetReachability(ctx, reqs)
+		require.NoError(t, err)
+		require.Equal(t, pb.DialStatus_OK, res.Status)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		n := NewMockNetwork(t, autonatv2.WithServerTimeouts(time.Minute, time.Minute, time.Minute, time.Minute))
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		// a dial request stream the client never sends a request on
+		s, err := n.ClientHost.NewStream(ctx, n.ServerHost.ID(), autonatv2.DialProtocol)
+		require.NoError(t, err)
+		defer s.Close()
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := s.Read(make([]byte, 1))
+			errCh <- err
+		}()
+
+		// The server resets the stream once the stream timeout expires on its clock. The clock is
+		// advanced repeatedly, as the server only sets the timeout once it handles the stream.
+		require.Eventually(t, func() bool {
+			n.Clock.AdvanceBy(time.Minute)
+			select {
+			case err := <-errCh:
+				require.Error(t, err)
+				return true
+			default:
+				return false
+			}
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+}
@@ -8,6 +8,7 @@ import (
 	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	ic "github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/network"
@@ -15,6 +16,7 @@ import (
 	tpt "github.com/libp2p/go-libp2p/core/transport"
 
 	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
 	"github.com/pion/datachannel"
 	"github.com/pion/webrtc/v3"
 )
@@ -23,6 +25,10 @@ var _ tpt.CapableConn = &connection{}
 
 const maxAcceptQueueLen = 256
 
+// ErrTooManyStreams is returned by OpenStream when the connection has the maximum number of
+// concurrent streams set with WithMaxStreams. Incoming streams past the limit are reset.
+var ErrTooManyStreams = errors.New("too many streams")
+
 type errConnectionTimeout struct{}
 
 var _ net.Error = &errConnectionTimeout{}
@@ -57,6 +63,8 @@ type connection struct {
 
 	acceptQueue chan dataChannel
 
+	handshakeTimings HandshakeTimings
+
 	ctx    context.Context
 	cancel context.CancelFunc
 }
@@ -143,6 +151,11 @@ func (c *connection) OpenStream(ctx context.Context) (network.MuxedStream, error
 	if c.IsClosed() {
 		return nil, c.closeErr
 	}
+	// Check the limit before creating the data channel. addStream checks it again, as streams
+	// may be added concurrently.
+	if c.atStreamLimit() {
+		return nil, ErrTooManyStreams
+	}
 
 	id := c.nextStreamID.Add(2) - 2
 	if id > math.MaxUint16 {
@@ -158,7 +171,7 @@ func (c *connection) OpenStream(ctx context.Context) (network.MuxedStream, error
 		dc.Close()
 		return nil, fmt.Errorf("detach channel failed for stream(%d): %w", streamID, err)
 	}
-	str := newStream(dc, rwc, func() { c.removeStream(streamID) })
+	str := c.transport.newStream(dc, rwc, func() { c.removeStream(streamID) })
 	if err := c.addStream(str); err != nil {
 		str.Reset()
 		return nil, fmt.Errorf("failed to add stream(%d) to connection: %w", streamID, err)
@@ -167,16 +180,22 @@ func (c *connection) OpenStream(ctx context.Context) (network.MuxedStream, error
 }
 
 func (c *connection) AcceptStream() (network.MuxedStream, error) {
-	select {
-	case <-c.ctx.Done():
-		return nil, c.closeErr
-	case dc := <-c.acceptQueue:
-		str := newStream(dc.channel, dc.stream, func() { c.removeStream(*dc.channel.ID()) })
-		if err := c.addStream(str); err != nil {
-			str.Reset()
-			return nil, err
+	for {
+		select {
+		case <-c.ctx.Done():
+			return nil, c.closeErr
+		case dc := <-c.acceptQueue:
+			str := c.transport.newStream(dc.channel, dc.stream, func() { c.removeStream(*dc.channel.ID()) })
+			if err := c.addStream(str); err != nil {
+				str.Reset()
+				if errors.Is(err, ErrTooManyStreams) {
+					log.Debugf("rejecting stream(%d) from %s: too many streams", str.id, c.remotePeer)
+					continue
+				}
+				return nil, err
+			}
+			return str, nil
 		}
-		return str, nil
 	}
 }
 
@@ -197,10 +216,23 @@ func (c *connection) addStream(str *stream) error {
 	if _, ok := c.streams[str.id]; ok {
 		return errors.New("stream ID already exists")
 	}
+	if c.transport.maxStreams > 0 && len(c.streams) >= c.transport.maxStreams {
+		return ErrTooManyStreams
+	}
 	c.streams[str.id] = str
 	return nil
 }
 
+// atStreamLimit reports whether the connection has the maximum number of concurrent streams.
+func (c *connection) atStreamLimit() bool {
+	if c.transport.maxStreams <= 0 {
+		return false
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	return len(c.streams) >= c.transport.maxStreams
+}
+
 func (c *connection) removeStream(id uint16) {
 	c.m.Lock()
 	defer c.m.Unlock()
@@ -253,3 +285,215 @@ func (c *connection) detachChannel(ctx context.Context, dc *webrtc.DataChannel)
 		return rwc, err
 	}
 }
+
+// ConnStats are statistics of a WebRTC connection.
+//
+// Pion doesn't report retransmissions on the SCTP association, so they aren't included.
+type ConnStats struct {
+	// BytesSent and BytesReceived are the bytes sent and received on the ICE transport.
+	// This includes the DTLS and SCTP overhead.
+	BytesSent     uint64
+	BytesReceived uint64
+	// DataBytesSent and DataBytesReceived are the bytes sent and received on the SCTP association.
+	DataBytesSent     uint64
+	DataBytesReceived uint64
+	// RTT is the smoothed round trip time of the SCTP association.
+	RTT time.Duration
+
+	// LocalCandidate and RemoteCandidate are the addresses of the selected ICE candidate pair.
+	LocalCandidate  ma.Multiaddr
+	RemoteCandidate ma.Multiaddr
+	// CandidatePairRTT is the latest round trip time measured on the nominated candidate pair
+	// by ICE connectivity checks.
+	CandidatePairRTT time.Duration
+}
+
+// StatsConn is a connection that reports its statistics. Connections established
+// by the WebRTC transport implement it.
+type StatsConn interface {
+	// Stats returns the statistics of the connection. It fails once the connection
+	// is closed.
+	Stats() (ConnStats, error)
+}
+
+var _ StatsConn = &connection{}
+
+// Stats returns the statistics of the connection, as reported by the underlying peer connection.
+func (c *connection) Stats() (ConnStats, error) {
+	if c.ctx.Err() != nil {
+		return ConnStats{}, c.closeErr
+	}
+
+	var stats ConnStats
+	for _, s := range c.pc.GetStats() {
+		switch s := s.(type) {
+		case webrtc.TransportStats:
+			stats.BytesSent = s.BytesSent
+			stats.BytesReceived = s.BytesReceived
+		case webrtc.SCTPTransportStats:
+			stats.DataBytesSent = s.BytesSent
+			stats.DataBytesReceived = s.BytesReceived
+			stats.RTT = secondsToDuration(s.SmoothedRoundTripTime)
+		case webrtc.ICECandidatePairStats:
+			if s.Nominated {
+				stats.CandidatePairRTT = secondsToDuration(s.CurrentRoundTripTime)
+			}
+		}
+	}
+
+	cp, err := c.pc.SCTP().Transport().ICETransport().GetSelectedCandidatePair()
+	if err != nil {
+		return ConnStats{}, fmt.Errorf("get selected candidate pair: %w", err)
+	}
+	if cp != nil {
+		stats.LocalCandidate, err = manet.FromNetAddr(&net.UDPAddr{IP: net.ParseIP(cp.Local.Address), Port: int(cp.Local.Port)})
+		if err != nil {
+			return ConnStats{}, err
+		}
+		stats.RemoteCandidate, err = manet.FromNetAddr(&net.UDPAddr{IP: net.ParseIP(cp.Remote.Address), Port: int(cp.Remote.Port)})
+		if err != nil {
+			return ConnStats{}, err
+		}
+	}
+	return stats, nil
+}
+
+// CandidateTypes are the types of the candidates of a connection's selected ICE candidate pair.
+type CandidateTypes struct {
+	Local  webrtc.ICECandidateType
+	Remote webrtc.ICECandidateType
+}
+
+// IsRelayed reports whether the connection goes through a TURN relay.
+func (ct CandidateTypes) IsRelayed() bool {
+	return ct.Local == webrtc.ICECandidateTypeRelay || ct.Remote == webrtc.ICECandidateTypeRelay
+}
+
+// CandidateTypesConn is a connection that reports the types of its selected ICE candidate pair.
+// Connections established by the WebRTC transport implement it.
+type CandidateTypesConn interface {
+	// SelectedCandidateTypes returns the types of the selected ICE candidate pair. It fails once
+	// the connection is closed. Listeners learn the dialer's candidate from its connectivity
+	// checks, so on inbound connections the remote candidate is always peer reflexive, even if
+	// the dialer uses a relay.
+	SelectedCandidateTypes() (CandidateTypes, error)
+}
+
+var _ CandidateTypesConn = &connection{}
+
+// SelectedCandidateTypes returns the types of the local and remote candidates of the selected
+// ICE candidate pair.
+func (c *connection) SelectedCandidateTypes() (CandidateTypes, error) {
+	if c.ctx.Err() != nil {
+		return CandidateTypes{}, c.closeErr
+	}
+	cp, err := c.pc.SCTP().Transport().ICETransport().GetSelectedCandidatePair()
+	if err != nil {
+		return CandidateTypes{}, fmt.Errorf("get selected candidate pair: %w", err)
+	}
+	if cp == nil {
+		return CandidateTypes{}, errors.New("no selected candidate pair")
+	}
+	return CandidateTypes{Local: cp.Local.Typ, Remote: cp.Remote.Typ}, nil
+}
+
+func secondsToDuration(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// HandshakeTimings are the durations of the phases of establishing a WebRTC connection.
+// Each phase starts when the previous one completes.
+type HandshakeTimings struct {
+	// ICE is the time from creating the peer connection until ICE connectivity is established.
+	// This includes gathering candidates and the connectivity checks.
+	ICE time.Duration
+	// DTLS is the duration of the DTLS handshake.
+	DTLS time.Duration
+	// SCTP is the time until the SCTP association is established and the handshake data
+	// channel is opened.
+	SCTP time.Duration
+	// Noise is the duration of the Noise handshake on the handshake data channel.
+	Noise time.Duration
+}
+
+// HandshakeTimingsConn is a connection that reports how long establishing it took.
+// Connections established by the WebRTC transport implement it.
+type HandshakeTimingsConn interface {
+	HandshakeTimings() HandshakeTimings
+}
+
+var _ HandshakeTimingsConn = &connection{}
+
+// HandshakeTracer is notified of the handshake timings of the connections
+// established by the transport.
+type HandshakeTracer interface {
+	// HandshakeCompleted is called once a connection in direction dir was established.
+	HandshakeCompleted(dir network.Direction, timings HandshakeTimings)
+}
+
+// HandshakeTimings returns the durations of the phases of establishing the connection.
+func (c *connection) HandshakeTimings() HandshakeTimings {
+	return c.handshakeTimings
+}
+
+// handshakeTimer records the completion of the phases of establishing a connection.
+type handshakeTimer struct {
+	mx sync.Mutex
+
+	start         time.Time
+	iceConnected  time.Time
+	dtlsConnected time.Time
+	sctpConnected time.Time
+	noise         time.Time
+}
+
+// newHandshakeTimer starts recording the phases of establishing a connection on pc. It
+// must be called before connecting with the peer.
+func newHandshakeTimer(pc *webrtc.PeerConnection) *handshakeTimer {
+	t := &handshakeTimer{start: time.Now()}
+	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		if state == webrtc.ICEConnectionStateConnected {
+			t.record(&t.iceConnected)
+		}
+	})
+	pc.SCTP().Transport().OnStateChange(func(state webrtc.DTLSTransportState) {
+		if state == webrtc.DTLSTransportStateConnected {
+			t.record(&t.dtlsConnected)
+		}
+	})
+	return t
+}
+
+func (t *handshakeTimer) record(ts *time.Time) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	if ts.IsZero() {
+		*ts = time.Now()
+	}
+}
+
+// SCTPConnected records that the handshake data channel was opened.
+func (t *handshakeTimer) SCTPConnected() { t.record(&t.sctpConnected) }
+
+// NoiseDone records the completion of the Noise handshake.
+func (t *handshakeTimer) NoiseDone() { t.record(&t.noise) }
+
+// Timings returns the durations of the phases that have completed.
+func (t *handshakeTimer) Timings() HandshakeTimings {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	return HandshakeTimings{
+		ICE:   phaseDuration(t.start, t.iceConnected),
+		DTLS:  phaseDuration(t.iceConnected, t.dtlsConnected),
+		SCTP:  phaseDuration(t.dtlsConnected, t.sctpConnected),
+		Noise: phaseDuration(t.sctpConnected, t.noise),
+	}
+}
+
+// phaseDuration returns the duration of a phase, or 0 if it hasn't completed.
+func phaseDuration(start, end time.Time) time.Duration {
+	if start.IsZero() || end.IsZero() || end.Before(start) {
+		return 0
+	}
+	return end.Sub(start)
+}
@@ -3,11 +3,9 @@ package libp2pwebrtc
 import (
 	"context"
 	"crypto"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"net"
-	"strings"
 	"sync"
 	"time"
 
@@ -18,11 +16,20 @@ import (
 
 	ma "github.com/multiformats/go-multiaddr"
 	manet "github.com/multiformats/go-multiaddr/net"
-	"github.com/multiformats/go-multibase"
-	"github.com/multiformats/go-multihash"
+	"github.com/pion/ice/v2"
 	"github.com/pion/webrtc/v3"
 )
 
+// filteredUDPMux is a UDPMux that only reports the addresses allowed by the
+// candidate filter as its listen addresses. The ICE agent creates its host
+// candidates from these addresses.
+type filteredUDPMux struct {
+	*udpmux.UDPMux
+	addrs []net.Addr
+}
+
+func (m *filteredUDPMux) GetListenAddresses() []net.Addr { return m.addrs }
+
 type connMultiaddrs struct {
 	local, remote ma.Multiaddr
 }
@@ -32,6 +39,32 @@ var _ network.ConnMultiaddrs = &connMultiaddrs{}
 func (c *connMultiaddrs) LocalMultiaddr() ma.Multiaddr  { return c.local }
 func (c *connMultiaddrs) RemoteMultiaddr() ma.Multiaddr { return c.remote }
 
+// The phases of an inbound handshake, as reported to the WithOnHandshakeError callback.
+const (
+	// HandshakePhaseSetup covers the checks before the handshake starts, such as the
+	// connection gater and the resource manager, and creating the peer connection.
+	HandshakePhaseSetup = "setup"
+	// HandshakePhaseDTLS covers ICE and the DTLS handshake, up to the peer connection being
+	// connected.
+	HandshakePhaseDTLS = "dtls"
+	// HandshakePhaseSCTP covers opening the handshake data channel over SCTP.
+	HandshakePhaseSCTP = "sctp"
+	// HandshakePhaseNoise covers the Noise handshake on the handshake data channel.
+	HandshakePhaseNoise = "noise"
+	// HandshakePhasePeer covers the checks once the remote peer is known, such as the
+	// connection gater's InterceptSecured.
+	HandshakePhasePeer = "peer"
+)
+
+// handshakeError is an error of an inbound handshake, annotated with the phase it occurred in.
+type handshakeError struct {
+	phase string
+	err   error
+}
+
+func (e *handshakeError) Error() string { return fmt.Sprintf("%s: %s", e.phase, e.err) }
+func (e *handshakeError) Unwrap() error { return e.err }
+
 const (
 	candidateSetupTimeout         = 20 * time.Second
 	DefaultMaxInFlightConnections = 10
@@ -41,56 +74,83 @@ type listener struct {
 	transport *WebRTCTransport
 
 	mux *udpmux.UDPMux
-
-	config                    webrtc.Configuration
-	localFingerprint          webrtc.DTLSFingerprint
-	localFingerprintMultibase string
-
-	localAddr      net.Addr
+	// keepSocket is set if the socket was supplied with WithPacketConn, in which case it isn't
+	// closed with the listener
+	keepSocket bool
+	// iceMux is the mux used by the ICE agents. It is mux, unless the candidate
+	// addresses are restricted by the candidate filter.
+	iceMux ice.UDPMux
+
+	localAddr net.Addr
+	// localMultiaddr is the listen address without the certhash, since the
+	// certhash changes when the transport rotates its certificate.
 	localMultiaddr ma.Multiaddr
+	// announceMultiaddr, if set, is advertised instead of localMultiaddr.
+	// Like localMultiaddr, it doesn't contain the certhash.
+	announceMultiaddr ma.Multiaddr
 
 	// buffered incoming connections
 	acceptQueue chan tpt.CapableConn
 
+	// handshakeSemaphore limits the concurrent handshakes. It is nil if there is no limit.
+	handshakeSemaphore chan struct{}
+
 	// used to control the lifecycle of the listener
 	ctx    context.Context
 	cancel context.CancelFunc
-	wg     sync.WaitGroup
+	// acceptCtx is canceled once the listener stops handling new connection attempts. In-flight
+	// handshakes continue until ctx is canceled.
+	acceptCtx     context.Context
+	stopAccepting context.CancelFunc
+	// wg tracks the accept loop and the in-flight handshakes
+	wg        sync.WaitGroup
+	closeOnce sync.Once
 }
 
-var _ tpt.Listener = &listener{}
+// GracefulListener is a listener that can complete the in-flight handshakes before closing.
+// Listeners created by the WebRTC transport implement it.
+type GracefulListener interface {
+	tpt.Listener
+	// CloseWithGrace stops handling new connection attempts and waits up to d for the in-flight
+	// handshakes to complete, before closing the listener like Close. Connections established
+	// during the grace period are returned by Accept; those that weren't accepted when the grace
+	// period ends are closed. Close is CloseWithGrace with a zero grace period.
+	CloseWithGrace(d time.Duration) error
+}
 
-func newListener(transport *WebRTCTransport, laddr ma.Multiaddr, socket net.PacketConn, config webrtc.Configuration) (*listener, error) {
-	localFingerprints, err := config.Certificates[0].GetFingerprints()
-	if err != nil {
-		return nil, err
-	}
+var _ GracefulListener = &listener{}
 
-	localMh, err := hex.DecodeString(strings.ReplaceAll(localFingerprints[0].Value, ":", ""))
-	if err != nil {
-		return nil, err
+func newListener(transport *WebRTCTransport, laddr, announceAddr ma.Multiaddr, socket net.PacketConn) (*listener, error) {
+	l := &listener{
+		transport:         transport,
+		localMultiaddr:    laddr,
+		announceMultiaddr: announceAddr,
+		localAddr:         socket.LocalAddr(),
+		acceptQueue:       make(chan tpt.CapableConn),
 	}
-	localMhBuf, err := multihash.Encode(localMh, multihash.SHA2_256)
-	if err != nil {
-		return nil, err
+	if transport.maxInFlightHandshakes > 0 {
+		l.handshakeSemaphore = make(chan struct{}, transport.maxInFlightHandshakes)
 	}
-	localFpMultibase, err := multibase.Encode(multibase.Base64url, localMhBuf)
+
+	var muxOpts []udpmux.Option
+	if transport.pinRemoteAddr {
+		muxOpts = append(muxOpts, udpmux.WithPinRemoteAddr())
+	}
+	mux, err := udpmux.NewUDPMuxWithOptions(socket, muxOpts...)
 	if err != nil {
 		return nil, err
 	}
-
-	l := &listener{
-		transport:                 transport,
-		config:                    config,
-		localFingerprint:          localFingerprints[0],
-		localFingerprintMultibase: localFpMultibase,
-		localMultiaddr:            laddr,
-		localAddr:                 socket.LocalAddr(),
-		acceptQueue:               make(chan tpt.CapableConn),
+	l.mux = mux
+	l.iceMux = l.mux
+	if transport.candidateFilter != nil {
+		addrs, err := transport.candidateAddrs(socket.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			return nil, err
+		}
+		l.iceMux = &filteredUDPMux{UDPMux: l.mux, addrs: addrs}
 	}
-
 	l.ctx, l.cancel = context.WithCancel(context.Background())
-	l.mux = udpmux.NewUDPMux(socket)
+	l.acceptCtx, l.stopAccepting = context.WithCancel(l.ctx)
 	l.mux.Start()
 
 	l.wg.Add(1)
@@ -99,7 +159,7 @@ func newListener(transport *WebRTCTransport, laddr ma.Multiaddr, socket net.Pack
 		l.listen()
 	}()
 
-	return l, err
+	return l, nil
 }
 
 func (l *listener) listen() {
@@ -111,28 +171,31 @@ func (l *listener) listen() {
 	for {
 		select {
 		case inFlightSemaphore <- struct{}{}:
-		case <-l.ctx.Done():
+		case <-l.acceptCtx.Done():
 			return
 		}
 
-		candidate, err := l.mux.Accept(l.ctx)
+		candidate, err := l.mux.Accept(l.acceptCtx)
 		if err != nil {
-			if l.ctx.Err() == nil {
+			if l.acceptCtx.Err() == nil {
 				log.Debugf("accepting candidate failed: %s", err)
 			}
 			return
 		}
 
+		l.wg.Add(1)
 		go func() {
+			defer l.wg.Done()
 			defer func() { <-inFlightSemaphore }()
 
 			ctx, cancel := context.WithTimeout(l.ctx, candidateSetupTimeout)
 			defer cancel()
 
-			conn, err := l.handleCandidate(ctx, candidate)
+			conn, err := l.handshake(ctx, candidate)
 			if err != nil {
 				l.mux.RemoveConnByUfrag(candidate.Ufrag)
 				log.Debugf("could not accept connection: %s: %v", candidate.Ufrag, err)
+				l.reportHandshakeError(candidate.Addr, err)
 				return
 			}
 
@@ -147,14 +210,40 @@ func (l *listener) listen() {
 	}
 }
 
+// reportHandshakeError calls the transport's OnHandshakeError callback, unless the handshake
+// failed because the listener was closed.
+func (l *listener) reportHandshakeError(remote net.Addr, err error) {
+	if l.transport.onHandshakeError == nil || l.ctx.Err() != nil {
+		return
+	}
+	phase := HandshakePhaseSetup
+	var herr *handshakeError
+	if errors.As(err, &herr) {
+		phase, err = herr.phase, herr.err
+	}
+	l.transport.onHandshakeError(remote, phase, err)
+}
+
+// handshake runs handleCandidate once a handshake slot is available.
+func (l *listener) handshake(ctx context.Context, candidate udpmux.Candidate) (tpt.CapableConn, error) {
+	if l.handshakeSemaphore != nil {
+		select {
+		case l.handshakeSemaphore <- struct{}{}:
+			defer func() { <-l.handshakeSemaphore }()
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for a handshake slot: %w", ctx.Err())
+		}
+	}
+	return l.handleCandidate(ctx, candidate)
+}
+
 func (l *listener) handleCandidate(ctx context.Context, candidate udpmux.Candidate) (tpt.CapableConn, error) {
 	remoteMultiaddr, err := manet.FromNetAddr(candidate.Addr)
 	if err != nil {
 		return nil, err
 	}
 	if l.transport.gater != nil {
-		localAddr, _ := ma.SplitFunc(l.localMultiaddr, func(c ma.Component) bool { return c.Protocol().Code == ma.P_CERTHASH })
-		if !l.transport.gater.InterceptAccept(&connMultiaddrs{local: localAddr, remote: remoteMultiaddr}) {
+		if !l.transport.gater.InterceptAccept(&connMultiaddrs{local: l.localMultiaddr, remote: remoteMultiaddr}) {
 			// The connection attempt is rejected before we can send the client an error.
 			// This means that the connection attempt will time out.
 			return nil, errors.New("connection gated")
@@ -169,10 +258,6 @@ func (l *listener) handleCandidate(ctx context.Context, candidate udpmux.Candida
 		scope.Done()
 		return nil, err
 	}
-	if l.transport.gater != nil && !l.transport.gater.InterceptSecured(network.DirInbound, conn.RemotePeer(), conn) {
-		conn.Close()
-		return nil, errors.New("connection gated")
-	}
 	return conn, nil
 }
 
@@ -181,8 +266,10 @@ func (l *listener) setupConnection(
 	remoteMultiaddr ma.Multiaddr, candidate udpmux.Candidate,
 ) (tConn tpt.CapableConn, err error) {
 	var w webRTCConnection
+	phase := HandshakePhaseSetup
 	defer func() {
 		if err != nil {
+			err = &handshakeError{phase: phase, err: err}
 			if w.PeerConnection != nil {
 				_ = w.PeerConnection.Close()
 			}
@@ -196,7 +283,7 @@ func (l *listener) setupConnection(
 	settingEngine.SetAnsweringDTLSRole(webrtc.DTLSRoleServer)
 	settingEngine.SetICECredentials(candidate.Ufrag, candidate.Ufrag)
 	settingEngine.SetLite(true)
-	settingEngine.SetICEUDPMux(l.mux)
+	settingEngine.SetICEUDPMux(l.iceMux)
 	settingEngine.SetIncludeLoopbackCandidate(true)
 	settingEngine.DisableCertificateFingerprintVerification(true)
 	settingEngine.SetICETimeouts(
@@ -214,11 +301,18 @@ func (l *listener) setupConnection(
 		return nil, err
 	}
 
-	w, err = newWebRTCConnection(settingEngine, l.config)
+	w, err = newWebRTCConnection(settingEngine, l.transport.getWebRTCConfig())
 	if err != nil {
 		return nil, fmt.Errorf("instantiating peer connection failed: %w", err)
 	}
 
+	if l.transport.pinRemoteAddr {
+		w.PeerConnection.SCTP().Transport().ICETransport().OnSelectedCandidatePairChange(func(pair *webrtc.ICECandidatePair) {
+			l.pinRemoteAddr(candidate.Ufrag, pair)
+		})
+	}
+
+	phase = HandshakePhaseDTLS
 	errC := addOnConnectionStateChangeCallback(w.PeerConnection)
 	// Infer the client SDP from the incoming STUN message by setting the ice-ufrag.
 	if err := w.PeerConnection.SetRemoteDescription(webrtc.SessionDescription{
@@ -245,33 +339,42 @@ func (l *listener) setupConnection(
 	}
 
 	// Run the noise handshake.
+	phase = HandshakePhaseSCTP
 	rwc, err := detachHandshakeDataChannel(ctx, w.HandshakeDataChannel)
 	if err != nil {
 		return nil, err
 	}
-	handshakeChannel := newStream(w.HandshakeDataChannel, rwc, func() {})
+	phase = HandshakePhaseNoise
+	w.HandshakeTimer.SCTPConnected()
+	handshakeChannel := newStream(w.HandshakeDataChannel, rwc, maxMessageSize, func() {})
 	// we do not yet know A's peer ID so accept any inbound
 	remotePubKey, err := l.transport.noiseHandshake(ctx, w.PeerConnection, handshakeChannel, "", crypto.SHA256, true)
 	if err != nil {
 		return nil, err
 	}
+	w.HandshakeTimer.NoiseDone()
+	phase = HandshakePhasePeer
 	remotePeer, err := peer.IDFromPublicKey(remotePubKey)
 	if err != nil {
 		return nil, err
 	}
 	// earliest point where we know the remote's peerID
+	// Check the gater before attributing any resources to the peer. Returning an error
+	// here closes the peer connection, releasing the DTLS and SCTP resources.
+	if l.transport.gater != nil && !l.transport.gater.InterceptSecured(network.DirInbound, remotePeer, &connMultiaddrs{local: l.localMultiaddr, remote: remoteMultiaddr}) {
+		return nil, errors.New("connection gated")
+	}
 	if err := scope.SetPeer(remotePeer); err != nil {
 		return nil, err
 	}
 
-	localMultiaddrWithoutCerthash, _ := ma.SplitFunc(l.localMultiaddr, func(c ma.Component) bool { return c.Protocol().Code == ma.P_CERTHASH })
 	conn, err := newConnection(
 		network.DirInbound,
 		w.PeerConnection,
 		l.transport,
 		scope,
 		l.transport.localPeerId,
-		localMultiaddrWithoutCerthash,
+		l.localMultiaddr,
 		remotePeer,
 		remotePubKey,
 		remoteMultiaddr,
@@ -280,10 +383,31 @@ func (l *listener) setupConnection(
 	if err != nil {
 		return nil, err
 	}
+	conn.handshakeTimings = w.HandshakeTimer.Timings()
+	if l.transport.handshakeTracer != nil {
+		l.transport.handshakeTracer.HandshakeCompleted(network.DirInbound, conn.handshakeTimings)
+	}
 
 	return conn, err
 }
 
+// pinRemoteAddr pins the mux connection for ufrag to the remote address of the candidate
+// pair ICE selected.
+func (l *listener) pinRemoteAddr(ufrag string, pair *webrtc.ICECandidatePair) {
+	if pair == nil || pair.Remote == nil {
+		return
+	}
+	ip := net.ParseIP(pair.Remote.Address)
+	if ip == nil {
+		log.Debugf("could not pin connection %s: invalid remote address %s", ufrag, pair.Remote.Address)
+		return
+	}
+	addr := &net.UDPAddr{IP: ip, Port: int(pair.Remote.Port)}
+	if err := l.mux.PinRemoteAddr(ufrag, ip.To4() == nil, addr); err != nil {
+		log.Debugf("could not pin connection %s to %s: %s", ufrag, addr, err)
+	}
+}
+
 func (l *listener) Accept() (tpt.CapableConn, error) {
 	select {
 	case <-l.ctx.Done():
@@ -294,12 +418,36 @@ func (l *listener) Accept() (tpt.CapableConn, error) {
 }
 
 func (l *listener) Close() error {
-	select {
-	case <-l.ctx.Done():
-	default:
+	return l.CloseWithGrace(0)
+}
+
+func (l *listener) CloseWithGrace(d time.Duration) error {
+	l.closeOnce.Do(func() { l.close(d) })
+	return nil
+}
+
+func (l *listener) close(grace time.Duration) {
+	l.stopAccepting()
+	if grace > 0 {
+		drained := make(chan struct{})
+		go func() {
+			l.wg.Wait()
+			close(drained)
+		}()
+		t := time.NewTimer(grace)
+		select {
+		case <-drained:
+		case <-t.C:
+			log.Debugf("listener %s: aborting in-flight handshakes after grace period", l.localMultiaddr)
+		}
+		t.Stop()
 	}
 	l.cancel()
-	l.mux.Close()
+	if l.keepSocket {
+		l.mux.CloseKeepConn()
+	} else {
+		l.mux.Close()
+	}
 	l.wg.Wait()
 loop:
 	for {
@@ -310,15 +458,28 @@ loop:
 			break loop
 		}
 	}
-	return nil
+	if l.keepSocket {
+		l.transport.releasePacketConn(l)
+	}
 }
 
 func (l *listener) Addr() net.Addr {
 	return l.localAddr
 }
 
+// Multiaddr returns the listen address with the certhash of the transport's current certificate.
+// If the transport has an announce address for the listener's IP address family, that address is
+// returned instead of the local address.
 func (l *listener) Multiaddr() ma.Multiaddr {
-	return l.localMultiaddr
+	laddr := l.localMultiaddr
+	if l.announceMultiaddr != nil {
+		laddr = l.announceMultiaddr
+	}
+	addr, ok := l.transport.AddCertHashes(laddr)
+	if !ok {
+		return laddr
+	}
+	return addr
 }
 
 // addOnConnectionStateChangeCallback adds the OnConnectionStateChange to the PeerConnection.
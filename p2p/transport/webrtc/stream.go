@@ -2,6 +2,7 @@ package libp2pwebrtc
 
 import (
 	"errors"
+	"fmt"
 	"os"
 	"sync"
 	"time"
@@ -15,15 +16,10 @@ import (
 )
 
 const (
-	// maxMessageSize is the maximum message size of the Protobuf message we send / receive.
+	// maxMessageSize is the default maximum message size of the Protobuf message we send / receive.
 	maxMessageSize = 16384
-	// maxSendBuffer is the maximum data we enqueue on the underlying data channel for writes.
-	// The underlying SCTP layer has an unbounded buffer for writes. We limit the amount enqueued
-	// per stream is limited to avoid a single stream monopolizing the entire connection.
-	maxSendBuffer = 2 * maxMessageSize
-	// sendBufferLowThreshold is the threshold below which we write more data on the underlying
-	// data channel. We want a notification as soon as we can write 1 full sized message.
-	sendBufferLowThreshold = maxSendBuffer - maxMessageSize
+	// maxSCTPMessageSize is the largest message the SCTP layer accepts.
+	maxSCTPMessageSize = 65536
 	// maxTotalControlMessagesSize is the maximum total size of all control messages we will
 	// write on this stream.
 	// 4 control messages of size 10 bytes + 10 bytes buffer. This number doesn't need to be
@@ -39,12 +35,36 @@ const (
 	// which includes the data and the protobuf header. Since `maxMessageSize`
 	// is less than or equal to 2 ^ 14, the varint will not be more than
 	// 2 bytes in length.
+	// For larger configured message sizes, see messageOverhead.
 	varintOverhead = 2
 	// maxFINACKWait is the maximum amount of time a stream will wait to read
 	// FIN_ACK before closing the data channel
 	maxFINACKWait = 10 * time.Second
 )
 
+// StreamErrorCode is an application error code sent to the peer when resetting a stream.
+type StreamErrorCode uint32
+
+// StreamError is returned by Read and Write on a stream that was reset with an error code.
+// It matches network.ErrReset with errors.Is.
+type StreamError struct {
+	ErrorCode StreamErrorCode
+	// Remote is true if the peer reset the stream.
+	Remote bool
+}
+
+func (e *StreamError) Error() string {
+	side := "local"
+	if e.Remote {
+		side = "remote"
+	}
+	return fmt.Sprintf("stream reset (%s): code: %d", side, e.ErrorCode)
+}
+
+func (e *StreamError) Is(target error) bool {
+	return target == network.ErrReset
+}
+
 type receiveState uint8
 
 const (
@@ -77,11 +97,20 @@ type stream struct {
 	// wait to buffer that for as long as the remaining part is not (yet) read
 	nextMessage  *pb.Message
 	receiveState receiveState
-
-	writer            pbio.Writer // concurrent writes prevented by mx
+	// readResetErr is returned by Read if the stream was reset with an error code
+	readResetErr error
+
+	writer         pbio.Writer // concurrent writes prevented by mx
+	maxMessageSize int
+	// sendBufferHigh is the maximum number of bytes buffered on the data channel.
+	// Blocked writes resume once the buffered amount drops to sendBufferLow.
+	sendBufferHigh    int
+	sendBufferLow     int
 	writeStateChanged chan struct{}
 	sendState         sendState
 	writeDeadline     time.Time
+	// writeResetErr is returned by Write if the stream was reset locally with an error code
+	writeResetErr error
 
 	controlMessageReaderOnce sync.Once
 	// controlMessageReaderEndTime is the end time for reading FIN_ACK from the control
@@ -100,20 +129,32 @@ type stream struct {
 
 var _ network.MuxedStream = &stream{}
 
+// newStream creates a stream that writes messages of up to msgSize bytes.
 func newStream(
 	channel *webrtc.DataChannel,
 	rwc datachannel.ReadWriteCloser,
+	msgSize int,
 	onDone func(),
 ) *stream {
+	// We always accept messages of the default size, since that's what the remote
+	// uses unless configured otherwise.
+	readMsgSize := msgSize
+	if readMsgSize < maxMessageSize {
+		readMsgSize = maxMessageSize
+	}
 	s := &stream{
-		reader:            pbio.NewDelimitedReader(rwc, maxMessageSize),
+		reader:            pbio.NewDelimitedReader(rwc, readMsgSize),
 		writer:            pbio.NewDelimitedWriter(rwc),
+		maxMessageSize:    msgSize,
+		sendBufferHigh:    2 * msgSize,
+		sendBufferLow:     msgSize,
 		writeStateChanged: make(chan struct{}, 1),
 		id:                *channel.ID(),
 		dataChannel:       rwc.(*datachannel.DataChannel),
 		onDone:            onDone,
 	}
-	s.dataChannel.SetBufferedAmountLowThreshold(sendBufferLowThreshold)
+	// By default, we want a notification as soon as we can write 1 full sized message.
+	s.dataChannel.SetBufferedAmountLowThreshold(uint64(s.sendBufferLow))
 	s.dataChannel.OnBufferedAmountLow(func() {
 		s.notifyWriteStateChanged()
 
@@ -121,6 +162,14 @@ func newStream(
 	return s
 }
 
+// setSendBufferThresholds sets the amount of buffered data at which writes block and resume.
+// It must be called before the stream is used.
+func (s *stream) setSendBufferThresholds(high, low int) {
+	s.sendBufferHigh = high
+	s.sendBufferLow = low
+	s.dataChannel.SetBufferedAmountLowThreshold(uint64(low))
+}
+
 func (s *stream) Close() error {
 	s.mx.Lock()
 	isClosed := s.closeForShutdownErr != nil
@@ -146,15 +195,37 @@ func (s *stream) Close() error {
 }
 
 func (s *stream) Reset() error {
+	return s.reset(nil)
+}
+
+// StreamResetter is a stream that can be reset with an error code. Streams of
+// connections established by the WebRTC transport implement it.
+type StreamResetter interface {
+	ResetWithError(code StreamErrorCode) error
+}
+
+var _ StreamResetter = &stream{}
+
+// ResetWithError resets the stream and sends the error code to the peer. The peer's Read
+// returns a *StreamError with the error code. Peers that don't support error codes observe a
+// plain reset.
+func (s *stream) ResetWithError(code StreamErrorCode) error {
+	return s.reset(&code)
+}
+
+func (s *stream) reset(code *StreamErrorCode) error {
 	s.mx.Lock()
 	isClosed := s.closeForShutdownErr != nil
+	if code != nil && s.receiveState == receiveStateReceiving {
+		s.readResetErr = &StreamError{ErrorCode: *code}
+	}
 	s.mx.Unlock()
 	if isClosed {
 		return nil
 	}
 
 	defer s.cleanup()
-	cancelWriteErr := s.cancelWrite()
+	cancelWriteErr := s.cancelWrite(code)
 	closeReadErr := s.CloseRead()
 	s.setDataChannelReadDeadline(time.Now().Add(-1 * time.Hour))
 	return errors.Join(closeReadErr, cancelWriteErr)
@@ -177,12 +248,12 @@ func (s *stream) SetDeadline(t time.Time) error {
 
 // processIncomingFlag process the flag on an incoming message
 // It needs to be called while the mutex is locked.
-func (s *stream) processIncomingFlag(flag *pb.Message_Flag) {
-	if flag == nil {
+func (s *stream) processIncomingFlag(msg *pb.Message) {
+	if msg.Flag == nil {
 		return
 	}
 
-	switch *flag {
+	switch *msg.Flag {
 	case pb.Message_STOP_SENDING:
 		// We must process STOP_SENDING after sending a FIN(sendStateDataSent). Remote peer
 		// may not send a FIN_ACK once it has sent a STOP_SENDING
@@ -206,6 +277,9 @@ func (s *stream) processIncomingFlag(flag *pb.Message_Flag) {
 	case pb.Message_RESET:
 		if s.receiveState == receiveStateReceiving {
 			s.receiveState = receiveStateReset
+			if msg.ErrorCode != nil {
+				s.readResetErr = &StreamError{ErrorCode: StreamErrorCode(*msg.ErrorCode), Remote: true}
+			}
 		}
 		s.spawnControlMessageReader()
 	}
@@ -235,7 +309,7 @@ func (s *stream) spawnControlMessageReader() {
 			s.readerMx.Unlock()
 
 			if s.nextMessage != nil {
-				s.processIncomingFlag(s.nextMessage.Flag)
+				s.processIncomingFlag(s.nextMessage)
 				s.nextMessage = nil
 			}
 			var msg pb.Message
@@ -266,7 +340,7 @@ func (s *stream) spawnControlMessageReader() {
 					}
 					return
 				}
-				s.processIncomingFlag(msg.Flag)
+				s.processIncomingFlag(&msg)
 			}
 		}()
 	})
@@ -22,7 +22,7 @@ func (s *stream) Read(b []byte) (int, error) {
 	case receiveStateDataRead:
 		return 0, io.EOF
 	case receiveStateReset:
-		return 0, network.ErrReset
+		return 0, s.readResetError()
 	}
 
 	if len(b) == 0 {
@@ -55,7 +55,7 @@ func (s *stream) Read(b []byte) (int, error) {
 					return 0, network.ErrReset
 				}
 				if s.receiveState == receiveStateReset {
-					return 0, network.ErrReset
+					return 0, s.readResetError()
 				}
 				if s.receiveState == receiveStateDataRead {
 					return 0, io.EOF
@@ -73,7 +73,7 @@ func (s *stream) Read(b []byte) (int, error) {
 		}
 
 		// process flags on the message after reading all the data
-		s.processIncomingFlag(s.nextMessage.Flag)
+		s.processIncomingFlag(s.nextMessage)
 		s.nextMessage = nil
 		if s.closeForShutdownErr != nil {
 			return read, s.closeForShutdownErr
@@ -82,11 +82,20 @@ func (s *stream) Read(b []byte) (int, error) {
 		case receiveStateDataRead:
 			return read, io.EOF
 		case receiveStateReset:
-			return read, network.ErrReset
+			return read, s.readResetError()
 		}
 	}
 }
 
+// readResetError returns the error for reading from a reset stream.
+// It needs to be called while the mutex is locked.
+func (s *stream) readResetError() error {
+	if s.readResetErr != nil {
+		return s.readResetErr
+	}
+	return network.ErrReset
+}
+
 func (s *stream) SetReadDeadline(t time.Time) error {
 	s.mx.Lock()
 	defer s.mx.Unlock()
@@ -148,8 +148,8 @@ func TestStreamSimpleReadWriteClose(t *testing.T) {
 	client, server := getDetachedDataChannels(t)
 
 	var clientDone, serverDone atomic.Bool
-	clientStr := newStream(client.dc, client.rwc, func() { clientDone.Store(true) })
-	serverStr := newStream(server.dc, server.rwc, func() { serverDone.Store(true) })
+	clientStr := newStream(client.dc, client.rwc, maxMessageSize, func() { clientDone.Store(true) })
+	serverStr := newStream(server.dc, server.rwc, maxMessageSize, func() { serverDone.Store(true) })
 
 	// send a foobar from the client
 	n, err := clientStr.Write([]byte("foobar"))
@@ -191,11 +191,56 @@ func TestStreamSimpleReadWriteClose(t *testing.T) {
 	require.Eventually(t, func() bool { return serverDone.Load() }, 5*time.Second, 100*time.Millisecond)
 }
 
+func TestStreamResetWithError(t *testing.T) {
+	client, server := getDetachedDataChannels(t)
+
+	clientStr := newStream(client.dc, client.rwc, maxMessageSize, func() {})
+	serverStr := newStream(server.dc, server.rwc, maxMessageSize, func() {})
+
+	_, err := clientStr.Write([]byte("foobar"))
+	require.NoError(t, err)
+	require.NoError(t, clientStr.ResetWithError(42))
+
+	_, err = clientStr.Write([]byte("foobar"))
+	var streamErr *StreamError
+	require.ErrorAs(t, err, &streamErr)
+	require.Equal(t, &StreamError{ErrorCode: 42}, streamErr)
+	_, err = clientStr.Read(make([]byte, 10))
+	require.ErrorAs(t, err, &streamErr)
+	require.Equal(t, &StreamError{ErrorCode: 42}, streamErr)
+	require.ErrorIs(t, err, network.ErrReset)
+
+	serverStr.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadAll(serverStr)
+	require.ErrorAs(t, err, &streamErr)
+	require.Equal(t, &StreamError{ErrorCode: 42, Remote: true}, streamErr)
+	require.ErrorIs(t, err, network.ErrReset)
+	// subsequent reads return the same error
+	_, err = serverStr.Read(make([]byte, 10))
+	require.ErrorAs(t, err, &streamErr)
+	require.Equal(t, StreamErrorCode(42), streamErr.ErrorCode)
+}
+
+func TestStreamResetWithoutError(t *testing.T) {
+	client, server := getDetachedDataChannels(t)
+
+	clientStr := newStream(client.dc, client.rwc, maxMessageSize, func() {})
+	serverStr := newStream(server.dc, server.rwc, maxMessageSize, func() {})
+
+	_, err := clientStr.Write([]byte("foobar"))
+	require.NoError(t, err)
+	require.NoError(t, clientStr.Reset())
+
+	serverStr.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadAll(serverStr)
+	require.Equal(t, network.ErrReset, err)
+}
+
 func TestStreamPartialReads(t *testing.T) {
 	client, server := getDetachedDataChannels(t)
 
-	clientStr := newStream(client.dc, client.rwc, func() {})
-	serverStr := newStream(server.dc, server.rwc, func() {})
+	clientStr := newStream(client.dc, client.rwc, maxMessageSize, func() {})
+	serverStr := newStream(server.dc, server.rwc, maxMessageSize, func() {})
 
 	_, err := serverStr.Write([]byte("foobar"))
 	require.NoError(t, err)
@@ -217,8 +262,8 @@ func TestStreamPartialReads(t *testing.T) {
 func TestStreamSkipEmptyFrames(t *testing.T) {
 	client, server := getDetachedDataChannels(t)
 
-	clientStr := newStream(client.dc, client.rwc, func() {})
-	serverStr := newStream(server.dc, server.rwc, func() {})
+	clientStr := newStream(client.dc, client.rwc, maxMessageSize, func() {})
+	serverStr := newStream(server.dc, server.rwc, maxMessageSize, func() {})
 
 	for i := 0; i < 10; i++ {
 		require.NoError(t, serverStr.writer.WriteMsg(&pb.Message{}))
@@ -252,7 +297,7 @@ func TestStreamSkipEmptyFrames(t *testing.T) {
 func TestStreamReadReturnsOnClose(t *testing.T) {
 	client, _ := getDetachedDataChannels(t)
 
-	clientStr := newStream(client.dc, client.rwc, func() {})
+	clientStr := newStream(client.dc, client.rwc, maxMessageSize, func() {})
 	errChan := make(chan error, 1)
 	go func() {
 		_, err := clientStr.Read([]byte{0})
@@ -275,8 +320,8 @@ func TestStreamResets(t *testing.T) {
 	client, server := getDetachedDataChannels(t)
 
 	var clientDone, serverDone atomic.Bool
-	clientStr := newStream(client.dc, client.rwc, func() { clientDone.Store(true) })
-	serverStr := newStream(server.dc, server.rwc, func() { serverDone.Store(true) })
+	clientStr := newStream(client.dc, client.rwc, maxMessageSize, func() { clientDone.Store(true) })
+	serverStr := newStream(server.dc, server.rwc, maxMessageSize, func() { serverDone.Store(true) })
 
 	// send a foobar from the client
 	_, err := clientStr.Write([]byte("foobar"))
@@ -311,8 +356,8 @@ func TestStreamResets(t *testing.T) {
 func TestStreamReadDeadlineAsync(t *testing.T) {
 	client, server := getDetachedDataChannels(t)
 
-	clientStr := newStream(client.dc, client.rwc, func() {})
-	serverStr := newStream(server.dc, server.rwc, func() {})
+	clientStr := newStream(client.dc, client.rwc, maxMessageSize, func() {})
+	serverStr := newStream(server.dc, server.rwc, maxMessageSize, func() {})
 
 	timeout := 100 * time.Millisecond
 	if os.Getenv("CI") != "" {
@@ -342,8 +387,8 @@ func TestStreamReadDeadlineAsync(t *testing.T) {
 func TestStreamWriteDeadlineAsync(t *testing.T) {
 	client, server := getDetachedDataChannels(t)
 
-	clientStr := newStream(client.dc, client.rwc, func() {})
-	serverStr := newStream(server.dc, server.rwc, func() {})
+	clientStr := newStream(client.dc, client.rwc, maxMessageSize, func() {})
+	serverStr := newStream(server.dc, server.rwc, maxMessageSize, func() {})
 	_ = serverStr
 
 	b := make([]byte, 1024)
@@ -372,8 +417,8 @@ func TestStreamWriteDeadlineAsync(t *testing.T) {
 func TestStreamReadAfterClose(t *testing.T) {
 	client, server := getDetachedDataChannels(t)
 
-	clientStr := newStream(client.dc, client.rwc, func() {})
-	serverStr := newStream(server.dc, server.rwc, func() {})
+	clientStr := newStream(client.dc, client.rwc, maxMessageSize, func() {})
+	serverStr := newStream(server.dc, server.rwc, maxMessageSize, func() {})
 
 	serverStr.Close()
 	b := make([]byte, 1)
@@ -384,8 +429,8 @@ func TestStreamReadAfterClose(t *testing.T) {
 
 	client, server = getDetachedDataChannels(t)
 
-	clientStr = newStream(client.dc, client.rwc, func() {})
-	serverStr = newStream(server.dc, server.rwc, func() {})
+	clientStr = newStream(client.dc, client.rwc, maxMessageSize, func() {})
+	serverStr = newStream(server.dc, server.rwc, maxMessageSize, func() {})
 
 	serverStr.Reset()
 	b = make([]byte, 1)
@@ -399,8 +444,8 @@ func TestStreamCloseAfterFINACK(t *testing.T) {
 	client, server := getDetachedDataChannels(t)
 
 	done := make(chan bool, 1)
-	clientStr := newStream(client.dc, client.rwc, func() { done <- true })
-	serverStr := newStream(server.dc, server.rwc, func() {})
+	clientStr := newStream(client.dc, client.rwc, maxMessageSize, func() { done <- true })
+	serverStr := newStream(server.dc, server.rwc, maxMessageSize, func() {})
 
 	go func() {
 		err := clientStr.Close()
@@ -427,8 +472,8 @@ func TestStreamFinAckAfterStopSending(t *testing.T) {
 	client, server := getDetachedDataChannels(t)
 
 	done := make(chan bool, 1)
-	clientStr := newStream(client.dc, client.rwc, func() { done <- true })
-	serverStr := newStream(server.dc, server.rwc, func() {})
+	clientStr := newStream(client.dc, client.rwc, maxMessageSize, func() { done <- true })
+	serverStr := newStream(server.dc, server.rwc, maxMessageSize, func() {})
 
 	go func() {
 		clientStr.CloseRead()
@@ -460,8 +505,8 @@ func TestStreamConcurrentClose(t *testing.T) {
 
 	start := make(chan bool, 2)
 	done := make(chan bool, 2)
-	clientStr := newStream(client.dc, client.rwc, func() { done <- true })
-	serverStr := newStream(server.dc, server.rwc, func() { done <- true })
+	clientStr := newStream(client.dc, client.rwc, maxMessageSize, func() { done <- true })
+	serverStr := newStream(server.dc, server.rwc, maxMessageSize, func() { done <- true })
 
 	go func() {
 		start <- true
@@ -495,7 +540,7 @@ func TestStreamResetAfterClose(t *testing.T) {
 	client, server := getDetachedDataChannels(t)
 
 	done := make(chan bool, 2)
-	clientStr := newStream(client.dc, client.rwc, func() { done <- true })
+	clientStr := newStream(client.dc, client.rwc, maxMessageSize, func() { done <- true })
 	clientStr.Close()
 
 	select {
@@ -520,7 +565,7 @@ func TestStreamDataChannelCloseOnFINACK(t *testing.T) {
 	client, server := getDetachedDataChannels(t)
 
 	done := make(chan bool, 1)
-	clientStr := newStream(client.dc, client.rwc, func() { done <- true })
+	clientStr := newStream(client.dc, client.rwc, maxMessageSize, func() { done <- true })
 
 	clientStr.Close()
 
@@ -542,8 +587,8 @@ func TestStreamDataChannelCloseOnFINACK(t *testing.T) {
 func TestStreamChunking(t *testing.T) {
 	client, server := getDetachedDataChannels(t)
 
-	clientStr := newStream(client.dc, client.rwc, func() {})
-	serverStr := newStream(server.dc, server.rwc, func() {})
+	clientStr := newStream(client.dc, client.rwc, maxMessageSize, func() {})
+	serverStr := newStream(server.dc, server.rwc, maxMessageSize, func() {})
 
 	const N = (16 << 10) + 1000
 	go func() {
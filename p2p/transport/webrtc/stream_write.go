@@ -24,7 +24,7 @@ func (s *stream) Write(b []byte) (int, error) {
 	}
 	switch s.sendState {
 	case sendStateReset:
-		return 0, network.ErrReset
+		return 0, s.writeResetError()
 	case sendStateDataSent, sendStateDataReceived:
 		return 0, errWriteAfterClose
 	}
@@ -48,7 +48,7 @@ func (s *stream) Write(b []byte) (int, error) {
 		}
 		switch s.sendState {
 		case sendStateReset:
-			return n, network.ErrReset
+			return n, s.writeResetError()
 		case sendStateDataSent, sendStateDataReceived:
 			return n, errWriteAfterClose
 		}
@@ -84,11 +84,11 @@ func (s *stream) Write(b []byte) (int, error) {
 			s.mx.Lock()
 			continue
 		}
-		end := maxMessageSize
+		end := s.maxMessageSize
 		if end > availableSpace {
 			end = availableSpace
 		}
-		end -= protoOverhead + varintOverhead
+		end -= messageOverhead(s.maxMessageSize)
 		if end > len(b) {
 			end = len(b)
 		}
@@ -112,14 +112,42 @@ func (s *stream) SetWriteDeadline(t time.Time) error {
 
 func (s *stream) availableSendSpace() int {
 	buffered := int(s.dataChannel.BufferedAmount())
-	availableSpace := maxSendBuffer - buffered
+	availableSpace := s.maxSendBuffer() - buffered
 	if availableSpace+maxTotalControlMessagesSize < 0 { // this should never happen, but better check
-		log.Errorw("data channel buffered more data than the maximum amount", "max", maxSendBuffer, "buffered", buffered)
+		log.Errorw("data channel buffered more data than the maximum amount", "max", s.maxSendBuffer(), "buffered", buffered)
 	}
 	return availableSpace
 }
 
-func (s *stream) cancelWrite() error {
+// maxSendBuffer is the maximum data we enqueue on the underlying data channel for writes.
+// The underlying SCTP layer has an unbounded buffer for writes. We limit the amount enqueued
+// per stream is limited to avoid a single stream monopolizing the entire connection.
+// It defaults to twice the message size.
+func (s *stream) maxSendBuffer() int {
+	return s.sendBufferHigh
+}
+
+// messageOverhead returns the maximum framing overhead of a message of up to msgSize bytes.
+// Both the length prefix and the length of the message field are varints, which
+// take 3 bytes instead of 2 for messages larger than 2 ^ 14 bytes.
+func messageOverhead(msgSize int) int {
+	if msgSize <= 1<<14 {
+		return protoOverhead + varintOverhead
+	}
+	return protoOverhead + varintOverhead + 2
+}
+
+// writeResetError returns the error for writing to a reset stream.
+// It needs to be called while the mutex is locked.
+func (s *stream) writeResetError() error {
+	if s.writeResetErr != nil {
+		return s.writeResetErr
+	}
+	return network.ErrReset
+}
+
+// cancelWrite resets the write half of the stream. If code is not nil, it is sent to the peer.
+func (s *stream) cancelWrite(code *StreamErrorCode) error {
 	s.mx.Lock()
 	defer s.mx.Unlock()
 
@@ -132,7 +160,12 @@ func (s *stream) cancelWrite() error {
 	// Remove reference to this stream from data channel
 	s.dataChannel.OnBufferedAmountLow(nil)
 	s.notifyWriteStateChanged()
-	return s.writer.WriteMsg(&pb.Message{Flag: pb.Message_RESET.Enum()})
+	msg := &pb.Message{Flag: pb.Message_RESET.Enum()}
+	if code != nil {
+		s.writeResetErr = &StreamError{ErrorCode: *code}
+		msg.ErrorCode = (*uint32)(code)
+	}
+	return s.writer.WriteMsg(msg)
 }
 
 func (s *stream) CloseWrite() error {
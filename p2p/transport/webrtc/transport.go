@@ -23,6 +23,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	mrand "golang.org/x/exp/rand"
@@ -44,6 +45,7 @@ import (
 	"github.com/multiformats/go-multihash"
 
 	"github.com/pion/datachannel"
+	"github.com/pion/stun"
 	"github.com/pion/webrtc/v3"
 )
 
@@ -81,6 +83,8 @@ const (
 )
 
 type WebRTCTransport struct {
+	// certMu guards the certificate in webrtcConfig, which changes when it is rotated
+	certMu       sync.RWMutex
 	webrtcConfig webrtc.Configuration
 	rcmgr        network.ResourceManager
 	gater        connmgr.ConnectionGater
@@ -93,12 +97,395 @@ type WebRTCTransport struct {
 
 	// in-flight connections
 	maxInFlightConnections uint32
+	// maxInFlightHandshakes limits the inbound handshakes running concurrently. 0 means no limit.
+	maxInFlightHandshakes int
+
+	maxMessageSize int
+
+	// maxStreams is the maximum number of concurrent streams per connection. 0 means no limit.
+	maxStreams int
+
+	// disableIPv6 restricts dials and listeners to IPv4
+	disableIPv6 bool
+
+	// sendBufferHigh and sendBufferLow are the stream send buffer thresholds. If unset, they
+	// are derived from the message size.
+	sendBufferHigh int
+	sendBufferLow  int
+
+	candidateFilter func(candidate ma.Multiaddr) bool
+
+	// pinRemoteAddr pins inbound connections to the remote address ICE selected
+	pinRemoteAddr bool
+
+	// iceServersFunc returns ICE servers for each dial, in addition to the ones in webrtcConfig
+	iceServersFunc func() ([]webrtc.ICEServer, error)
+	// iceTransportPolicy is the ICE transport policy for dials. Listeners are ICE lite agents,
+	// which only use host candidates.
+	iceTransportPolicy webrtc.ICETransportPolicy
+
+	handshakeTracer HandshakeTracer
+	// onHandshakeError is called when an inbound handshake fails
+	onHandshakeError func(remote net.Addr, phase string, err error)
+
+	// announceAddr is the /webrtc-direct address advertised by listeners of the same IP
+	// address family instead of their local address
+	announceAddr ma.Multiaddr
+
+	// packetConn, if set, is the socket listeners are created on instead of binding their own
+	packetConn net.PacketConn
+	// packetConnMu guards packetConnListener, the listener currently using packetConn
+	packetConnMu       sync.Mutex
+	packetConnListener *listener
+
+	certRotationInterval time.Duration
+	closeOnce            sync.Once
+	closeCertRotation    context.CancelFunc
+	certRotationDone     chan struct{}
 }
 
 var _ tpt.Transport = &WebRTCTransport{}
 
 type Option func(*WebRTCTransport) error
 
+// WithCertificate sets the certificate used for DTLS. Its fingerprint is
+// advertised in the certhash component of the listen addresses. By default, a
+// new ECDSA P-256 certificate is generated, which is valid for a month.
+func WithCertificate(cert webrtc.Certificate) Option {
+	return func(t *WebRTCTransport) error {
+		if !cert.Expires().After(time.Now()) {
+			return errors.New("certificate has expired")
+		}
+		t.webrtcConfig.Certificates = []webrtc.Certificate{cert}
+		return nil
+	}
+}
+
+// WithCertRotation regenerates the certificate every interval. Listeners
+// advertise the new certhash right away and use the new certificate for new
+// connections, while existing connections keep using the old one. Peers that
+// only know the old certhash can't dial the listener after a rotation.
+func WithCertRotation(interval time.Duration) Option {
+	return func(t *WebRTCTransport) error {
+		if interval <= 0 {
+			return errors.New("certificate rotation interval must be positive")
+		}
+		t.certRotationInterval = interval
+		return nil
+	}
+}
+
+// WithMaxMessageSize sets the maximum size of the messages written on streams.
+// Writes larger than this are split into multiple messages.
+// The size must be between 1 KiB and 64 KiB and defaults to 16 KiB.
+// Streams always accept messages of up to 16 KiB, so raising the size above the
+// default requires the remote peer to be configured with the same size.
+func WithMaxMessageSize(size int) Option {
+	return func(t *WebRTCTransport) error {
+		if size < minMessageSize || size > maxSCTPMessageSize {
+			return fmt.Errorf("max message size must be between %d and %d, got %d", minMessageSize, maxSCTPMessageSize, size)
+		}
+		t.maxMessageSize = size
+		return nil
+	}
+}
+
+// WithSCTPBufferThresholds sets when writes on a stream block and resume. Writes block once
+// high bytes are buffered on the stream's data channel, and resume when the buffered amount
+// drops to low. Low watermarks close to high suit many small streams, while a large gap lets a
+// few high-throughput streams keep more data in flight. High must be at least 1 KiB larger than low.
+// By default, high is twice the message size and low is the message size.
+func WithSCTPBufferThresholds(high, low int) Option {
+	return func(t *WebRTCTransport) error {
+		if low < 0 {
+			return fmt.Errorf("low threshold must not be negative, got %d", low)
+		}
+		if high-low < minMessageSize {
+			return fmt.Errorf("high threshold must be at least %d bytes larger than the low threshold, got high %d, low %d", minMessageSize, high, low)
+		}
+		t.sendBufferHigh = high
+		t.sendBufferLow = low
+		return nil
+	}
+}
+
+// newStream creates a stream with the transport's message size and send buffer thresholds.
+func (t *WebRTCTransport) newStream(channel *webrtc.DataChannel, rwc datachannel.ReadWriteCloser, onDone func()) *stream {
+	str := newStream(channel, rwc, t.maxMessageSize, onDone)
+	if t.sendBufferHigh > 0 {
+		str.setSendBufferThresholds(t.sendBufferHigh, t.sendBufferLow)
+	}
+	return str
+}
+
+// WithMaxStreams limits the number of concurrent streams on each connection, in addition to the
+// limits of the resource manager. OpenStream fails with ErrTooManyStreams once the limit is
+// reached, and streams opened by the peer past the limit are reset. A stream stops counting
+// towards the limit once it is closed or reset. By default, the number of streams isn't limited.
+func WithMaxStreams(n int) Option {
+	return func(t *WebRTCTransport) error {
+		if n <= 0 {
+			return fmt.Errorf("max streams must be positive, got %d", n)
+		}
+		t.maxStreams = n
+		return nil
+	}
+}
+
+// WithDisableIPv6 restricts the transport to IPv4. Dials only gather IPv4 candidates, which
+// avoids spending time on IPv6 candidates on networks where IPv6 is broken. IPv6 addresses
+// can't be dialed and listened on, and DNS names are only resolved to IPv4 addresses.
+func WithDisableIPv6() Option {
+	return func(t *WebRTCTransport) error {
+		t.disableIPv6 = true
+		return nil
+	}
+}
+
+// WithPacketConn makes the transport listen on conn instead of binding its own socket. This
+// allows reusing a socket obtained out of band, for example through socket activation or from
+// a NAT traversal library that already punched a hole with it. conn must be a UDP socket, and
+// must not be read from by anything else while a listener uses it.
+// Listen only accepts addresses matching the local address of conn, where an unspecified IP
+// address or port 0 match any, and only one listener can use conn at a time. Closing the
+// listener doesn't close conn; the caller remains responsible for closing it.
+func WithPacketConn(conn net.PacketConn) Option {
+	return func(t *WebRTCTransport) error {
+		if conn == nil {
+			return errors.New("packet conn must not be nil")
+		}
+		if _, ok := conn.LocalAddr().(*net.UDPAddr); !ok {
+			return fmt.Errorf("packet conn must be a UDP socket, got local address %s", conn.LocalAddr())
+		}
+		t.packetConn = conn
+		return nil
+	}
+}
+
+// WithKeepalive sets how connections detect that the peer went away. When dialing, ICE
+// connectivity checks are sent to the peer if nothing was sent or received for interval, and
+// connections are closed once nothing was received from the peer for timeout. Listeners don't send
+// connectivity checks, they rely on the checks sent by the dialer. A listener's timeout must
+// therefore be larger than the keepalive interval of the peers dialing it, which is 15 seconds
+// by default. The timeout must be larger than the interval.
+// By default, the interval is 15 seconds and the timeout is 50 seconds.
+func WithKeepalive(interval, timeout time.Duration) Option {
+	return func(t *WebRTCTransport) error {
+		if interval <= 0 {
+			return fmt.Errorf("keepalive interval must be positive, got %s", interval)
+		}
+		if timeout <= interval {
+			return fmt.Errorf("keepalive timeout must be larger than the interval, got interval %s, timeout %s", interval, timeout)
+		}
+		// The ICE agent reports the connection as disconnected after the disconnected timeout,
+		// and as failed, which closes the connection, after the failed timeout on top of that.
+		t.peerConnectionTimeouts = iceTimeouts{
+			Disconnect: timeout / 2,
+			Failed:     timeout - timeout/2,
+			Keepalive:  interval,
+		}
+		return nil
+	}
+}
+
+// WithCandidateFilter restricts the local addresses used for ICE candidates.
+// The filter is called with the IP address of a candidate, e.g. /ip4/192.0.2.1, and
+// returns whether the address may be used. Host candidates are only gathered on
+// allowed addresses when dialing. A listener on an unspecified address only offers
+// candidates on the allowed interface addresses, and listening on a specific address
+// the filter rejects fails. By default, all addresses are used.
+func WithCandidateFilter(filter func(candidate ma.Multiaddr) bool) Option {
+	return func(t *WebRTCTransport) error {
+		t.candidateFilter = filter
+		return nil
+	}
+}
+
+// WithPinRemoteAddr pins inbound connections to the remote address ICE selected during the
+// handshake. Afterwards, packets for the connection from any other address are dropped, which
+// prevents an off-path attacker who learned the ufrag from injecting packets. Pinning breaks
+// ICE roaming, so it is disabled by default.
+func WithPinRemoteAddr() Option {
+	return func(t *WebRTCTransport) error {
+		t.pinRemoteAddr = true
+		return nil
+	}
+}
+
+// WithHandshakeTracer sets a tracer that is notified of the handshake timings of
+// every inbound and outbound connection the transport establishes.
+func WithHandshakeTracer(tracer HandshakeTracer) Option {
+	return func(t *WebRTCTransport) error {
+		t.handshakeTracer = tracer
+		return nil
+	}
+}
+
+// WithOnHandshakeError sets a callback that is called when an inbound handshake fails, with the
+// address the connection attempt came from, the phase of the handshake that failed (one of the
+// HandshakePhase constants) and the error. This makes handshake failures observable without
+// enabling debug logging. Handshakes aborted because the listener is closed aren't reported.
+// The callback is called from the handshake's goroutine and must not block.
+func WithOnHandshakeError(f func(remote net.Addr, phase string, err error)) Option {
+	return func(t *WebRTCTransport) error {
+		t.onHandshakeError = f
+		return nil
+	}
+}
+
+// WithMaxInFlightHandshakes limits the number of inbound handshakes (ICE, DTLS, SCTP and Noise)
+// a listener runs concurrently. Once the limit is reached, new connection attempts wait for a
+// running handshake to complete or fail. Attempts that can't start their handshake before the
+// connection setup timeout are rejected. Unlike the limit on in-flight connections, a slot is
+// released as soon as the handshake completes, even if the connection wasn't accepted yet.
+// By default, handshakes are only limited by the number of in-flight connections.
+func WithMaxInFlightHandshakes(n int) Option {
+	return func(t *WebRTCTransport) error {
+		if n <= 0 {
+			return fmt.Errorf("max in-flight handshakes must be positive, got %d", n)
+		}
+		t.maxInFlightHandshakes = n
+		return nil
+	}
+}
+
+// WithAnnounceAddr sets a fixed external address, e.g. /ip4/192.0.2.1/udp/9000, that listeners
+// advertise instead of their local address. This is useful for servers behind a 1:1 NAT or a
+// port forwarding, where the external address is known upfront. Listeners still accept connections
+// on their local socket. The address only applies to listeners of the same IP address family.
+// Any certhash in addr is replaced with the certhash of the transport's certificate.
+func WithAnnounceAddr(addr ma.Multiaddr) Option {
+	return func(t *WebRTCTransport) error {
+		addr, _ = ma.SplitFunc(addr, func(c ma.Component) bool { return c.Protocol().Code == ma.P_WEBRTC_DIRECT })
+		na, err := manet.ToNetAddr(addr)
+		if err != nil {
+			return fmt.Errorf("invalid announce address %s: %w", addr, err)
+		}
+		udpAddr, ok := na.(*net.UDPAddr)
+		if !ok {
+			return fmt.Errorf("announce address %s is not a UDP address", addr)
+		}
+		if udpAddr.IP.IsUnspecified() || udpAddr.Port == 0 {
+			return fmt.Errorf("announce address %s must have a specified IP address and port", addr)
+		}
+		t.announceAddr = addr.Encapsulate(webrtcComponent)
+		return nil
+	}
+}
+
+// allowCandidateIP reports whether the candidate filter allows the IP address.
+func (t *WebRTCTransport) allowCandidateIP(ip net.IP) bool {
+	if t.candidateFilter == nil {
+		return true
+	}
+	addr, err := manet.FromIP(ip)
+	if err != nil {
+		return false
+	}
+	return t.candidateFilter(addr)
+}
+
+// candidateAddrs returns the addresses for the host candidates of a listener
+// on laddr. If laddr is unspecified, these are the interface addresses of
+// laddr's address family that the candidate filter allows.
+func (t *WebRTCTransport) candidateAddrs(laddr *net.UDPAddr) ([]net.Addr, error) {
+	if !laddr.IP.IsUnspecified() {
+		return []net.Addr{laddr}, nil
+	}
+	ifaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get interface addresses: %w", err)
+	}
+	isIPv6 := laddr.IP.To4() == nil
+	var addrs []net.Addr
+	for _, a := range ifaceAddrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || (ipnet.IP.To4() == nil) != isIPv6 || !t.allowCandidateIP(ipnet.IP) {
+			continue
+		}
+		addrs = append(addrs, &net.UDPAddr{IP: ipnet.IP, Port: laddr.Port})
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no interface address for %s allowed by the candidate filter", laddr)
+	}
+	return addrs, nil
+}
+
+// WithICEServers sets the STUN and TURN servers used to gather candidates when dialing.
+// TURN servers (turn: and turns: URLs) require a username and credential. With a TURN server,
+// the dialer also gathers relay candidates, which lets peers behind symmetric NATs reach
+// listeners. Listeners don't use ICE servers, /webrtc-direct listeners must be reachable on
+// their own address. If a TURN server is unreachable, the dial proceeds with the other
+// candidates, but closing the connection waits until the allocation on the server times out.
+// By default, no ICE servers are used and only host candidates are gathered.
+func WithICEServers(servers []webrtc.ICEServer) Option {
+	return func(t *WebRTCTransport) error {
+		if err := validateICEServers(servers); err != nil {
+			return err
+		}
+		t.webrtcConfig.ICEServers = append([]webrtc.ICEServer(nil), servers...)
+		return nil
+	}
+}
+
+// WithICEServersFunc sets a function that returns ICE servers for each dial, in addition to the
+// servers set with WithICEServers. This allows using short-lived TURN credentials, e.g. from a
+// TURN REST API, that are refreshed while the transport is running. If f fails or returns invalid
+// servers, the dial proceeds with the servers set with WithICEServers.
+func WithICEServersFunc(f func() ([]webrtc.ICEServer, error)) Option {
+	return func(t *WebRTCTransport) error {
+		if f == nil {
+			return errors.New("ICE servers func must not be nil")
+		}
+		t.iceServersFunc = f
+		return nil
+	}
+}
+
+// WithICETransportPolicy sets the candidates used when dialing. With ICETransportPolicyRelay,
+// only relay candidates are used, so that all the traffic goes through a TURN server. This hides
+// the dialer's addresses from the listener, but dials fail if no TURN server is reachable.
+// The default is ICETransportPolicyAll.
+func WithICETransportPolicy(policy webrtc.ICETransportPolicy) Option {
+	return func(t *WebRTCTransport) error {
+		if policy != webrtc.ICETransportPolicyAll && policy != webrtc.ICETransportPolicyRelay {
+			return fmt.Errorf("invalid ICE transport policy %d", policy)
+		}
+		t.iceTransportPolicy = policy
+		return nil
+	}
+}
+
+func hasTURNServer(servers []webrtc.ICEServer) bool {
+	for _, s := range servers {
+		for _, u := range s.URLs {
+			if uri, err := stun.ParseURI(u); err == nil && (uri.Scheme == stun.SchemeTypeTURN || uri.Scheme == stun.SchemeTypeTURNS) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func validateICEServers(servers []webrtc.ICEServer) error {
+	for _, s := range servers {
+		if len(s.URLs) == 0 {
+			return errors.New("ICE server must have at least one URL")
+		}
+		for _, u := range s.URLs {
+			uri, err := stun.ParseURI(u)
+			if err != nil {
+				return fmt.Errorf("invalid ICE server URL %s: %w", u, err)
+			}
+			isTURN := uri.Scheme == stun.SchemeTypeTURN || uri.Scheme == stun.SchemeTypeTURNS
+			if isTURN && (s.Username == "" || s.Credential == nil) {
+				return fmt.Errorf("TURN server %s requires a username and credential", u)
+			}
+		}
+	}
+	return nil
+}
+
 type iceTimeouts struct {
 	Disconnect time.Duration
 	Failed     time.Duration
@@ -117,24 +504,9 @@ func New(privKey ic.PrivKey, psk pnet.PSK, gater connmgr.ConnectionGater, rcmgr
 	if err != nil {
 		return nil, fmt.Errorf("get local peer ID: %w", err)
 	}
-	// We use elliptic P-256 since it is widely supported by browsers.
-	//
-	// Implementation note: Testing with the browser,
-	// it seems like Chromium only supports ECDSA P-256 or RSA key signatures in the webrtc TLS certificate.
-	// We tried using P-228 and P-384 which caused the DTLS handshake to fail with Illegal Parameter
-	//
-	// Please refer to this is a list of suggested algorithms for the WebCrypto API.
-	// The algorithm for generating a certificate for an RTCPeerConnection
-	// must adhere to the WebCrpyto API. From my observation,
-	// RSA and ECDSA P-256 is supported on almost all browsers.
-	// Ed25519 is not present on the list.
-	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	if err != nil {
-		return nil, fmt.Errorf("generate key for cert: %w", err)
-	}
-	cert, err := webrtc.GenerateCertificate(pk)
+	cert, err := generateCertificate()
 	if err != nil {
-		return nil, fmt.Errorf("generate certificate: %w", err)
+		return nil, err
 	}
 	config := webrtc.Configuration{
 		Certificates: []webrtc.Certificate{*cert},
@@ -158,15 +530,111 @@ func New(privKey ic.PrivKey, psk pnet.PSK, gater connmgr.ConnectionGater, rcmgr
 		},
 
 		maxInFlightConnections: DefaultMaxInFlightConnections,
+		maxMessageSize:         maxMessageSize,
 	}
 	for _, opt := range opts {
 		if err := opt(transport); err != nil {
 			return nil, err
 		}
 	}
+	if transport.iceTransportPolicy == webrtc.ICETransportPolicyRelay && transport.iceServersFunc == nil &&
+		!hasTURNServer(transport.webrtcConfig.ICEServers) {
+		return nil, errors.New("relay ICE transport policy requires a TURN server")
+	}
+	if transport.certRotationInterval > 0 {
+		var ctx context.Context
+		ctx, transport.closeCertRotation = context.WithCancel(context.Background())
+		transport.certRotationDone = make(chan struct{})
+		go transport.rotateCertificates(ctx)
+	}
 	return transport, nil
 }
 
+// generateCertificate generates a certificate for DTLS.
+func generateCertificate() (*webrtc.Certificate, error) {
+	// We use elliptic P-256 since it is widely supported by browsers.
+	//
+	// Implementation note: Testing with the browser,
+	// it seems like Chromium only supports ECDSA P-256 or RSA key signatures in the webrtc TLS certificate.
+	// We tried using P-228 and P-384 which caused the DTLS handshake to fail with Illegal Parameter
+	//
+	// Please refer to this is a list of suggested algorithms for the WebCrypto API.
+	// The algorithm for generating a certificate for an RTCPeerConnection
+	// must adhere to the WebCrpyto API. From my observation,
+	// RSA and ECDSA P-256 is supported on almost all browsers.
+	// Ed25519 is not present on the list.
+	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate key for cert: %w", err)
+	}
+	cert, err := webrtc.GenerateCertificate(pk)
+	if err != nil {
+		return nil, fmt.Errorf("generate certificate: %w", err)
+	}
+	return cert, nil
+}
+
+func (t *WebRTCTransport) rotateCertificates(ctx context.Context) {
+	defer close(t.certRotationDone)
+	ticker := time.NewTicker(t.certRotationInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		cert, err := generateCertificate()
+		if err != nil {
+			log.Errorf("failed to rotate certificate: %s", err)
+			continue
+		}
+		t.certMu.Lock()
+		t.webrtcConfig.Certificates = []webrtc.Certificate{*cert}
+		t.certMu.Unlock()
+		log.Debug("rotated certificate")
+	}
+}
+
+// getWebRTCConfig returns the configuration for new peer connections.
+func (t *WebRTCTransport) getWebRTCConfig() webrtc.Configuration {
+	t.certMu.RLock()
+	defer t.certMu.RUnlock()
+	return t.webrtcConfig
+}
+
+// getDialWebRTCConfig returns the configuration for outbound peer connections, which adds the
+// ICE servers returned by the ICE servers func and the ICE transport policy.
+func (t *WebRTCTransport) getDialWebRTCConfig() webrtc.Configuration {
+	config := t.getWebRTCConfig()
+	config.ICETransportPolicy = t.iceTransportPolicy
+	if t.iceServersFunc == nil {
+		return config
+	}
+	servers, err := t.iceServersFunc()
+	if err != nil {
+		log.Warnf("failed to get ICE servers: %s", err)
+		return config
+	}
+	if err := validateICEServers(servers); err != nil {
+		log.Warnf("ignoring invalid ICE servers: %s", err)
+		return config
+	}
+	config.ICEServers = append(append([]webrtc.ICEServer(nil), config.ICEServers...), servers...)
+	return config
+}
+
+// Close stops the certificate rotation.
+func (t *WebRTCTransport) Close() error {
+	t.closeOnce.Do(func() {
+		if t.closeCertRotation != nil {
+			t.closeCertRotation()
+			<-t.certRotationDone
+		}
+	})
+	return nil
+}
+
 func (t *WebRTCTransport) Protocols() []int {
 	return []int{ma.P_WEBRTC_DIRECT}
 }
@@ -177,9 +645,22 @@ func (t *WebRTCTransport) Proxy() bool {
 
 func (t *WebRTCTransport) CanDial(addr ma.Multiaddr) bool {
 	isValid, n := IsWebRTCDirectMultiaddr(addr)
+	if t.disableIPv6 && isIPv6Addr(addr) {
+		return false
+	}
 	return isValid && n > 0
 }
 
+// isIPv6Addr reports whether addr is an /ip6 or /dns6 address.
+func isIPv6Addr(addr ma.Multiaddr) bool {
+	first, _ := ma.SplitFirst(addr)
+	if first == nil {
+		return false
+	}
+	code := first.Protocol().Code
+	return code == ma.P_IP6 || code == ma.P_DNS6
+}
+
 // Listen returns a listener for addr.
 //
 // The IP, Port combination for addr must be exclusive to this listener as a WebRTC listener cannot
@@ -195,10 +676,25 @@ func (t *WebRTCTransport) Listen(addr ma.Multiaddr) (tpt.Listener, error) {
 	if err != nil {
 		return nil, fmt.Errorf("listener could not fetch dialargs: %w", err)
 	}
+	if t.disableIPv6 {
+		switch nw {
+		case "udp6":
+			return nil, fmt.Errorf("can't listen on %s: IPv6 is disabled", addr)
+		case "udp":
+			nw = "udp4"
+		}
+	}
 	udpAddr, err := net.ResolveUDPAddr(nw, host)
 	if err != nil {
 		return nil, fmt.Errorf("listener could not resolve udp address: %w", err)
 	}
+	if !udpAddr.IP.IsUnspecified() && !t.allowCandidateIP(udpAddr.IP) {
+		return nil, fmt.Errorf("listen address %s rejected by the candidate filter", addr)
+	}
+
+	if t.packetConn != nil {
+		return t.listenPacketConn(addr, udpAddr)
+	}
 
 	socket, err := net.ListenUDP(nw, udpAddr)
 	if err != nil {
@@ -213,33 +709,62 @@ func (t *WebRTCTransport) Listen(addr ma.Multiaddr) (tpt.Listener, error) {
 	return listener, nil
 }
 
-func (t *WebRTCTransport) listenSocket(socket *net.UDPConn) (tpt.Listener, error) {
-	listenerMultiaddr, err := manet.FromNetAddr(socket.LocalAddr())
-	if err != nil {
-		return nil, err
+// listenPacketConn creates a listener on the socket supplied with WithPacketConn. udpAddr is the
+// resolved listen address addr, which must be of the same IP address family as the socket.
+func (t *WebRTCTransport) listenPacketConn(addr ma.Multiaddr, udpAddr *net.UDPAddr) (tpt.Listener, error) {
+	connAddr := t.packetConn.LocalAddr().(*net.UDPAddr)
+	if (udpAddr.IP.To4() == nil) != (connAddr.IP.To4() == nil) ||
+		(!udpAddr.IP.IsUnspecified() && !udpAddr.IP.Equal(connAddr.IP)) ||
+		(udpAddr.Port != 0 && udpAddr.Port != connAddr.Port) {
+		return nil, fmt.Errorf("listen address %s doesn't match the packet conn address %s", addr, connAddr)
 	}
 
-	listenerFingerprint, err := t.getCertificateFingerprint()
+	t.packetConnMu.Lock()
+	defer t.packetConnMu.Unlock()
+	if t.packetConnListener != nil {
+		return nil, errors.New("packet conn is already used by a listener")
+	}
+	l, err := t.listenSocket(t.packetConn)
 	if err != nil {
 		return nil, err
 	}
+	l.keepSocket = true
+	t.packetConnListener = l
+	return l, nil
+}
 
-	encodedLocalFingerprint, err := encodeDTLSFingerprint(listenerFingerprint)
-	if err != nil {
-		return nil, err
+// releasePacketConn is called when l is closed, so that the supplied socket can be listened on again.
+func (t *WebRTCTransport) releasePacketConn(l *listener) {
+	t.packetConnMu.Lock()
+	defer t.packetConnMu.Unlock()
+	if t.packetConnListener == l {
+		t.packetConnListener = nil
 	}
+}
 
-	certComp, err := ma.NewComponent(ma.ProtocolWithCode(ma.P_CERTHASH).Name, encodedLocalFingerprint)
+func (t *WebRTCTransport) listenSocket(socket net.PacketConn) (*listener, error) {
+	listenerMultiaddr, err := manet.FromNetAddr(socket.LocalAddr())
 	if err != nil {
 		return nil, err
 	}
-	listenerMultiaddr = listenerMultiaddr.Encapsulate(webrtcComponent).Encapsulate(certComp)
+	// The certhash is added by the listener, as it changes when the certificate is rotated.
+	listenerMultiaddr = listenerMultiaddr.Encapsulate(webrtcComponent)
+
+	var announceMultiaddr ma.Multiaddr
+	if t.announceAddr != nil {
+		isIPv6 := socket.LocalAddr().(*net.UDPAddr).IP.To4() == nil
+		_, err := t.announceAddr.ValueForProtocol(ma.P_IP6)
+		announceIsIPv6 := err == nil
+		if announceIsIPv6 == isIPv6 {
+			announceMultiaddr = t.announceAddr
+		}
+	}
 
 	return newListener(
 		t,
 		listenerMultiaddr,
+		announceMultiaddr,
 		socket,
-		t.webrtcConfig,
 	)
 }
 
@@ -286,6 +811,15 @@ func (t *WebRTCTransport) dial(ctx context.Context, scope network.ConnManagement
 	if err != nil {
 		return nil, fmt.Errorf("generate dial args: %w", err)
 	}
+	if t.disableIPv6 {
+		switch rnw {
+		case "udp6":
+			return nil, fmt.Errorf("can't dial %s: IPv6 is disabled", remoteMultiaddr)
+		case "udp":
+			// only resolve DNS names to IPv4 addresses
+			rnw = "udp4"
+		}
+	}
 
 	raddr, err := net.ResolveUDPAddr(rnw, rhost)
 	if err != nil {
@@ -299,30 +833,11 @@ func (t *WebRTCTransport) dial(ctx context.Context, scope network.ConnManagement
 	// the password using the STUN message.
 	ufrag := genUfrag()
 
-	settingEngine := webrtc.SettingEngine{
-		LoggerFactory: pionLoggerFactory,
-	}
-	settingEngine.SetICECredentials(ufrag, ufrag)
-	settingEngine.DetachDataChannels()
-	// use the first best address candidate
-	settingEngine.SetPrflxAcceptanceMinWait(0)
-	settingEngine.SetICETimeouts(
-		t.peerConnectionTimeouts.Disconnect,
-		t.peerConnectionTimeouts.Failed,
-		t.peerConnectionTimeouts.Keepalive,
-	)
-	// By default, webrtc will not collect candidates on the loopback address.
-	// This is disallowed in the ICE specification. However, implementations
-	// do not strictly follow this, for eg. Chrome gathers TCP loopback candidates.
-	// If you run pion on a system with only the loopback interface UP,
-	// it will not connect to anything.
-	settingEngine.SetIncludeLoopbackCandidate(true)
-	settingEngine.SetSCTPMaxReceiveBufferSize(sctpReceiveBufferSize)
 	if err := scope.ReserveMemory(sctpReceiveBufferSize, network.ReservationPriorityMedium); err != nil {
 		return nil, err
 	}
 
-	w, err = newWebRTCConnection(settingEngine, t.webrtcConfig)
+	w, err = newWebRTCConnection(t.newDialSettingEngine(ufrag), t.getDialWebRTCConfig())
 	if err != nil {
 		return nil, fmt.Errorf("instantiating peer connection failed: %w", err)
 	}
@@ -366,12 +881,14 @@ func (t *WebRTCTransport) dial(ctx context.Context, scope network.ConnManagement
 	if err != nil {
 		return nil, err
 	}
-	channel := newStream(w.HandshakeDataChannel, detached, func() {})
+	w.HandshakeTimer.SCTPConnected()
+	channel := newStream(w.HandshakeDataChannel, detached, maxMessageSize, func() {})
 
 	remotePubKey, err := t.noiseHandshake(ctx, w.PeerConnection, channel, p, remoteHashFunction, false)
 	if err != nil {
 		return nil, err
 	}
+	w.HandshakeTimer.NoiseDone()
 
 	// Setup local and remote address for the connection
 	cp, err := w.HandshakeDataChannel.Transport().Transport().ICETransport().GetSelectedCandidatePair()
@@ -388,6 +905,12 @@ func (t *WebRTCTransport) dial(ctx context.Context, scope network.ConnManagement
 	}
 	remoteMultiaddrWithoutCerthash, _ := ma.SplitFunc(remoteMultiaddr, func(c ma.Component) bool { return c.Protocol().Code == ma.P_CERTHASH })
 
+	// Check the gater before creating the connection. Returning an error here closes
+	// the peer connection, releasing the DTLS and SCTP resources.
+	if t.gater != nil && !t.gater.InterceptSecured(network.DirOutbound, p, &connMultiaddrs{local: localAddr, remote: remoteMultiaddrWithoutCerthash}) {
+		return nil, fmt.Errorf("secured connection gated")
+	}
+
 	conn, err := newConnection(
 		network.DirOutbound,
 		w.PeerConnection,
@@ -403,13 +926,44 @@ func (t *WebRTCTransport) dial(ctx context.Context, scope network.ConnManagement
 	if err != nil {
 		return nil, err
 	}
-
-	if t.gater != nil && !t.gater.InterceptSecured(network.DirOutbound, p, conn) {
-		return nil, fmt.Errorf("secured connection gated")
+	conn.handshakeTimings = w.HandshakeTimer.Timings()
+	if t.handshakeTracer != nil {
+		t.handshakeTracer.HandshakeCompleted(network.DirOutbound, conn.handshakeTimings)
 	}
 	return conn, nil
 }
 
+// newDialSettingEngine returns the setting engine for an outbound peer connection using ufrag as
+// the ICE username fragment and password.
+func (t *WebRTCTransport) newDialSettingEngine(ufrag string) webrtc.SettingEngine {
+	settingEngine := webrtc.SettingEngine{
+		LoggerFactory: pionLoggerFactory,
+	}
+	settingEngine.SetICECredentials(ufrag, ufrag)
+	settingEngine.DetachDataChannels()
+	// use the first best address candidate
+	settingEngine.SetPrflxAcceptanceMinWait(0)
+	settingEngine.SetICETimeouts(
+		t.peerConnectionTimeouts.Disconnect,
+		t.peerConnectionTimeouts.Failed,
+		t.peerConnectionTimeouts.Keepalive,
+	)
+	// By default, webrtc will not collect candidates on the loopback address.
+	// This is disallowed in the ICE specification. However, implementations
+	// do not strictly follow this, for eg. Chrome gathers TCP loopback candidates.
+	// If you run pion on a system with only the loopback interface UP,
+	// it will not connect to anything.
+	settingEngine.SetIncludeLoopbackCandidate(true)
+	if t.candidateFilter != nil {
+		settingEngine.SetIPFilter(t.allowCandidateIP)
+	}
+	if t.disableIPv6 {
+		settingEngine.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+	}
+	settingEngine.SetSCTPMaxReceiveBufferSize(sctpReceiveBufferSize)
+	return settingEngine
+}
+
 func genUfrag() string {
 	const (
 		uFragAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890"
@@ -432,7 +986,11 @@ func genUfrag() string {
 }
 
 func (t *WebRTCTransport) getCertificateFingerprint() (webrtc.DTLSFingerprint, error) {
-	fps, err := t.webrtcConfig.Certificates[0].GetFingerprints()
+	return getCertificateFingerprint(t.getWebRTCConfig().Certificates[0])
+}
+
+func getCertificateFingerprint(cert webrtc.Certificate) (webrtc.DTLSFingerprint, error) {
+	fps, err := cert.GetFingerprints()
 	if err != nil {
 		return webrtc.DTLSFingerprint{}, err
 	}
@@ -448,7 +1006,9 @@ func (t *WebRTCTransport) generateNoisePrologue(pc *webrtc.PeerConnection, hash
 
 	// NOTE: should we want we can fork the cert code as well to avoid
 	// all the extra allocations due to unneeded string interspersing (hex)
-	localFp, err := t.getCertificateFingerprint()
+	// Use the certificate of the peer connection rather than the transport's current
+	// certificate, since the certificate may have been rotated since the connection was created.
+	localFp, err := getCertificateFingerprint(pc.GetConfiguration().Certificates[0])
 	if err != nil {
 		return nil, err
 	}
@@ -564,8 +1124,8 @@ func detachHandshakeDataChannel(ctx context.Context, dc *webrtc.DataChannel) (da
 	}
 }
 
-// webRTCConnection holds the webrtc.PeerConnection with the handshake channel and the queue for
-// incoming data channels created by the peer.
+// webRTCConnection holds the webrtc.PeerConnection with the handshake channel, the queue for
+// incoming data channels created by the peer and the timer for the connection's handshake phases.
 //
 // When creating a webrtc.PeerConnection, It is important to set the OnDataChannel handler upfront
 // before connecting with the peer. If the handler's set up after connecting with the peer, there's
@@ -575,6 +1135,7 @@ type webRTCConnection struct {
 	PeerConnection       *webrtc.PeerConnection
 	HandshakeDataChannel *webrtc.DataChannel
 	IncomingDataChannels chan dataChannel
+	HandshakeTimer       *handshakeTimer
 }
 
 func newWebRTCConnection(settings webrtc.SettingEngine, config webrtc.Configuration) (webRTCConnection, error) {
@@ -583,6 +1144,7 @@ func newWebRTCConnection(settings webrtc.SettingEngine, config webrtc.Configurat
 	if err != nil {
 		return webRTCConnection{}, fmt.Errorf("failed to create peer connection: %w", err)
 	}
+	timer := newHandshakeTimer(pc)
 
 	negotiated, id := handshakeChannelNegotiated, handshakeChannelID
 	handshakeDataChannel, err := pc.CreateDataChannel("", &webrtc.DataChannelInit{
@@ -617,6 +1179,7 @@ func newWebRTCConnection(settings webrtc.SettingEngine, config webrtc.Configurat
 		PeerConnection:       pc,
 		HandshakeDataChannel: handshakeDataChannel,
 		IncomingDataChannels: incomingDataChannels,
+		HandshakeTimer:       timer,
 	}, nil
 }
 
@@ -9,23 +9,32 @@ import (
 	"io"
 	"net"
 	"os"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/libp2p/go-libp2p/core/connmgr"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/network"
+	mocknetwork "github.com/libp2p/go-libp2p/core/network/mocks"
 	"github.com/libp2p/go-libp2p/core/peer"
 	tpt "github.com/libp2p/go-libp2p/core/transport"
 	ma "github.com/multiformats/go-multiaddr"
 	manet "github.com/multiformats/go-multiaddr/net"
 	"github.com/multiformats/go-multibase"
 	"github.com/multiformats/go-multihash"
+	"github.com/pion/ice/v2"
+	"github.com/pion/stun"
+	"github.com/pion/turn/v2"
+	"github.com/pion/webrtc/v3"
 	quicproxy "github.com/quic-go/quic-go/integrationtests/tools/proxy"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
 	"golang.org/x/crypto/sha3"
 )
 
@@ -852,6 +861,172 @@ func TestConnectionTimeoutOnListener(t *testing.T) {
 	require.True(t, os.IsTimeout(err))
 }
 
+// gatherCandidates returns the IP addresses of the candidates gathered when dialing with tr.
+func gatherCandidates(t *testing.T, tr *WebRTCTransport) []net.IP {
+	t.Helper()
+	w, err := newWebRTCConnection(tr.newDialSettingEngine(genUfrag()), tr.getDialWebRTCConfig())
+	require.NoError(t, err)
+	defer w.PeerConnection.Close()
+	offer, err := w.PeerConnection.CreateOffer(nil)
+	require.NoError(t, err)
+	gatheringDone := webrtc.GatheringCompletePromise(w.PeerConnection)
+	require.NoError(t, w.PeerConnection.SetLocalDescription(offer))
+	select {
+	case <-gatheringDone:
+	case <-time.After(10 * time.Second):
+		t.Fatal("candidate gathering timed out")
+	}
+
+	var ips []net.IP
+	for _, line := range strings.Split(w.PeerConnection.LocalDescription().SDP, "\r\n") {
+		if !strings.HasPrefix(line, "a=candidate:") {
+			continue
+		}
+		// a=candidate:<foundation> <component> <protocol> <priority> <address> <port> typ <type>
+		fields := strings.Fields(line)
+		require.GreaterOrEqual(t, len(fields), 5)
+		ip := net.ParseIP(fields[4])
+		require.NotNil(t, ip, "invalid candidate address in %s", line)
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+func TestDisableIPv6(t *testing.T) {
+	hasIPv6 := func(ips []net.IP) bool {
+		for _, ip := range ips {
+			if ip.To4() == nil {
+				return true
+			}
+		}
+		return false
+	}
+
+	t.Run("candidates", func(t *testing.T) {
+		tr, _ := getTransport(t)
+		if !hasIPv6(gatherCandidates(t, tr)) {
+			t.Skip("no IPv6 candidates gathered without WithDisableIPv6")
+		}
+		tr, _ = getTransport(t, WithDisableIPv6())
+		ips := gatherCandidates(t, tr)
+		require.NotEmpty(t, ips)
+		require.False(t, hasIPv6(ips), "gathered IPv6 candidates: %v", ips)
+	})
+
+	t.Run("listen", func(t *testing.T) {
+		tr, _ := getTransport(t, WithDisableIPv6())
+		_, err := tr.Listen(ma.StringCast("/ip6/::1/udp/0/webrtc-direct"))
+		require.ErrorContains(t, err, "IPv6 is disabled")
+
+		ln, err := tr.Listen(ma.StringCast("/ip4/0.0.0.0/udp/0/webrtc-direct"))
+		require.NoError(t, err)
+		defer ln.Close()
+		require.False(t, isIPv6Addr(ln.Multiaddr()), "advertised IPv6 address %s", ln.Multiaddr())
+	})
+
+	t.Run("dial", func(t *testing.T) {
+		listenTransport, listeningPeer := getTransport(t)
+		ln, err := listenTransport.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/webrtc-direct"))
+		require.NoError(t, err)
+		defer ln.Close()
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}()
+
+		tr, _ := getTransport(t, WithDisableIPv6())
+		_, certhash := ma.SplitFunc(ln.Multiaddr(), func(c ma.Component) bool { return c.Protocol().Code == ma.P_WEBRTC_DIRECT })
+		ip6Addr := ma.StringCast("/ip6/::1/udp/1234").Encapsulate(certhash)
+		require.False(t, tr.CanDial(ip6Addr))
+		require.False(t, tr.CanDial(ma.StringCast("/dns6/example.com/udp/1234").Encapsulate(certhash)))
+		_, err = tr.Dial(context.Background(), ip6Addr, listeningPeer)
+		require.ErrorContains(t, err, "IPv6 is disabled")
+
+		require.True(t, tr.CanDial(ln.Multiaddr()))
+		conn, err := tr.Dial(context.Background(), ln.Multiaddr(), listeningPeer)
+		require.NoError(t, err)
+		conn.Close()
+	})
+}
+
+func TestKeepalive(t *testing.T) {
+	const (
+		interval = 50 * time.Millisecond
+		timeout  = 400 * time.Millisecond
+	)
+	tr, listeningPeer := getTransport(t, WithKeepalive(interval, timeout))
+	ln, err := tr.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/webrtc-direct"))
+	require.NoError(t, err)
+	defer ln.Close()
+
+	var drop atomic.Bool
+	proxy, err := quicproxy.NewQuicProxy("127.0.0.1:0", &quicproxy.Opts{
+		RemoteAddr: fmt.Sprintf("127.0.0.1:%d", ln.Addr().(*net.UDPAddr).Port),
+		DropPacket: func(quicproxy.Direction, []byte) bool { return drop.Load() },
+	})
+	require.NoError(t, err)
+	defer proxy.Close()
+
+	acceptCh := make(chan tpt.CapableConn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if !assert.NoError(t, err) {
+			return
+		}
+		acceptCh <- conn
+	}()
+
+	tr1, _ := getTransport(t, WithKeepalive(interval, timeout))
+	addr, err := manet.FromNetAddr(proxy.LocalAddr())
+	require.NoError(t, err)
+	_, webrtcComponent := ma.SplitFunc(ln.Multiaddr(), func(c ma.Component) bool { return c.Protocol().Code == ma.P_WEBRTC_DIRECT })
+	dialed, err := tr1.Dial(context.Background(), addr.Encapsulate(webrtcComponent), listeningPeer)
+	require.NoError(t, err)
+	defer dialed.Close()
+	var accepted tpt.CapableConn
+	select {
+	case accepted = <-acceptCh:
+	case <-time.After(10 * time.Second):
+		t.Fatal("listener didn't accept the connection")
+	}
+	defer accepted.Close()
+
+	// keepalives keep idle connections open
+	time.Sleep(3 * timeout)
+	require.False(t, dialed.IsClosed())
+	require.False(t, accepted.IsClosed())
+
+	// once the peer stops responding, both sides close the connection after the timeout,
+	// long before the default timeouts
+	drop.Store(true)
+	require.Eventually(t, func() bool { return dialed.IsClosed() && accepted.IsClosed() }, 5*time.Second, 10*time.Millisecond)
+
+	_, err = dialed.OpenStream(context.Background())
+	require.True(t, os.IsTimeout(err))
+	_, err = accepted.AcceptStream()
+	require.True(t, os.IsTimeout(err))
+}
+
+func TestWithKeepalive(t *testing.T) {
+	privKey, _, err := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	require.NoError(t, err)
+	for _, tc := range []struct{ interval, timeout time.Duration }{
+		{0, time.Second},
+		{time.Second, time.Second},
+		{time.Second, time.Millisecond},
+	} {
+		_, err := New(privKey, nil, nil, nil, WithKeepalive(tc.interval, tc.timeout))
+		require.Error(t, err)
+	}
+
+	tr, _ := getTransport(t, WithKeepalive(time.Second, 5*time.Second))
+	require.Equal(t, time.Second, tr.peerConnectionTimeouts.Keepalive)
+	require.Equal(t, 5*time.Second, tr.peerConnectionTimeouts.Disconnect+tr.peerConnectionTimeouts.Failed)
+}
+
 func TestMaxInFlightRequests(t *testing.T) {
 	const count = 3
 	tr, listeningPeer := getTransport(t,
@@ -884,6 +1059,74 @@ func TestMaxInFlightRequests(t *testing.T) {
 	require.Equal(t, 1, int(fails.Load()), "expected exactly 1 dial failure")
 }
 
+func TestMaxInFlightHandshakes(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	connGater := NewMockConnectionGater(ctrl)
+
+	// The gater is called at the start of every inbound handshake. Delay it, so that the
+	// handshakes would overlap without the limit.
+	var running, maxRunning atomic.Int32
+	connGater.EXPECT().InterceptAccept(gomock.Any()).DoAndReturn(func(network.ConnMultiaddrs) bool {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			m := maxRunning.Load()
+			if n <= m || maxRunning.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(200 * time.Millisecond)
+		return true
+	}).AnyTimes()
+	connGater.EXPECT().InterceptSecured(network.DirInbound, gomock.Any(), gomock.Any()).Return(true).AnyTimes()
+
+	privKey, _, err := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	require.NoError(t, err)
+	listeningPeer, err := peer.IDFromPrivateKey(privKey)
+	require.NoError(t, err)
+	tr, err := New(privKey, nil, connGater, nil, WithMaxInFlightHandshakes(1))
+	require.NoError(t, err)
+	ln, err := tr.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/webrtc-direct"))
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	const count = 3
+	errC := make(chan error, count)
+	for i := 0; i < count; i++ {
+		go func() {
+			dialer, _ := getTransport(t)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			conn, err := dialer.Dial(ctx, ln.Multiaddr(), listeningPeer)
+			if err == nil {
+				t.Cleanup(func() { conn.Close() })
+			}
+			errC <- err
+		}()
+	}
+	for i := 0; i < count; i++ {
+		require.NoError(t, <-errC)
+	}
+	require.Equal(t, int32(1), maxRunning.Load())
+}
+
+func TestMaxInFlightHandshakesInvalid(t *testing.T) {
+	privKey, _, err := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	require.NoError(t, err)
+	_, err = New(privKey, nil, nil, nil, WithMaxInFlightHandshakes(0))
+	require.Error(t, err)
+}
+
 func TestGenUfrag(t *testing.T) {
 	for i := 0; i < 10; i++ {
 		s := genUfrag()
@@ -1005,3 +1248,1503 @@ func TestManyConnections(t *testing.T) {
 		}
 	}
 }
+
+func TestWithICEServers(t *testing.T) {
+	servers := []webrtc.ICEServer{
+		{URLs: []string{"stun:stun.example.com:3478"}},
+		{
+			URLs:           []string{"turn:turn.example.com:3478?transport=udp"},
+			Username:       "user",
+			Credential:     "password",
+			CredentialType: webrtc.ICECredentialTypePassword,
+		},
+	}
+	tr, _ := getTransport(t, WithICEServers(servers))
+	w, err := newWebRTCConnection(webrtc.SettingEngine{}, tr.webrtcConfig)
+	require.NoError(t, err)
+	defer w.PeerConnection.Close()
+	require.Equal(t, servers, w.PeerConnection.GetConfiguration().ICEServers)
+
+	// by default no ICE servers are configured
+	tr, _ = getTransport(t)
+	require.Empty(t, tr.webrtcConfig.ICEServers)
+
+	privKey, _, err := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	require.NoError(t, err)
+	for _, s := range []webrtc.ICEServer{
+		{},
+		{URLs: []string{"invalid"}},
+		{URLs: []string{"turn:turn.example.com:3478"}},
+	} {
+		_, err := New(privKey, nil, nil, nil, WithICEServers([]webrtc.ICEServer{s}))
+		require.Error(t, err)
+	}
+}
+
+func TestMaxStreams(t *testing.T) {
+	const maxStreams = 2
+
+	connect := func(t *testing.T, listenOpts, dialOpts []Option) (dialed, accepted tpt.CapableConn) {
+		t.Helper()
+		listenTransport, listeningPeer := getTransport(t, listenOpts...)
+		ln, err := listenTransport.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/webrtc-direct"))
+		require.NoError(t, err)
+		t.Cleanup(func() { ln.Close() })
+		acceptCh := make(chan tpt.CapableConn, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if !assert.NoError(t, err) {
+				return
+			}
+			acceptCh <- conn
+		}()
+		dialTransport, _ := getTransport(t, dialOpts...)
+		dialed, err = dialTransport.Dial(context.Background(), ln.Multiaddr(), listeningPeer)
+		require.NoError(t, err)
+		t.Cleanup(func() { dialed.Close() })
+		select {
+		case accepted = <-acceptCh:
+		case <-time.After(10 * time.Second):
+			t.Fatal("listener didn't accept the connection")
+		}
+		t.Cleanup(func() { accepted.Close() })
+		return dialed, accepted
+	}
+
+	t.Run("outbound", func(t *testing.T) {
+		conn, _ := connect(t, nil, []Option{WithMaxStreams(maxStreams)})
+		var streams []network.MuxedStream
+		for i := 0; i < maxStreams; i++ {
+			str, err := conn.OpenStream(context.Background())
+			require.NoError(t, err)
+			streams = append(streams, str)
+		}
+		_, err := conn.OpenStream(context.Background())
+		require.ErrorIs(t, err, ErrTooManyStreams)
+
+		// closing a stream frees a slot
+		require.NoError(t, streams[0].Close())
+		str, err := conn.OpenStream(context.Background())
+		require.NoError(t, err)
+		_, err = conn.OpenStream(context.Background())
+		require.ErrorIs(t, err, ErrTooManyStreams)
+
+		// so does resetting it
+		require.NoError(t, str.Reset())
+		_, err = conn.OpenStream(context.Background())
+		require.NoError(t, err)
+	})
+
+	t.Run("inbound", func(t *testing.T) {
+		dialed, accepted := connect(t, []Option{WithMaxStreams(maxStreams)}, nil)
+
+		openStream := func() network.MuxedStream {
+			t.Helper()
+			str, err := dialed.OpenStream(context.Background())
+			require.NoError(t, err)
+			t.Cleanup(func() { str.Reset() })
+			_, err = str.Write([]byte("a"))
+			require.NoError(t, err)
+			return str
+		}
+		acceptCh := make(chan network.MuxedStream)
+		go func() {
+			for {
+				str, err := accepted.AcceptStream()
+				if err != nil {
+					return
+				}
+				acceptCh <- str
+			}
+		}()
+		accept := func() network.MuxedStream {
+			t.Helper()
+			select {
+			case str := <-acceptCh:
+				return str
+			case <-time.After(10 * time.Second):
+				t.Fatal("stream wasn't accepted")
+				return nil
+			}
+		}
+
+		var streams []network.MuxedStream
+		for i := 0; i < maxStreams; i++ {
+			openStream()
+			streams = append(streams, accept())
+		}
+
+		// the stream past the limit is reset
+		rejected := openStream()
+		rejected.SetReadDeadline(time.Now().Add(10 * time.Second))
+		_, err := rejected.Read(make([]byte, 1))
+		require.ErrorIs(t, err, network.ErrReset)
+		select {
+		case <-acceptCh:
+			t.Fatal("stream past the limit was accepted")
+		default:
+		}
+
+		// closing a stream frees a slot
+		require.NoError(t, streams[0].Reset())
+		str := openStream()
+		astr := accept()
+		_, err = str.Write([]byte("b"))
+		require.NoError(t, err)
+		buf := make([]byte, 2)
+		_, err = io.ReadFull(astr, buf)
+		require.NoError(t, err)
+		require.Equal(t, "ab", string(buf))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		privKey, _, err := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+		require.NoError(t, err)
+		_, err = New(privKey, nil, nil, nil, WithMaxStreams(0))
+		require.Error(t, err)
+	})
+}
+
+// recordingRelayAddressGenerator records the relay addresses allocated by a TURN server
+type recordingRelayAddressGenerator struct {
+	*turn.RelayAddressGeneratorStatic
+
+	mu     sync.Mutex
+	relays []net.Addr
+}
+
+func (g *recordingRelayAddressGenerator) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	conn, addr, err := g.RelayAddressGeneratorStatic.AllocatePacketConn(network, requestedPort)
+	if err == nil {
+		g.mu.Lock()
+		g.relays = append(g.relays, addr)
+		g.mu.Unlock()
+	}
+	return conn, addr, err
+}
+
+func (g *recordingRelayAddressGenerator) Relays() []net.Addr {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]net.Addr(nil), g.relays...)
+}
+
+// newTURNServer starts a TURN server on the loopback address that accepts the credentials for
+// which authenticate returns the password.
+func newTURNServer(t *testing.T, authenticate func(username string) (password string, ok bool)) (url string, relays *recordingRelayAddressGenerator) {
+	t.Helper()
+	const realm = "libp2p.test"
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	relays = &recordingRelayAddressGenerator{
+		RelayAddressGeneratorStatic: &turn.RelayAddressGeneratorStatic{
+			RelayAddress: net.ParseIP("127.0.0.1"),
+			Address:      "127.0.0.1",
+		},
+	}
+	s, err := turn.NewServer(turn.ServerConfig{
+		Realm:         realm,
+		LoggerFactory: pionLoggerFactory,
+		AuthHandler: func(username, realm string, _ net.Addr) ([]byte, bool) {
+			password, ok := authenticate(username)
+			if !ok {
+				return nil, false
+			}
+			return turn.GenerateAuthKey(username, realm, password), true
+		},
+		PacketConnConfigs: []turn.PacketConnConfig{{
+			PacketConn:            conn,
+			RelayAddressGenerator: relays,
+		}},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return fmt.Sprintf("turn:%s?transport=udp", conn.LocalAddr()), relays
+}
+
+func TestDialThroughTURNRelay(t *testing.T) {
+	turnURL, relays := newTURNServer(t, func(username string) (string, bool) {
+		return "password", username == "user"
+	})
+
+	listenTransport, listeningPeer := getTransport(t)
+	ln, err := listenTransport.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/webrtc-direct"))
+	require.NoError(t, err)
+	defer ln.Close()
+
+	dialTransport, _ := getTransport(t,
+		WithICEServers([]webrtc.ICEServer{{
+			URLs:           []string{turnURL},
+			Username:       "user",
+			Credential:     "password",
+			CredentialType: webrtc.ICECredentialTypePassword,
+		}}),
+		WithICETransportPolicy(webrtc.ICETransportPolicyRelay),
+	)
+
+	acceptCh := make(chan tpt.CapableConn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if !assert.NoError(t, err) {
+			return
+		}
+		acceptCh <- conn
+	}()
+
+	conn, err := dialTransport.Dial(context.Background(), ln.Multiaddr(), listeningPeer)
+	require.NoError(t, err)
+	defer conn.Close()
+	var lconn tpt.CapableConn
+	select {
+	case lconn = <-acceptCh:
+	case <-time.After(10 * time.Second):
+		t.Fatal("listener didn't accept the connection")
+	}
+	defer lconn.Close()
+
+	// The listener sees the connection coming from the relay address allocated by the TURN server.
+	allocated := relays.Relays()
+	require.NotEmpty(t, allocated)
+	var fromRelay bool
+	for _, a := range allocated {
+		relayAddr, err := manet.FromNetAddr(a)
+		require.NoError(t, err)
+		if relayAddr.Equal(lconn.RemoteMultiaddr()) {
+			fromRelay = true
+		}
+	}
+	require.True(t, fromRelay, "connection from %s didn't traverse a relay %v", lconn.RemoteMultiaddr(), allocated)
+	types, err := conn.(CandidateTypesConn).SelectedCandidateTypes()
+	require.NoError(t, err)
+	require.Equal(t, webrtc.ICECandidateTypeRelay, types.Local)
+	require.True(t, types.IsRelayed())
+
+	// The connection works through the relay.
+	str, err := conn.OpenStream(context.Background())
+	require.NoError(t, err)
+	defer str.Close()
+	_, err = str.Write([]byte("hello"))
+	require.NoError(t, err)
+	lstr, err := lconn.AcceptStream()
+	require.NoError(t, err)
+	defer lstr.Close()
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(lstr, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+}
+
+func TestICEServersFunc(t *testing.T) {
+	// The credentials are refreshed on every dial. The TURN server only accepts the current ones.
+	var current atomic.Int32
+	var used sync.Map
+	turnURL, _ := newTURNServer(t, func(username string) (string, bool) {
+		used.Store(username, struct{}{})
+		return "password-" + username, username == fmt.Sprintf("user-%d", current.Load())
+	})
+
+	listenTransport, listeningPeer := getTransport(t)
+	ln, err := listenTransport.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/webrtc-direct"))
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	dialTransport, _ := getTransport(t,
+		WithICEServersFunc(func() ([]webrtc.ICEServer, error) {
+			username := fmt.Sprintf("user-%d", current.Add(1))
+			return []webrtc.ICEServer{{
+				URLs:           []string{turnURL},
+				Username:       username,
+				Credential:     "password-" + username,
+				CredentialType: webrtc.ICECredentialTypePassword,
+			}}, nil
+		}),
+		WithICETransportPolicy(webrtc.ICETransportPolicyRelay),
+	)
+	for i := 1; i <= 2; i++ {
+		conn, err := dialTransport.Dial(context.Background(), ln.Multiaddr(), listeningPeer)
+		require.NoError(t, err)
+		conn.Close()
+		_, ok := used.Load(fmt.Sprintf("user-%d", i))
+		require.True(t, ok, "credentials of dial %d weren't used", i)
+	}
+
+	// If the func fails, the dial uses the static ICE servers
+	dialTransport, _ = getTransport(t, WithICEServersFunc(func() ([]webrtc.ICEServer, error) {
+		return nil, errors.New("TURN credentials unavailable")
+	}))
+	conn, err := dialTransport.Dial(context.Background(), ln.Multiaddr(), listeningPeer)
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestUnreachableTURNServer(t *testing.T) {
+	// find a port without a TURN server
+	c, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	unreachable := webrtc.ICEServer{
+		URLs:           []string{fmt.Sprintf("turn:%s?transport=udp", c.LocalAddr())},
+		Username:       "user",
+		Credential:     "password",
+		CredentialType: webrtc.ICECredentialTypePassword,
+	}
+	require.NoError(t, c.Close())
+
+	listenTransport, listeningPeer := getTransport(t)
+	ln, err := listenTransport.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/webrtc-direct"))
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	// The dial falls back to the host candidates
+	dialTransport, _ := getTransport(t, WithICEServers([]webrtc.ICEServer{unreachable}))
+	conn, err := dialTransport.Dial(context.Background(), ln.Multiaddr(), listeningPeer)
+	require.NoError(t, err)
+	conn.Close()
+
+	// Without host candidates, the dial fails
+	dialTransport, _ = getTransport(t,
+		WithICEServers([]webrtc.ICEServer{unreachable}),
+		WithICETransportPolicy(webrtc.ICETransportPolicyRelay),
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err = dialTransport.Dial(ctx, ln.Multiaddr(), listeningPeer)
+	require.Error(t, err)
+}
+
+func TestWithICETransportPolicy(t *testing.T) {
+	privKey, _, err := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	require.NoError(t, err)
+	_, err = New(privKey, nil, nil, nil, WithICETransportPolicy(webrtc.ICETransportPolicy(5)))
+	require.Error(t, err)
+	// relay candidates require a TURN server
+	_, err = New(privKey, nil, nil, nil, WithICETransportPolicy(webrtc.ICETransportPolicyRelay))
+	require.Error(t, err)
+	_, err = New(privKey, nil, nil, nil,
+		WithICEServers([]webrtc.ICEServer{{URLs: []string{"stun:stun.example.com:3478"}}}),
+		WithICETransportPolicy(webrtc.ICETransportPolicyRelay))
+	require.Error(t, err)
+}
+
+func TestWithCertificate(t *testing.T) {
+	cert, err := generateCertificate()
+	require.NoError(t, err)
+	tr, _ := getTransport(t, WithCertificate(*cert))
+
+	fp, err := getCertificateFingerprint(*cert)
+	require.NoError(t, err)
+	encodedFp, err := encodeDTLSFingerprint(fp)
+	require.NoError(t, err)
+
+	ln, err := tr.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/webrtc-direct"))
+	require.NoError(t, err)
+	defer ln.Close()
+	certhash, err := ln.Multiaddr().ValueForProtocol(ma.P_CERTHASH)
+	require.NoError(t, err)
+	require.Equal(t, encodedFp, certhash)
+}
+
+func TestCertRotation(t *testing.T) {
+	tr, listeningPeer := getTransport(t, WithCertRotation(300*time.Millisecond))
+	defer tr.Close()
+	tr1, _ := getTransport(t)
+
+	ln, err := tr.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/webrtc-direct"))
+	require.NoError(t, err)
+	defer ln.Close()
+
+	dial := func(addr ma.Multiaddr) (tpt.CapableConn, tpt.CapableConn) {
+		t.Helper()
+		accepted := make(chan tpt.CapableConn, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}()
+		conn, err := tr1.Dial(context.Background(), addr, listeningPeer)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		select {
+		case lconn := <-accepted:
+			t.Cleanup(func() { lconn.Close() })
+			return conn, lconn
+		case <-time.After(10 * time.Second):
+			t.Fatal("listener didn't accept the connection")
+			return nil, nil
+		}
+	}
+
+	oldAddr := ln.Multiaddr()
+	oldConn, oldLConn := dial(oldAddr)
+
+	require.Eventually(t, func() bool { return !ln.Multiaddr().Equal(oldAddr) }, 5*time.Second, 50*time.Millisecond)
+	oldCerthash, err := oldAddr.ValueForProtocol(ma.P_CERTHASH)
+	require.NoError(t, err)
+	newCerthash, err := ln.Multiaddr().ValueForProtocol(ma.P_CERTHASH)
+	require.NoError(t, err)
+	require.NotEqual(t, oldCerthash, newCerthash)
+
+	// connections established before the rotation keep working
+	str, err := oldConn.OpenStream(context.Background())
+	require.NoError(t, err)
+	_, err = str.Write([]byte("test"))
+	require.NoError(t, err)
+	lstr, err := oldLConn.AcceptStream()
+	require.NoError(t, err)
+	buf := make([]byte, 100)
+	lstr.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, err := lstr.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "test", string(buf[:n]))
+
+	// new connections use the new certificate
+	dial(ln.Multiaddr())
+}
+
+func TestCertRotationInvalid(t *testing.T) {
+	privKey, _, err := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	require.NoError(t, err)
+	_, err = New(privKey, nil, nil, nil, WithCertRotation(0))
+	require.Error(t, err)
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	for _, size := range []int{0, 4 << 10, 64 << 10} {
+		t.Run(fmt.Sprintf("size=%d", size), func(t *testing.T) {
+			var opts []Option
+			msgSize := maxMessageSize
+			if size != 0 {
+				opts = append(opts, WithMaxMessageSize(size))
+				msgSize = size
+			}
+			tr, listeningPeer := getTransport(t, opts...)
+			tr1, _ := getTransport(t, opts...)
+			ln, err := tr.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/webrtc-direct"))
+			require.NoError(t, err)
+			defer ln.Close()
+
+			payload := make([]byte, 3*msgSize+17)
+			_, err = rand.Read(payload)
+			require.NoError(t, err)
+
+			errC := make(chan error, 1)
+			go func() {
+				errC <- func() error {
+					conn, err := tr1.Dial(context.Background(), ln.Multiaddr(), listeningPeer)
+					if err != nil {
+						return err
+					}
+					t.Cleanup(func() { conn.Close() })
+					str, err := conn.OpenStream(context.Background())
+					if err != nil {
+						return err
+					}
+					if _, err := str.Write(payload); err != nil {
+						return err
+					}
+					return str.CloseWrite()
+				}()
+			}()
+
+			conn, err := ln.Accept()
+			require.NoError(t, err)
+			defer conn.Close()
+			str, err := conn.AcceptStream()
+			require.NoError(t, err)
+			str.SetReadDeadline(time.Now().Add(10 * time.Second))
+			b, err := io.ReadAll(str)
+			require.NoError(t, err)
+			require.Equal(t, payload, b)
+			require.NoError(t, <-errC)
+		})
+	}
+}
+
+func TestMaxMessageSizeInvalid(t *testing.T) {
+	privKey, _, err := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	require.NoError(t, err)
+	for _, size := range []int{minMessageSize - 1, maxSCTPMessageSize + 1} {
+		_, err = New(privKey, nil, nil, nil, WithMaxMessageSize(size))
+		require.Error(t, err)
+	}
+}
+
+func TestSCTPBufferThresholds(t *testing.T) {
+	const high, low = 8 << 10, 2 << 10
+	tr, listeningPeer := getTransport(t)
+	tr1, _ := getTransport(t, WithSCTPBufferThresholds(high, low))
+	ln, err := tr.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/webrtc-direct"))
+	require.NoError(t, err)
+	defer ln.Close()
+
+	conn, err := tr1.Dial(context.Background(), ln.Multiaddr(), listeningPeer)
+	require.NoError(t, err)
+	defer conn.Close()
+	str, err := conn.OpenStream(context.Background())
+	require.NoError(t, err)
+
+	// The payload is larger than the receive buffer, so the writer must block until the
+	// reader drains the stream.
+	payload := make([]byte, 2<<20)
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := str.Write(payload)
+		writeErr <- err
+	}()
+
+	lconn, err := ln.Accept()
+	require.NoError(t, err)
+	defer lconn.Close()
+	lstr, err := lconn.AcceptStream()
+	require.NoError(t, err)
+
+	dc := str.(*stream).dataChannel
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		require.LessOrEqual(t, dc.BufferedAmount(), uint64(high))
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case err := <-writeErr:
+		t.Fatalf("expected the write to block, got: %v", err)
+	default:
+	}
+
+	lstr.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, err = io.ReadFull(lstr, make([]byte, len(payload)))
+	require.NoError(t, err)
+	select {
+	case err := <-writeErr:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the write to resume")
+	}
+}
+
+func TestSCTPBufferThresholdsInvalid(t *testing.T) {
+	privKey, _, err := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	require.NoError(t, err)
+	for _, th := range []struct{ high, low int }{
+		{high: 4 << 10, low: 8 << 10},
+		{high: 4 << 10, low: 4 << 10},
+		{high: 4 << 10, low: 4<<10 - minMessageSize + 1},
+		{high: 4 << 10, low: -1},
+	} {
+		_, err = New(privKey, nil, nil, nil, WithSCTPBufferThresholds(th.high, th.low))
+		require.Error(t, err)
+	}
+	_, err = New(privKey, nil, nil, nil, WithSCTPBufferThresholds(4<<10, 4<<10-minMessageSize))
+	require.NoError(t, err)
+}
+
+func TestAnnounceAddr(t *testing.T) {
+	tr, listeningPeer := getTransport(t, WithAnnounceAddr(ma.StringCast("/ip4/192.0.2.1/udp/9000")))
+	ln, err := tr.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/webrtc-direct"))
+	require.NoError(t, err)
+	defer ln.Close()
+
+	announced, certhash := ma.SplitFunc(ln.Multiaddr(), func(c ma.Component) bool { return c.Protocol().Code == ma.P_CERTHASH })
+	require.Equal(t, ma.StringCast("/ip4/192.0.2.1/udp/9000/webrtc-direct"), announced)
+	require.NotNil(t, certhash)
+	require.True(t, ln.Addr().(*net.UDPAddr).IP.IsLoopback())
+
+	// connections are accepted on the local socket
+	localAddr, err := manet.FromNetAddr(ln.Addr())
+	require.NoError(t, err)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+	}()
+	tr1, _ := getTransport(t)
+	conn, err := tr1.Dial(context.Background(), localAddr.Encapsulate(ma.StringCast("/webrtc-direct")).Encapsulate(certhash), listeningPeer)
+	require.NoError(t, err)
+	conn.Close()
+
+	t.Run("different address family", func(t *testing.T) {
+		tr, _ := getTransport(t, WithAnnounceAddr(ma.StringCast("/ip6/2001:db8::1/udp/9000")))
+		ln, err := tr.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/webrtc-direct"))
+		require.NoError(t, err)
+		defer ln.Close()
+		require.Equal(t, "127.0.0.1", ln.Addr().(*net.UDPAddr).IP.String())
+		ip, err := ln.Multiaddr().ValueForProtocol(ma.P_IP4)
+		require.NoError(t, err)
+		require.Equal(t, "127.0.0.1", ip)
+	})
+
+	t.Run("with certhash", func(t *testing.T) {
+		tr, _ := getTransport(t, WithAnnounceAddr(ln.Multiaddr()))
+		ln1, err := tr.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/webrtc-direct"))
+		require.NoError(t, err)
+		defer ln1.Close()
+		expected, ok := tr.AddCertHashes(ma.StringCast("/ip4/192.0.2.1/udp/9000/webrtc-direct"))
+		require.True(t, ok)
+		require.Equal(t, expected, ln1.Multiaddr())
+	})
+}
+
+func TestAnnounceAddrInvalid(t *testing.T) {
+	privKey, _, err := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	require.NoError(t, err)
+	for _, addr := range []string{
+		"/ip4/192.0.2.1/tcp/9000",
+		"/dns4/example.com/udp/9000",
+		"/ip4/0.0.0.0/udp/9000",
+		"/ip4/192.0.2.1/udp/0",
+	} {
+		_, err = New(privKey, nil, nil, nil, WithAnnounceAddr(ma.StringCast(addr)))
+		require.Error(t, err, addr)
+	}
+}
+
+func TestConnectionStats(t *testing.T) {
+	tr, listeningPeer := getTransport(t)
+	tr1, _ := getTransport(t)
+	ln, err := tr.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/webrtc-direct"))
+	require.NoError(t, err)
+	defer ln.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+		str, err := conn.AcceptStream()
+		if err != nil {
+			done <- err
+			return
+		}
+		_, err = io.Copy(io.Discard, str)
+		done <- err
+	}()
+
+	conn, err := tr1.Dial(context.Background(), ln.Multiaddr(), listeningPeer)
+	require.NoError(t, err)
+	defer conn.Close()
+	str, err := conn.OpenStream(context.Background())
+	require.NoError(t, err)
+	_, err = str.Write(make([]byte, 100<<10))
+	require.NoError(t, err)
+	require.NoError(t, str.CloseWrite())
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("transfer timed out")
+	}
+
+	statsConn, ok := conn.(StatsConn)
+	require.True(t, ok)
+	stats, err := statsConn.Stats()
+	require.NoError(t, err)
+	require.Greater(t, stats.BytesSent, uint64(100<<10))
+	require.NotZero(t, stats.BytesReceived)
+	require.Greater(t, stats.DataBytesSent, uint64(100<<10))
+	require.NotZero(t, stats.DataBytesReceived)
+	require.NotNil(t, stats.LocalCandidate)
+	require.True(t, ln.Multiaddr().Decapsulate(ma.StringCast("/webrtc-direct")).Equal(stats.RemoteCandidate))
+
+	conn.Close()
+	_, err = statsConn.Stats()
+	require.Error(t, err)
+}
+
+func TestSelectedCandidateTypes(t *testing.T) {
+	tr, listeningPeer := getTransport(t)
+	tr1, _ := getTransport(t)
+	ln, err := tr.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/webrtc-direct"))
+	require.NoError(t, err)
+	defer ln.Close()
+
+	acceptCh := make(chan tpt.CapableConn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if !assert.NoError(t, err) {
+			return
+		}
+		acceptCh <- conn
+	}()
+
+	conn, err := tr1.Dial(context.Background(), ln.Multiaddr(), listeningPeer)
+	require.NoError(t, err)
+	defer conn.Close()
+	var accepted tpt.CapableConn
+	select {
+	case accepted = <-acceptCh:
+	case <-time.After(10 * time.Second):
+		t.Fatal("listener didn't accept the connection")
+	}
+	defer accepted.Close()
+
+	ctConn, ok := conn.(CandidateTypesConn)
+	require.True(t, ok)
+	types, err := ctConn.SelectedCandidateTypes()
+	require.NoError(t, err)
+	require.Equal(t, CandidateTypes{Local: webrtc.ICECandidateTypeHost, Remote: webrtc.ICECandidateTypeHost}, types)
+	require.False(t, types.IsRelayed())
+
+	// the listener learns the dialer's candidate from the connectivity checks
+	ctConn, ok = accepted.(CandidateTypesConn)
+	require.True(t, ok)
+	types, err = ctConn.SelectedCandidateTypes()
+	require.NoError(t, err)
+	require.Equal(t, CandidateTypes{Local: webrtc.ICECandidateTypeHost, Remote: webrtc.ICECandidateTypePrflx}, types)
+
+	conn.Close()
+	_, err = conn.(CandidateTypesConn).SelectedCandidateTypes()
+	require.Error(t, err)
+}
+
+type handshakeTracer struct {
+	mx      sync.Mutex
+	timings map[network.Direction][]HandshakeTimings
+}
+
+var _ HandshakeTracer = &handshakeTracer{}
+
+func (t *handshakeTracer) HandshakeCompleted(dir network.Direction, timings HandshakeTimings) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	if t.timings == nil {
+		t.timings = make(map[network.Direction][]HandshakeTimings)
+	}
+	t.timings[dir] = append(t.timings[dir], timings)
+}
+
+func (t *handshakeTracer) get(dir network.Direction) []HandshakeTimings {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	return t.timings[dir]
+}
+
+func TestHandshakeTimings(t *testing.T) {
+	listenerTracer := &handshakeTracer{}
+	dialerTracer := &handshakeTracer{}
+	tr, listeningPeer := getTransport(t, WithHandshakeTracer(listenerTracer))
+	tr1, _ := getTransport(t, WithHandshakeTracer(dialerTracer))
+	ln, err := tr.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/webrtc-direct"))
+	require.NoError(t, err)
+	defer ln.Close()
+
+	accepted := make(chan tpt.CapableConn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		accepted <- conn
+	}()
+
+	conn, err := tr1.Dial(context.Background(), ln.Multiaddr(), listeningPeer)
+	require.NoError(t, err)
+	defer conn.Close()
+	var lconn tpt.CapableConn
+	select {
+	case lconn = <-accepted:
+		defer lconn.Close()
+	case <-time.After(10 * time.Second):
+		t.Fatal("accept timed out")
+	}
+
+	requirePositive := func(timings HandshakeTimings) {
+		t.Helper()
+		require.Positive(t, timings.ICE)
+		require.Positive(t, timings.DTLS)
+		require.Positive(t, timings.SCTP)
+		require.Positive(t, timings.Noise)
+	}
+	for _, c := range []tpt.CapableConn{conn, lconn} {
+		tc, ok := c.(HandshakeTimingsConn)
+		require.True(t, ok)
+		requirePositive(tc.HandshakeTimings())
+	}
+
+	require.Len(t, dialerTracer.get(network.DirOutbound), 1)
+	require.Empty(t, dialerTracer.get(network.DirInbound))
+	require.Equal(t, conn.(HandshakeTimingsConn).HandshakeTimings(), dialerTracer.get(network.DirOutbound)[0])
+	require.Len(t, listenerTracer.get(network.DirInbound), 1)
+	require.Empty(t, listenerTracer.get(network.DirOutbound))
+	require.Equal(t, lconn.(HandshakeTimingsConn).HandshakeTimings(), listenerTracer.get(network.DirInbound)[0])
+}
+
+func TestStreamResetterOnConn(t *testing.T) {
+	tr, listeningPeer := getTransport(t)
+	tr1, _ := getTransport(t)
+	ln, err := tr.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/webrtc-direct"))
+	require.NoError(t, err)
+	defer ln.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+		str, err := conn.AcceptStream()
+		if err != nil {
+			done <- err
+			return
+		}
+		_, err = io.ReadAll(str)
+		done <- err
+	}()
+
+	conn, err := tr1.Dial(context.Background(), ln.Multiaddr(), listeningPeer)
+	require.NoError(t, err)
+	defer conn.Close()
+	str, err := conn.OpenStream(context.Background())
+	require.NoError(t, err)
+	_, err = str.Write([]byte("foobar"))
+	require.NoError(t, err)
+	resetter, ok := str.(StreamResetter)
+	require.True(t, ok)
+	require.NoError(t, resetter.ResetWithError(42))
+
+	select {
+	case err := <-done:
+		var streamErr *StreamError
+		require.ErrorAs(t, err, &streamErr)
+		require.Equal(t, &StreamError{ErrorCode: 42, Remote: true}, streamErr)
+		require.ErrorIs(t, err, network.ErrReset)
+	case <-time.After(10 * time.Second):
+		t.Fatal("reset wasn't received")
+	}
+}
+
+//go:generate sh -c "go run go.uber.org/mock/mockgen -package libp2pwebrtc -destination mock_connection_gater_test.go github.com/libp2p/go-libp2p/core/connmgr ConnectionGater && go run golang.org/x/tools/cmd/goimports -w mock_connection_gater_test.go"
+
+func TestConnectionGaterInterceptSecuredInbound(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	connGater := NewMockConnectionGater(ctrl)
+	rcmgr := mocknetwork.NewMockResourceManager(ctrl)
+	scope := mocknetwork.NewMockConnManagementScope(ctrl)
+
+	privKey, _, err := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	require.NoError(t, err)
+	listeningPeer, err := peer.IDFromPrivateKey(privKey)
+	require.NoError(t, err)
+	tr, err := New(privKey, nil, connGater, rcmgr)
+	require.NoError(t, err)
+	ln, err := tr.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/webrtc-direct"))
+	require.NoError(t, err)
+	defer ln.Close()
+	tr1, connectingPeer := getTransport(t)
+
+	done := make(chan struct{})
+	connGater.EXPECT().InterceptAccept(gomock.Any()).Return(true)
+	rcmgr.EXPECT().OpenConnection(network.DirInbound, false, gomock.Any()).Return(scope, nil)
+	scope.EXPECT().ReserveMemory(gomock.Any(), gomock.Any()).Return(nil)
+	connGater.EXPECT().InterceptSecured(network.DirInbound, connectingPeer, gomock.Any()).DoAndReturn(
+		func(_ network.Direction, _ peer.ID, addrs network.ConnMultiaddrs) bool {
+			_, err := addrs.LocalMultiaddr().ValueForProtocol(ma.P_CERTHASH)
+			require.Error(t, err, "expected the local address without the certhash")
+			return false
+		})
+	// The gated connection must not be attributed to the peer, and its resources must be released.
+	scope.EXPECT().Done().Do(func() { close(done) })
+
+	go func() {
+		conn, err := tr1.Dial(context.Background(), ln.Multiaddr(), listeningPeer)
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the connection scope to be released")
+	}
+
+	accepted := make(chan struct{})
+	go func() {
+		if _, err := ln.Accept(); err == nil {
+			close(accepted)
+		}
+	}()
+	select {
+	case <-accepted:
+		t.Fatal("gated connection was accepted")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestConnectionGaterInterceptSecuredOutbound(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	connGater := NewMockConnectionGater(ctrl)
+	rcmgr := mocknetwork.NewMockResourceManager(ctrl)
+	scope := mocknetwork.NewMockConnManagementScope(ctrl)
+
+	tr, listeningPeer := getTransport(t)
+	ln, err := tr.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/webrtc-direct"))
+	require.NoError(t, err)
+	defer ln.Close()
+
+	privKey, _, err := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	require.NoError(t, err)
+	tr1, err := New(privKey, nil, connGater, rcmgr)
+	require.NoError(t, err)
+
+	rcmgr.EXPECT().OpenConnection(network.DirOutbound, false, gomock.Any()).Return(scope, nil)
+	scope.EXPECT().SetPeer(listeningPeer).Return(nil)
+	scope.EXPECT().ReserveMemory(gomock.Any(), gomock.Any()).Return(nil)
+	connGater.EXPECT().InterceptSecured(network.DirOutbound, listeningPeer, gomock.Any()).DoAndReturn(
+		func(_ network.Direction, _ peer.ID, addrs network.ConnMultiaddrs) bool {
+			_, err := addrs.RemoteMultiaddr().ValueForProtocol(ma.P_CERTHASH)
+			require.Error(t, err, "expected the remote address without the certhash")
+			return false
+		})
+	scope.EXPECT().Done()
+
+	_, err = tr1.Dial(context.Background(), ln.Multiaddr(), listeningPeer)
+	require.ErrorContains(t, err, "gated")
+}
+
+func TestCandidateFilter(t *testing.T) {
+	isLoopbackOrLinkLocal := func(addr ma.Multiaddr) bool {
+		return manet.IsIPLoopback(addr) || manet.IsIP6LinkLocal(addr) || strings.HasPrefix(addr.String(), "/ip4/169.254.")
+	}
+
+	t.Run("listen", func(t *testing.T) {
+		tr, _ := getTransport(t, WithCandidateFilter(func(addr ma.Multiaddr) bool { return !isLoopbackOrLinkLocal(addr) }))
+		_, err := tr.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/webrtc-direct"))
+		require.Error(t, err)
+		_, err = tr.Listen(ma.StringCast("/ip6/::1/udp/0/webrtc-direct"))
+		require.Error(t, err)
+	})
+
+	t.Run("listen on unspecified address", func(t *testing.T) {
+		var dialAddr ma.Multiaddr
+		ifaceAddrs, err := manet.InterfaceMultiaddrs()
+		require.NoError(t, err)
+		for _, a := range ifaceAddrs {
+			if _, err := a.ValueForProtocol(ma.P_IP4); err == nil && !isLoopbackOrLinkLocal(a) {
+				dialAddr = a
+				break
+			}
+		}
+		if dialAddr == nil {
+			t.Skip("no IPv4 interface address that isn't loopback or link-local")
+		}
+
+		tr, listeningPeer := getTransport(t, WithCandidateFilter(func(addr ma.Multiaddr) bool { return !isLoopbackOrLinkLocal(addr) }))
+		ln, err := tr.Listen(ma.StringCast("/ip4/0.0.0.0/udp/0/webrtc-direct"))
+		require.NoError(t, err)
+		defer ln.Close()
+		_, port, err := net.SplitHostPort(ln.Addr().String())
+		require.NoError(t, err)
+		certhash, err := ln.Multiaddr().ValueForProtocol(ma.P_CERTHASH)
+		require.NoError(t, err)
+		dialAddr = dialAddr.Encapsulate(ma.StringCast(fmt.Sprintf("/udp/%s/webrtc-direct/certhash/%s", port, certhash)))
+
+		accepted := make(chan tpt.CapableConn, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}()
+
+		tr1, _ := getTransport(t)
+		conn, err := tr1.Dial(context.Background(), dialAddr, listeningPeer)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		var lconn tpt.CapableConn
+		select {
+		case lconn = <-accepted:
+			defer lconn.Close()
+		case <-time.After(10 * time.Second):
+			t.Fatal("listener didn't accept the connection")
+		}
+
+		// The answer only contains candidates on addresses the filter allows.
+		var numCandidates int
+		for _, line := range strings.Split(lconn.(*connection).pc.LocalDescription().SDP, "\r\n") {
+			if !strings.HasPrefix(line, "a=candidate:") {
+				continue
+			}
+			numCandidates++
+			fields := strings.Fields(line)
+			require.GreaterOrEqual(t, len(fields), 6)
+			ip := net.ParseIP(fields[4])
+			require.NotNil(t, ip, "unexpected candidate %s", line)
+			require.False(t, ip.IsLoopback(), "unexpected loopback candidate %s", line)
+			require.False(t, ip.IsUnspecified(), "unexpected unspecified candidate %s", line)
+			require.False(t, ip.IsLinkLocalUnicast(), "unexpected link-local candidate %s", line)
+		}
+		require.NotZero(t, numCandidates)
+
+		// The connection works with multiple candidates sharing the socket.
+		str, err := conn.OpenStream(context.Background())
+		require.NoError(t, err)
+		defer str.Close()
+		_, err = str.Write([]byte("hello"))
+		require.NoError(t, err)
+		lstr, err := lconn.AcceptStream()
+		require.NoError(t, err)
+		defer lstr.Close()
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(lstr, buf)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(buf))
+	})
+
+	t.Run("dial", func(t *testing.T) {
+		tr, listeningPeer := getTransport(t)
+		ln, err := tr.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/webrtc-direct"))
+		require.NoError(t, err)
+		defer ln.Close()
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}()
+
+		// Only allow IPv4 addresses that aren't link-local. This keeps the loopback address,
+		// which is required to connect to the listener.
+		tr1, _ := getTransport(t, WithCandidateFilter(func(addr ma.Multiaddr) bool {
+			if strings.HasPrefix(addr.String(), "/ip4/169.254.") {
+				return false
+			}
+			_, err := addr.ValueForProtocol(ma.P_IP4)
+			return err == nil
+		}))
+		conn, err := tr1.Dial(context.Background(), ln.Multiaddr(), listeningPeer)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		var numCandidates int
+		for _, line := range strings.Split(conn.(*connection).pc.LocalDescription().SDP, "\r\n") {
+			if !strings.HasPrefix(line, "a=candidate:") {
+				continue
+			}
+			numCandidates++
+			// a=candidate:<foundation> <component> <protocol> <priority> <address> <port> typ <type>
+			fields := strings.Fields(line)
+			require.GreaterOrEqual(t, len(fields), 6)
+			ip := net.ParseIP(fields[4])
+			require.NotNil(t, ip, "unexpected candidate %s", line)
+			require.NotNil(t, ip.To4(), "unexpected IPv6 candidate %s", line)
+			require.False(t, ip.IsLinkLocalUnicast(), "unexpected link-local candidate %s", line)
+		}
+		require.NotZero(t, numCandidates)
+	})
+}
+
+func TestWithPacketConn(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer conn.Close()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	tr, listeningPeer := getTransport(t, WithPacketConn(conn))
+
+	t.Run("mismatched address", func(t *testing.T) {
+		_, err := tr.Listen(ma.StringCast(fmt.Sprintf("/ip4/127.0.0.1/udp/%d/webrtc-direct", port+1)))
+		require.ErrorContains(t, err, "doesn't match the packet conn address")
+		_, err = tr.Listen(ma.StringCast("/ip4/127.0.0.2/udp/0/webrtc-direct"))
+		require.ErrorContains(t, err, "doesn't match the packet conn address")
+		_, err = tr.Listen(ma.StringCast("/ip6/::/udp/0/webrtc-direct"))
+		require.ErrorContains(t, err, "doesn't match the packet conn address")
+	})
+
+	t.Run("listen and accept", func(t *testing.T) {
+		for _, laddr := range []string{
+			fmt.Sprintf("/ip4/127.0.0.1/udp/%d/webrtc-direct", port),
+			"/ip4/0.0.0.0/udp/0/webrtc-direct",
+		} {
+			ln, err := tr.Listen(ma.StringCast(laddr))
+			require.NoError(t, err)
+			require.Equal(t, conn.LocalAddr().String(), ln.Addr().String())
+			require.Equal(t, port, mustUDPPort(t, ln.Multiaddr()))
+
+			_, err = tr.Listen(ma.StringCast(laddr))
+			require.ErrorContains(t, err, "already used by a listener")
+
+			acceptCh := make(chan tpt.CapableConn, 1)
+			go func() {
+				c, err := ln.Accept()
+				if !assert.NoError(t, err) {
+					return
+				}
+				acceptCh <- c
+			}()
+
+			tr1, _ := getTransport(t)
+			dialed, err := tr1.Dial(context.Background(), ln.Multiaddr(), listeningPeer)
+			require.NoError(t, err)
+			select {
+			case accepted := <-acceptCh:
+				require.Equal(t, port, mustUDPPort(t, accepted.LocalMultiaddr()))
+				accepted.Close()
+			case <-time.After(10 * time.Second):
+				t.Fatal("listener didn't accept the connection")
+			}
+			dialed.Close()
+
+			// Closing the listener leaves the socket open, so it can be listened on again.
+			require.NoError(t, ln.Close())
+			require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Millisecond)))
+			_, _, err = conn.ReadFrom(make([]byte, 1500))
+			require.NotErrorIs(t, err, net.ErrClosed)
+			require.NoError(t, conn.SetReadDeadline(time.Time{}))
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		privKey, _, err := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+		require.NoError(t, err)
+		_, err = New(privKey, nil, nil, &network.NullResourceManager{}, WithPacketConn(nil))
+		require.Error(t, err)
+	})
+}
+
+func mustUDPPort(t *testing.T, addr ma.Multiaddr) int {
+	t.Helper()
+	p, err := addr.ValueForProtocol(ma.P_UDP)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(p)
+	require.NoError(t, err)
+	return port
+}
+
+// listenerGoroutines returns the number of goroutines running listener code.
+func listenerGoroutines() int {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	var count int
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		if strings.Contains(g, "libp2pwebrtc.(*listener)") {
+			count++
+		}
+	}
+	return count
+}
+
+func TestListenerCloseWithGrace(t *testing.T) {
+	// newListener returns a listener whose inbound handshakes block in the InterceptSecured
+	// gater call until release is closed. entered is closed once a handshake blocks.
+	newListener := func(t *testing.T) (ln GracefulListener, listeningPeer peer.ID, entered, release chan struct{}) {
+		ctrl := gomock.NewController(t)
+		connGater := NewMockConnectionGater(ctrl)
+		entered = make(chan struct{})
+		release = make(chan struct{})
+		var once sync.Once
+		connGater.EXPECT().InterceptAccept(gomock.Any()).Return(true).AnyTimes()
+		connGater.EXPECT().InterceptSecured(network.DirInbound, gomock.Any(), gomock.Any()).DoAndReturn(
+			func(network.Direction, peer.ID, network.ConnMultiaddrs) bool {
+				once.Do(func() { close(entered) })
+				<-release
+				return true
+			}).AnyTimes()
+
+		privKey, _, err := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+		require.NoError(t, err)
+		listeningPeer, err = peer.IDFromPrivateKey(privKey)
+		require.NoError(t, err)
+		tr, err := New(privKey, nil, connGater, &network.NullResourceManager{})
+		require.NoError(t, err)
+		l, err := tr.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/webrtc-direct"))
+		require.NoError(t, err)
+		return l.(GracefulListener), listeningPeer, entered, release
+	}
+
+	dial := func(t *testing.T, ln tpt.Listener, p peer.ID, timeout time.Duration) <-chan error {
+		errC := make(chan error, 1)
+		go func() {
+			dialer, _ := getTransport(t)
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			conn, err := dialer.Dial(ctx, ln.Multiaddr(), p)
+			if err == nil {
+				t.Cleanup(func() { conn.Close() })
+			}
+			errC <- err
+		}()
+		return errC
+	}
+
+	t.Run("handshake completed", func(t *testing.T) {
+		before := listenerGoroutines()
+		ln, listeningPeer, entered, release := newListener(t)
+		defer ln.Close()
+		dial(t, ln, listeningPeer, 10*time.Second)
+		select {
+		case <-entered:
+		case <-time.After(10 * time.Second):
+			t.Fatal("handshake didn't start")
+		}
+
+		closed := make(chan error, 1)
+		go func() { closed <- ln.CloseWithGrace(10 * time.Second) }()
+
+		// New connection attempts aren't handled during the grace period.
+		require.Error(t, <-dial(t, ln, listeningPeer, time.Second))
+
+		close(release)
+		conn, err := ln.Accept()
+		require.NoError(t, err)
+		conn.Close()
+		select {
+		case err := <-closed:
+			require.NoError(t, err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("CloseWithGrace didn't return after the handshake completed")
+		}
+		_, err = ln.Accept()
+		require.ErrorIs(t, err, tpt.ErrListenerClosed)
+		require.Equal(t, before, listenerGoroutines())
+	})
+
+	t.Run("handshake aborted", func(t *testing.T) {
+		before := listenerGoroutines()
+		ln, listeningPeer, entered, release := newListener(t)
+		defer ln.Close()
+		dial(t, ln, listeningPeer, 10*time.Second)
+		select {
+		case <-entered:
+		case <-time.After(10 * time.Second):
+			t.Fatal("handshake didn't start")
+		}
+
+		const grace = 200 * time.Millisecond
+		start := time.Now()
+		closed := make(chan error, 1)
+		go func() { closed <- ln.CloseWithGrace(grace) }()
+		_, err := ln.Accept()
+		require.ErrorIs(t, err, tpt.ErrListenerClosed)
+		require.GreaterOrEqual(t, time.Since(start), grace)
+
+		// Close waits for the handshake to return before closing the listener.
+		close(release)
+		select {
+		case err := <-closed:
+			require.NoError(t, err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("CloseWithGrace didn't return after the handshake was aborted")
+		}
+		require.Equal(t, before, listenerGoroutines())
+	})
+}
+
+// dialHandshakeChannel connects to ln like Dial does, up to opening the handshake data channel,
+// and returns that channel without running the Noise handshake.
+func dialHandshakeChannel(t *testing.T, ln tpt.Listener) *stream {
+	t.Helper()
+	return dialHandshakeChannelWithUfrag(t, ln, genUfrag())
+}
+
+func dialHandshakeChannelWithUfrag(t *testing.T, ln tpt.Listener, ufrag string) *stream {
+	t.Helper()
+	tr, _ := getTransport(t)
+	remoteMultihash, err := decodeRemoteFingerprint(ln.Multiaddr())
+	require.NoError(t, err)
+	w, err := newWebRTCConnection(tr.newDialSettingEngine(ufrag), tr.getDialWebRTCConfig())
+	require.NoError(t, err)
+	t.Cleanup(func() { w.PeerConnection.Close() })
+	errC := addOnConnectionStateChangeCallback(w.PeerConnection)
+
+	offer, err := w.PeerConnection.CreateOffer(nil)
+	require.NoError(t, err)
+	require.NoError(t, w.PeerConnection.SetLocalDescription(offer))
+	answer, err := createServerSDP(ln.Addr().(*net.UDPAddr), ufrag, *remoteMultihash)
+	require.NoError(t, err)
+	require.NoError(t, w.PeerConnection.SetRemoteDescription(webrtc.SessionDescription{SDP: answer, Type: webrtc.SDPTypeAnswer}))
+	select {
+	case err := <-errC:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("peer connection didn't connect")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	detached, err := detachHandshakeDataChannel(ctx, w.HandshakeDataChannel)
+	require.NoError(t, err)
+	return newStream(w.HandshakeDataChannel, detached, maxMessageSize, func() {})
+}
+
+type handshakeErrorReport struct {
+	remote net.Addr
+	phase  string
+	err    error
+}
+
+func TestOnHandshakeError(t *testing.T) {
+	newListener := func(t *testing.T, gater connmgr.ConnectionGater) (tpt.Listener, peer.ID, <-chan handshakeErrorReport) {
+		reports := make(chan handshakeErrorReport, 10)
+		privKey, _, err := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+		require.NoError(t, err)
+		listeningPeer, err := peer.IDFromPrivateKey(privKey)
+		require.NoError(t, err)
+		tr, err := New(privKey, nil, gater, &network.NullResourceManager{},
+			WithOnHandshakeError(func(remote net.Addr, phase string, err error) {
+				reports <- handshakeErrorReport{remote: remote, phase: phase, err: err}
+			}),
+		)
+		require.NoError(t, err)
+		ln, err := tr.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/webrtc-direct"))
+		require.NoError(t, err)
+		t.Cleanup(func() { ln.Close() })
+		return ln, listeningPeer, reports
+	}
+	requireReport := func(t *testing.T, reports <-chan handshakeErrorReport, phase string) handshakeErrorReport {
+		t.Helper()
+		select {
+		case r := <-reports:
+			require.Equal(t, phase, r.phase)
+			require.Error(t, r.err)
+			require.NotNil(t, r.remote)
+			return r
+		case <-time.After(10 * time.Second):
+			t.Fatal("handshake error not reported")
+			return handshakeErrorReport{}
+		}
+	}
+
+	t.Run("setup", func(t *testing.T) {
+		connGater := NewMockConnectionGater(gomock.NewController(t))
+		connGater.EXPECT().InterceptAccept(gomock.Any()).Return(false).AnyTimes()
+		ln, listeningPeer, reports := newListener(t, connGater)
+
+		dialer, _ := getTransport(t)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, err := dialer.Dial(ctx, ln.Multiaddr(), listeningPeer)
+		require.Error(t, err)
+		r := requireReport(t, reports, HandshakePhaseSetup)
+		require.ErrorContains(t, r.err, "connection gated")
+	})
+
+	t.Run("noise", func(t *testing.T) {
+		ln, _, reports := newListener(t, nil)
+		s := dialHandshakeChannel(t, ln)
+		// a length-prefixed message that isn't a valid Noise handshake message
+		_, err := s.Write([]byte{0, 4, 1, 2, 3, 4})
+		require.NoError(t, err)
+		r := requireReport(t, reports, HandshakePhaseNoise)
+		require.Equal(t, "127.0.0.1", r.remote.(*net.UDPAddr).IP.String())
+	})
+
+	t.Run("peer", func(t *testing.T) {
+		connGater := NewMockConnectionGater(gomock.NewController(t))
+		connGater.EXPECT().InterceptAccept(gomock.Any()).Return(true).AnyTimes()
+		connGater.EXPECT().InterceptSecured(network.DirInbound, gomock.Any(), gomock.Any()).Return(false).AnyTimes()
+		ln, listeningPeer, reports := newListener(t, connGater)
+
+		dialer, _ := getTransport(t)
+		// The dialer completes its side of the handshake before the listener rejects the
+		// connection, so the dial may succeed.
+		if conn, err := dialer.Dial(context.Background(), ln.Multiaddr(), listeningPeer); err == nil {
+			defer conn.Close()
+		}
+		r := requireReport(t, reports, HandshakePhasePeer)
+		require.ErrorContains(t, r.err, "connection gated")
+	})
+
+	t.Run("listener closed", func(t *testing.T) {
+		ln, _, reports := newListener(t, nil)
+		dialHandshakeChannel(t, ln)
+		require.NoError(t, ln.Close())
+		select {
+		case r := <-reports:
+			t.Fatalf("handshake aborted by closing the listener was reported: %s: %v", r.phase, r.err)
+		case <-time.After(200 * time.Millisecond):
+		}
+	})
+}
+
+func TestPinRemoteAddr(t *testing.T) {
+	for _, pin := range []bool{true, false} {
+		t.Run(fmt.Sprintf("pin=%t", pin), func(t *testing.T) {
+			var opts []Option
+			if pin {
+				opts = append(opts, WithPinRemoteAddr())
+			}
+			tr, _ := getTransport(t, opts...)
+			ln, err := tr.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/webrtc-direct"))
+			require.NoError(t, err)
+			defer ln.Close()
+
+			ufrag := genUfrag()
+			dialHandshakeChannelWithUfrag(t, ln, ufrag)
+
+			// A second source address sends a valid binding request for the same ufrag. The
+			// listener uses the ufrag as the ICE password, so anyone who knows the ufrag can
+			// authenticate it.
+			attacker, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			require.NoError(t, err)
+			defer attacker.Close()
+			answered := func() bool {
+				req, err := stun.Build(stun.TransactionID, stun.BindingRequest,
+					stun.NewUsername(ufrag+":"+ufrag),
+					ice.PriorityAttr(1),
+					ice.AttrControlling(1),
+					stun.NewShortTermIntegrity(ufrag),
+					stun.Fingerprint,
+				)
+				require.NoError(t, err)
+				_, err = attacker.WriteTo(req.Raw, ln.Addr())
+				require.NoError(t, err)
+				require.NoError(t, attacker.SetReadDeadline(time.Now().Add(200*time.Millisecond)))
+				buf := make([]byte, 1500)
+				n, _, err := attacker.ReadFrom(buf)
+				if err != nil {
+					return false
+				}
+				resp := &stun.Message{Raw: buf[:n]}
+				return resp.Decode() == nil && resp.Type == stun.BindingSuccess
+			}
+
+			if pin {
+				// The connection is pinned once ICE selected the dialer's address.
+				require.Eventually(t, func() bool { return !answered() }, 5*time.Second, 10*time.Millisecond)
+				for i := 0; i < 3; i++ {
+					require.False(t, answered())
+				}
+			} else {
+				require.True(t, answered())
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package udpmux
+
+import (
+	"context"
+	"net"
+	"runtime"
+
+	pool "github.com/libp2p/go-buffer-pool"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// writeBatchQueueLen is the number of batches of packets that can be queued
+// for writing on a socket before WriteTo blocks.
+const writeBatchQueueLen = 4
+
+// batchWriter is implemented by sockets that can write multiple packets with a
+// single system call. ipv4.Message and ipv6.Message are the same type.
+type batchWriter interface {
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// newBatchWriter returns a batchWriter for socket, or nil if batched writes
+// aren't supported for socket on this platform. isIPv6 is true if the returned
+// batchWriter writes through an IPv6 socket.
+func newBatchWriter(socket net.PacketConn) (bw batchWriter, isIPv6 bool) {
+	if bw, ok := socket.(batchWriter); ok {
+		return bw, false
+	}
+	// WriteBatch only writes more than one message per call on Linux.
+	if runtime.GOOS != "linux" {
+		return nil, false
+	}
+	conn, ok := socket.(*net.UDPConn)
+	if !ok {
+		return nil, false
+	}
+	if a, ok := conn.LocalAddr().(*net.UDPAddr); ok && a.IP.To4() != nil {
+		return ipv4.NewPacketConn(conn), false
+	}
+	return ipv6.NewPacketConn(conn), true
+}
+
+// isIPv4Addr returns true if addr is an IPv4 (or IPv4-mapped IPv6) UDP address.
+func isIPv4Addr(addr net.Addr) bool {
+	a, ok := addr.(*net.UDPAddr)
+	return ok && a.IP.To4() != nil
+}
+
+// writeBatcher coalesces the packets written on a socket. Packets written
+// while the previous batch is being written are written together in the next
+// batch, so that a burst of writes results in few system calls without
+// delaying packets when the socket is idle.
+type writeBatcher struct {
+	socket net.PacketConn
+	bw     batchWriter // nil if the socket doesn't support batched writes
+	// unbatchedIPv4 is set for IPv6 sockets. x/net marshals IPv4 destinations
+	// as AF_INET addresses, which a dual-stack IPv6 socket can't be relied on
+	// to accept, so packets to IPv4 addresses are written with WriteTo.
+	unbatchedIPv4 bool
+	maxBatch      int
+	queue         chan packet
+}
+
+func newWriteBatcher(socket net.PacketConn, maxBatch int) *writeBatcher {
+	bw, isIPv6 := newBatchWriter(socket)
+	return &writeBatcher{
+		socket:        socket,
+		bw:            bw,
+		unbatchedIPv4: isIPv6,
+		maxBatch:      maxBatch,
+		queue:         make(chan packet, writeBatchQueueLen*maxBatch),
+	}
+}
+
+// WriteTo queues p for writing to addr. Since packets are written
+// asynchronously, write errors are only logged.
+func (b *writeBatcher) WriteTo(ctx context.Context, p []byte, addr net.Addr) (int, error) {
+	buf := pool.Get(len(p))
+	copy(buf, p)
+	select {
+	case b.queue <- packet{buf: buf, addr: addr}:
+		return len(p), nil
+	case <-ctx.Done():
+		pool.Put(buf)
+		return 0, ErrMuxClosed
+	}
+}
+
+func (b *writeBatcher) run(ctx context.Context) {
+	batch := make([]packet, 0, b.maxBatch)
+	msgs := make([]ipv4.Message, b.maxBatch)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case p := <-b.queue:
+			batch = append(batch, p)
+		}
+	collect:
+		for len(batch) < b.maxBatch {
+			select {
+			case p := <-b.queue:
+				batch = append(batch, p)
+			default:
+				break collect
+			}
+		}
+
+		b.write(batch, msgs)
+		for i := range batch {
+			pool.Put(batch[i].buf)
+			batch[i] = packet{}
+		}
+		batch = batch[:0]
+	}
+}
+
+func (b *writeBatcher) write(batch []packet, msgs []ipv4.Message) {
+	if b.bw == nil || len(batch) == 1 {
+		for _, p := range batch {
+			b.writeTo(p)
+		}
+		return
+	}
+
+	msgs = msgs[:0]
+	for _, p := range batch {
+		if b.unbatchedIPv4 && isIPv4Addr(p.addr) {
+			b.writeTo(p)
+			continue
+		}
+		msgs = append(msgs, ipv4.Message{Buffers: [][]byte{p.buf}, Addr: p.addr})
+	}
+	for len(msgs) > 0 {
+		n, err := b.bw.WriteBatch(msgs, 0)
+		if err != nil {
+			// WriteBatch stops at the first message that can't be written.
+			// Skip it, and keep writing the packets for the other peers.
+			n = max(n, 0)
+			if n < len(msgs) {
+				log.Debugf("failed to write packet to %s: %v", msgs[n].Addr, err)
+				n++
+			}
+		}
+		msgs = msgs[n:]
+	}
+}
+
+func (b *writeBatcher) writeTo(p packet) {
+	if _, err := b.socket.WriteTo(p.buf, p.addr); err != nil {
+		log.Debugf("failed to write packet to %s: %v", p.addr, err)
+	}
+}
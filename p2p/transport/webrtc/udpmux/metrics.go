@@ -0,0 +1,18 @@
+package udpmux
+
+// MetricsTracer tracks the receive queues of the mux's connections.
+type MetricsTracer interface {
+	// QueueLength is called with the current length of a connection's receive
+	// queue whenever a packet is added to or removed from the queue.
+	QueueLength(ufrag string, n int)
+	// DroppedPacket is called when a packet is dropped because a connection's
+	// receive queue is full.
+	DroppedPacket(ufrag string)
+}
+
+type noopMetricsTracer struct{}
+
+var _ MetricsTracer = noopMetricsTracer{}
+
+func (noopMetricsTracer) QueueLength(string, int) {}
+func (noopMetricsTracer) DroppedPacket(string)    {}
@@ -3,11 +3,12 @@ package udpmux
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"io"
 	"net"
 	"strings"
 	"sync"
+	"time"
 
 	logging "github.com/ipfs/go-log/v2"
 	pool "github.com/libp2p/go-buffer-pool"
@@ -22,13 +23,35 @@ var log = logging.Logger("webrtc-udpmux")
 // used to decide the packet size on the write path.
 const ReceiveBufSize = 1500
 
+// minReceiveBufSize is the minimum size of the receive buffer. WebRTC
+// implementations keep STUN messages and DTLS records within 1200 bytes so
+// that they fit in the minimum IPv6 path MTU.
+const minReceiveBufSize = 1200
+
+// removedConnTimeout is how long STUN binding requests for a connection removed
+// with RemoveConn are dropped, instead of creating a new connection. This
+// covers the binding requests the peer retransmits after the removal.
+const removedConnTimeout = 10 * time.Second
+
+// ErrMuxClosed is returned when trying to get a connection from a closed mux.
+var ErrMuxClosed = errors.New("mux closed")
+
+// ErrDuplicateConn is returned by GetConn for a ufrag and address family that
+// was already requested, if the mux rejects duplicate connections.
+var ErrDuplicateConn = errors.New("connection already requested")
+
+// ErrConnNotFound is returned by RemoveConn if the mux has no connection for
+// the ufrag and address family.
+var ErrConnNotFound = errors.New("connection not found")
+
 type Candidate struct {
 	Ufrag string
 	Addr  *net.UDPAddr
 }
 
-// UDPMux multiplexes multiple ICE connections over a single net.PacketConn,
-// generally a UDP socket.
+// UDPMux multiplexes multiple ICE connections over one or more net.PacketConns,
+// generally UDP sockets. With multiple sockets, a connection is bound to the
+// socket it was first seen on, and its packets are written on that socket.
 //
 // The connections are indexed by (ufrag, IP address family) and by remote
 // address from which the connection has received valid STUN/RTC packets.
@@ -42,7 +65,7 @@ type Candidate struct {
 // is a connection associated with the (ufrag, IP address family) pair.
 // If found we add the association to the address map.
 type UDPMux struct {
-	socket net.PacketConn
+	sockets []net.PacketConn
 
 	queue chan Candidate
 
@@ -55,81 +78,227 @@ type UDPMux struct {
 	// ufragAddrMap allows cleaning up all addresses from the addrMap once the connection is closed
 	// During the ICE connectivity checks, the same ufrag might be used on multiple addresses.
 	ufragAddrMap map[ufragConnKey][]net.Addr
+	// pinnedAddrs holds the remote address each connection was pinned to with
+	// PinRemoteAddr
+	pinnedAddrs map[ufragConnKey]string
+	// removedConns holds the connections removed with RemoveConn, and when
+	// packets for them stop being dropped. removedConnsQueue holds the same
+	// entries in expiry order.
+	removedConns      map[ufragConnKey]time.Time
+	removedConnsQueue []removedConn
+
+	unknownUfragHandler UnknownUfragHandler
+	connIdleTimeout     time.Duration
+	pinRemoteAddr       bool
+	onReadError         ReadErrorHandler
+	receiveBufSize      int
+	metricsTracer       MetricsTracer
+	rejectDuplicates    bool
+	packetFilter        PacketFilter
+	writeBatchSize      int
+	// writeBatchers holds the write batcher of each socket, if write batching
+	// is enabled. It is not modified after the mux is created.
+	writeBatchers map[net.PacketConn]*writeBatcher
 
 	// the context controls the lifecycle of the mux
-	wg     sync.WaitGroup
-	ctx    context.Context
-	cancel context.CancelFunc
+	wg        sync.WaitGroup
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
 }
 
 var _ ice.UDPMux = &UDPMux{}
 
+// NewUDPMux creates a mux for the connections on socket.
 func NewUDPMux(socket net.PacketConn) *UDPMux {
+	// Creating a mux for a single socket without options can't fail.
+	mux, _ := NewUDPMuxWithOptions(socket)
+	return mux
+}
+
+// NewUDPMuxWithOptions creates a mux for the connections on socket, configured with opts.
+func NewUDPMuxWithOptions(socket net.PacketConn, opts ...Option) (*UDPMux, error) {
+	return NewMultiUDPMux([]net.PacketConn{socket}, opts...)
+}
+
+// NewMultiUDPMux creates a single mux for the connections on all sockets, for
+// example for a server listening on multiple UDP ports. The connections share
+// one routing table and accept queue.
+func NewMultiUDPMux(sockets []net.PacketConn, opts ...Option) (*UDPMux, error) {
+	if len(sockets) == 0 {
+		return nil, errors.New("no sockets")
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 	mux := &UDPMux{
-		ctx:          ctx,
-		cancel:       cancel,
-		socket:       socket,
-		ufragMap:     make(map[ufragConnKey]*muxedConnection),
-		addrMap:      make(map[string]*muxedConnection),
-		ufragAddrMap: make(map[ufragConnKey][]net.Addr),
-		queue:        make(chan Candidate, 32),
+		ctx:            ctx,
+		cancel:         cancel,
+		sockets:        sockets,
+		ufragMap:       make(map[ufragConnKey]*muxedConnection),
+		addrMap:        make(map[string]*muxedConnection),
+		ufragAddrMap:   make(map[ufragConnKey][]net.Addr),
+		pinnedAddrs:    make(map[ufragConnKey]string),
+		removedConns:   make(map[ufragConnKey]time.Time),
+		queue:          make(chan Candidate, 32),
+		receiveBufSize: ReceiveBufSize,
+		metricsTracer:  noopMetricsTracer{},
+	}
+	for _, opt := range opts {
+		if err := opt(mux); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+	if mux.writeBatchSize > 0 {
+		mux.writeBatchers = make(map[net.PacketConn]*writeBatcher, len(sockets))
+		for _, socket := range sockets {
+			mux.writeBatchers[socket] = newWriteBatcher(socket, mux.writeBatchSize)
+		}
 	}
 
-	return mux
+	return mux, nil
 }
 
 func (mux *UDPMux) Start() {
-	mux.wg.Add(1)
-	go func() {
-		defer mux.wg.Done()
-		mux.readLoop()
-	}()
+	for _, socket := range mux.sockets {
+		mux.wg.Add(1)
+		go func(socket net.PacketConn) {
+			defer mux.wg.Done()
+			mux.readLoop(socket)
+		}(socket)
+	}
+	for _, b := range mux.writeBatchers {
+		mux.wg.Add(1)
+		go func(b *writeBatcher) {
+			defer mux.wg.Done()
+			b.run(mux.ctx)
+		}(b)
+	}
+	if mux.connIdleTimeout > 0 {
+		mux.wg.Add(1)
+		go func() {
+			defer mux.wg.Done()
+			mux.closeIdleConnsLoop()
+		}()
+	}
 }
 
 // GetListenAddresses implements ice.UDPMux
 func (mux *UDPMux) GetListenAddresses() []net.Addr {
-	return []net.Addr{mux.socket.LocalAddr()}
+	addrs := make([]net.Addr, 0, len(mux.sockets))
+	for _, socket := range mux.sockets {
+		addrs = append(addrs, socket.LocalAddr())
+	}
+	return addrs
 }
 
 // GetConn implements ice.UDPMux
 // It creates a net.PacketConn for a given ufrag if an existing one cannot be found.
 // We differentiate IPv4 and IPv6 addresses, since a remote is can be reachable at multiple different
 // UDP addresses of the same IP address family (eg. server-reflexive addresses and peer-reflexive addresses).
+//
+// GetConn is idempotent: calling it again for the same ufrag and address family returns the same
+// connection, until that connection is closed. If the mux was created with WithRejectDuplicateConns,
+// repeated calls return ErrDuplicateConn instead. A connection the mux created for an incoming STUN
+// binding request can be retrieved with GetConn once in either case.
+//
+// The returned connection has a Stats() ConnStats method that reports its byte counters.
 func (mux *UDPMux) GetConn(ufrag string, addr net.Addr) (net.PacketConn, error) {
+	return mux.GetConnContext(context.Background(), ufrag, addr)
+}
+
+// GetConnContext is like GetConn, but fails if ctx is done. It returns
+// ErrMuxClosed if the mux has been closed.
+func (mux *UDPMux) GetConnContext(ctx context.Context, ufrag string, addr net.Addr) (net.PacketConn, error) {
 	a, ok := addr.(*net.UDPAddr)
 	if !ok {
 		return nil, fmt.Errorf("unexpected address type: %T", addr)
 	}
 	select {
 	case <-mux.ctx.Done():
-		return nil, io.ErrClosedPipe
+		return nil, ErrMuxClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	default:
-		isIPv6 := ok && a.IP.To4() == nil
-		_, conn := mux.getOrCreateConn(ufrag, isIPv6, mux, addr)
-		return conn, nil
+		isIPv6 := isIPv6Addr(a)
+		return mux.requestConn(ufrag, isIPv6, mux.socketForAddr(addr), addr)
 	}
 }
 
-// Close implements ice.UDPMux
-func (mux *UDPMux) Close() error {
-	select {
-	case <-mux.ctx.Done():
-		return nil
-	default:
+// requestConn returns the connection for a GetConn call.
+func (mux *UDPMux) requestConn(ufrag string, isIPv6 bool, socket net.PacketConn, addr net.Addr) (*muxedConnection, error) {
+	key := ufragConnKey{ufrag: ufrag, isIPv6: isIPv6}
+
+	mux.mx.Lock()
+	defer mux.mx.Unlock()
+
+	if conn, ok := mux.ufragMap[key]; ok && conn.requested && mux.rejectDuplicates {
+		return nil, ErrDuplicateConn
 	}
-	mux.cancel()
-	mux.socket.Close()
+	// A connection requested locally replaces a removed one.
+	delete(mux.removedConns, key)
+	_, conn := mux.getOrCreateConnLocked(key, socket, addr)
+	conn.requested = true
+	return conn, nil
+}
+
+// Close implements ice.UDPMux. It closes the mux, its connections and its
+// sockets.
+func (mux *UDPMux) Close() error {
+	mux.close()
 	mux.wg.Wait()
 	return nil
 }
 
-// writeTo writes a packet to the underlying net.PacketConn
-func (mux *UDPMux) writeTo(buf []byte, addr net.Addr) (int, error) {
-	return mux.socket.WriteTo(buf, addr)
+// CloseKeepConn closes the mux and its connections, like Close, but leaves the
+// sockets open. This is useful when the sockets are owned by the caller, for
+// example when they are shared with other transports. To stop the read loops,
+// CloseKeepConn sets a read deadline in the past on the sockets and clears it
+// once the read loops have exited.
+func (mux *UDPMux) CloseKeepConn() error {
+	var closed bool
+	mux.closeOnce.Do(func() {
+		closed = true
+		mux.cancel()
+		for _, socket := range mux.sockets {
+			socket.SetReadDeadline(time.Now())
+		}
+	})
+	mux.wg.Wait()
+	if closed {
+		for _, socket := range mux.sockets {
+			socket.SetReadDeadline(time.Time{})
+		}
+	}
+	return nil
 }
 
-func (mux *UDPMux) readLoop() {
+// close closes the mux without waiting for its goroutines to exit.
+func (mux *UDPMux) close() {
+	mux.closeOnce.Do(func() {
+		mux.cancel()
+		for _, socket := range mux.sockets {
+			socket.Close()
+		}
+	})
+}
+
+// socketForAddr returns the socket listening on addr. It returns the first
+// socket if none of the sockets listens on addr.
+func (mux *UDPMux) socketForAddr(addr net.Addr) net.PacketConn {
+	for _, socket := range mux.sockets {
+		if socket.LocalAddr().String() == addr.String() {
+			return socket
+		}
+	}
+	return mux.sockets[0]
+}
+
+func (mux *UDPMux) readLoop(socket net.PacketConn) {
+	// The buffer is reused for every packet: connections copy the packets
+	// they queue into buffers sized to the packet.
+	buf := pool.Get(mux.receiveBufSize)
+	defer pool.Put(buf)
+
 	for {
 		select {
 		case <-mux.ctx.Done():
@@ -137,85 +306,141 @@ func (mux *UDPMux) readLoop() {
 		default:
 		}
 
-		buf := pool.Get(ReceiveBufSize)
-
-		n, addr, err := mux.socket.ReadFrom(buf)
+		n, addr, err := socket.ReadFrom(buf)
 		if err != nil {
+			if mux.ctx.Err() != nil {
+				log.Debugf("readLoop exiting: mux closed")
+				return
+			}
+			if mux.onReadError != nil {
+				if mux.onReadError(err) {
+					continue
+				}
+				log.Debugf("readLoop exiting: closing mux after error reading from socket %s: %v", socket.LocalAddr(), err)
+				mux.close()
+				return
+			}
 			if strings.Contains(err.Error(), "use of closed network connection") {
-				log.Debugf("readLoop exiting: socket %s closed", mux.socket.LocalAddr())
+				log.Debugf("readLoop exiting: socket %s closed", socket.LocalAddr())
 			} else {
-				log.Errorf("error reading from socket %s: %v", mux.socket.LocalAddr(), err)
+				log.Errorf("error reading from socket %s: %v", socket.LocalAddr(), err)
 			}
-			pool.Put(buf)
 			return
 		}
-		buf = buf[:n]
 
-		if processed := mux.processPacket(buf, addr); !processed {
-			pool.Put(buf)
+		mux.processPacket(buf[:n], addr, socket)
+	}
+}
+
+// closeIdleConnsLoop periodically closes connections that haven't received
+// a packet within the idle timeout.
+func (mux *UDPMux) closeIdleConnsLoop() {
+	ticker := time.NewTicker(mux.connIdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-mux.ctx.Done():
+			return
+		case now := <-ticker.C:
+			mux.closeIdleConns(now)
 		}
 	}
 }
 
-func (mux *UDPMux) processPacket(buf []byte, addr net.Addr) (processed bool) {
+func (mux *UDPMux) closeIdleConns(now time.Time) {
+	var idle []*muxedConnection
+	mux.mx.Lock()
+	for _, conn := range mux.ufragMap {
+		if now.Sub(conn.LastActivity()) >= mux.connIdleTimeout {
+			idle = append(idle, conn)
+		}
+	}
+	mux.mx.Unlock()
+
+	// Close removes the connection from the mux, which requires the lock.
+	for _, conn := range idle {
+		log.Debugw("closing idle connection", "ufrag", conn.ufrag)
+		conn.Close()
+	}
+}
+
+// processPacket routes a packet received on socket from addr. buf is only
+// valid until processPacket returns.
+func (mux *UDPMux) processPacket(buf []byte, addr net.Addr, socket net.PacketConn) {
 	udpAddr, ok := addr.(*net.UDPAddr)
 	if !ok {
 		log.Errorf("received a non-UDP address: %s", addr)
-		return false
+		return
+	}
+	isIPv6 := isIPv6Addr(udpAddr)
+
+	if mux.packetFilter != nil && !mux.packetFilter(addr, buf) {
+		log.Debugw("dropping packet rejected by the packet filter", "addr", udpAddr)
+		return
 	}
-	isIPv6 := udpAddr.IP.To4() == nil
 
 	// Connections are indexed by remote address. We first
 	// check if the remote address has a connection associated
 	// with it. If yes, we push the received packet to the connection
 	mux.mx.Lock()
-	conn, ok := mux.addrMap[addr.String()]
+	conn, ok := mux.addrMap[addrKey(addr)]
 	mux.mx.Unlock()
 	if ok {
 		if err := conn.Push(buf, addr); err != nil {
 			log.Debugf("could not push packet: %v", err)
-			return false
 		}
-		return true
+		return
 	}
 
 	if !stun.IsMessage(buf) {
 		log.Debug("incoming message is not a STUN message")
-		return false
+		return
 	}
 
 	msg := &stun.Message{Raw: buf}
 	if err := msg.Decode(); err != nil {
 		log.Debugf("failed to decode STUN message: %s", err)
-		return false
+		return
 	}
 	if msg.Type != stun.BindingRequest {
 		log.Debugf("incoming message should be a STUN binding request, got %s", msg.Type)
-		return false
+		return
 	}
 
 	ufrag, err := ufragFromSTUNMessage(msg)
 	if err != nil {
 		log.Debugf("could not find STUN username: %s", err)
-		return false
+		return
 	}
 
-	connCreated, conn := mux.getOrCreateConn(ufrag, isIPv6, mux, udpAddr)
+	connCreated, conn, err := mux.getOrCreateConnForRemote(ufrag, isIPv6, socket, udpAddr)
+	if err != nil {
+		log.Debugw("dropping STUN binding request", "ufrag", ufrag, "addr", udpAddr, "error", err)
+		if errors.Is(err, errRemovedConn) {
+			mux.handleUnknownUfrag(ufrag, addr, buf)
+		}
+		return
+	}
 	if connCreated {
 		select {
 		case mux.queue <- Candidate{Addr: udpAddr, Ufrag: ufrag}:
 		default:
 			log.Debugw("queue full, dropping incoming candidate", "ufrag", ufrag, "addr", udpAddr)
 			conn.Close()
-			return false
+			mux.handleUnknownUfrag(ufrag, addr, buf)
+			return
 		}
 	}
 
 	if err := conn.Push(buf, addr); err != nil {
 		log.Debugf("could not push packet: %v", err)
-		return false
 	}
-	return true
+}
+
+func (mux *UDPMux) handleUnknownUfrag(ufrag string, addr net.Addr, buf []byte) {
+	if mux.unknownUfragHandler != nil {
+		mux.unknownUfragHandler(ufrag, addr, buf)
+	}
 }
 
 func (mux *UDPMux) Accept(ctx context.Context) (Candidate, error) {
@@ -229,6 +454,51 @@ func (mux *UDPMux) Accept(ctx context.Context) (Candidate, error) {
 	}
 }
 
+// ConnInfo describes a connection of the mux.
+type ConnInfo struct {
+	Ufrag  string
+	IsIPv6 bool
+	// Addrs are the remote addresses associated with the connection
+	Addrs []net.Addr
+	// Stats are the connection's byte counters
+	Stats ConnStats
+}
+
+// Conns returns a snapshot of the connections currently tracked by the mux.
+func (mux *UDPMux) Conns() []ConnInfo {
+	mux.mx.Lock()
+	defer mux.mx.Unlock()
+
+	conns := make([]ConnInfo, 0, len(mux.ufragMap))
+	for key, conn := range mux.ufragMap {
+		conns = append(conns, ConnInfo{
+			Ufrag:  key.ufrag,
+			IsIPv6: key.isIPv6,
+			Addrs:  append([]net.Addr(nil), mux.ufragAddrMap[key]...),
+			Stats:  conn.Stats(),
+		})
+	}
+	return conns
+}
+
+// isIPv6Addr returns whether addr is an IPv6 address. IPv4-mapped IPv6
+// addresses (::ffff:a.b.c.d), as received on dual-stack sockets, are IPv4
+// addresses, so that they map to the same connection as their IPv4 form.
+func isIPv6Addr(addr *net.UDPAddr) bool {
+	return addr.IP.To4() == nil
+}
+
+// addrKey returns the key of addr in the address maps. Like isIPv6Addr, it
+// normalizes IPv4-mapped IPv6 addresses to their IPv4 form.
+func addrKey(addr net.Addr) string {
+	if a, ok := addr.(*net.UDPAddr); ok {
+		if ip4 := a.IP.To4(); ip4 != nil {
+			return (&net.UDPAddr{IP: ip4, Port: a.Port}).String()
+		}
+	}
+	return addr.String()
+}
+
 type ufragConnKey struct {
 	ufrag  string
 	isIPv6 bool
@@ -268,31 +538,191 @@ func (mux *UDPMux) RemoveConnByUfrag(ufrag string) {
 
 	for _, isIPv6 := range [...]bool{true, false} {
 		key := ufragConnKey{ufrag: ufrag, isIPv6: isIPv6}
-		if _, ok := mux.ufragMap[key]; ok {
-			delete(mux.ufragMap, key)
-			for _, addr := range mux.ufragAddrMap[key] {
-				delete(mux.addrMap, addr.String())
-			}
-			delete(mux.ufragAddrMap, key)
+		if conn, ok := mux.ufragMap[key]; ok {
+			mux.removeConnLocked(key, conn)
+		}
+	}
+}
+
+// RemoveConn closes the connection for the ufrag and address family and removes
+// it and all its addresses from the mux. Packets arriving for the connection
+// afterwards are dropped. In particular, STUN binding requests for the ufrag
+// don't create a new connection for a short while, unless GetConn is called
+// for it. It returns ErrConnNotFound if there is no such connection.
+func (mux *UDPMux) RemoveConn(ufrag string, isIPv6 bool) error {
+	key := ufragConnKey{ufrag: ufrag, isIPv6: isIPv6}
+
+	mux.mx.Lock()
+	conn, ok := mux.ufragMap[key]
+	if ok {
+		mux.removeConnLocked(key, conn)
+		mux.addRemovedConnLocked(key, time.Now())
+	}
+	mux.mx.Unlock()
+
+	if !ok {
+		return ErrConnNotFound
+	}
+	// Close calls back into the mux, which requires the lock.
+	return conn.Close()
+}
+
+// PinRemoteAddr pins the connection for the ufrag and address family to addr.
+// Afterwards, packets for the connection from any other address are dropped.
+// It must only be called once ICE has validated addr, typically from the ICE
+// agent's selected candidate pair callback: pinning to the address of an
+// unauthenticated STUN binding request would let an attacker win the pin.
+// Remote address pinning must be enabled with WithPinRemoteAddr. It returns
+// ErrConnNotFound if there is no such connection.
+func (mux *UDPMux) PinRemoteAddr(ufrag string, isIPv6 bool, addr net.Addr) error {
+	if !mux.pinRemoteAddr {
+		return errors.New("remote address pinning is not enabled")
+	}
+	key := ufragConnKey{ufrag: ufrag, isIPv6: isIPv6}
+
+	mux.mx.Lock()
+	defer mux.mx.Unlock()
+
+	conn, ok := mux.ufragMap[key]
+	if !ok {
+		return ErrConnNotFound
+	}
+	mux.pinnedAddrs[key] = addrKey(addr)
+	// Stop routing packets from the other addresses used during the ICE
+	// connectivity checks.
+	addrs := mux.ufragAddrMap[key][:0]
+	for _, a := range mux.ufragAddrMap[key] {
+		if addrKey(a) == addrKey(addr) {
+			addrs = append(addrs, a)
+			continue
+		}
+		if mux.addrMap[addrKey(a)] == conn {
+			delete(mux.addrMap, addrKey(a))
 		}
 	}
+	if len(addrs) == 0 {
+		mux.addrMap[addrKey(addr)] = conn
+		addrs = append(addrs, addr)
+	}
+	mux.ufragAddrMap[key] = addrs
+	return nil
+}
+
+type removedConn struct {
+	key     ufragConnKey
+	expires time.Time
+}
+
+// addRemovedConnLocked must be called with mx held.
+func (mux *UDPMux) addRemovedConnLocked(key ufragConnKey, now time.Time) {
+	mux.pruneRemovedConnsLocked(now)
+	expires := now.Add(removedConnTimeout)
+	mux.removedConns[key] = expires
+	mux.removedConnsQueue = append(mux.removedConnsQueue, removedConn{key: key, expires: expires})
 }
 
-func (mux *UDPMux) getOrCreateConn(ufrag string, isIPv6 bool, _ *UDPMux, addr net.Addr) (created bool, _ *muxedConnection) {
+// isRemovedConnLocked must be called with mx held.
+func (mux *UDPMux) isRemovedConnLocked(key ufragConnKey, now time.Time) bool {
+	mux.pruneRemovedConnsLocked(now)
+	_, ok := mux.removedConns[key]
+	return ok
+}
+
+// pruneRemovedConnsLocked must be called with mx held.
+func (mux *UDPMux) pruneRemovedConnsLocked(now time.Time) {
+	for len(mux.removedConnsQueue) > 0 {
+		rc := mux.removedConnsQueue[0]
+		if now.Before(rc.expires) {
+			break
+		}
+		// The connection might have been removed again since.
+		if mux.removedConns[rc.key] == rc.expires {
+			delete(mux.removedConns, rc.key)
+		}
+		mux.removedConnsQueue[0] = removedConn{}
+		mux.removedConnsQueue = mux.removedConnsQueue[1:]
+	}
+}
+
+// removeConn removes conn from the mux, unless it was already replaced by a
+// newer connection for the same key.
+func (mux *UDPMux) removeConn(key ufragConnKey, conn *muxedConnection) {
+	mux.mx.Lock()
+	defer mux.mx.Unlock()
+
+	mux.removeConnLocked(key, conn)
+}
+
+// removeConnLocked must be called with mx held.
+func (mux *UDPMux) removeConnLocked(key ufragConnKey, conn *muxedConnection) {
+	if mux.ufragMap[key] != conn {
+		return
+	}
+	delete(mux.ufragMap, key)
+	for _, addr := range mux.ufragAddrMap[key] {
+		delete(mux.addrMap, addrKey(addr))
+	}
+	delete(mux.ufragAddrMap, key)
+	delete(mux.pinnedAddrs, key)
+}
+
+// hasConn returns the connection for the ufrag and address family, or nil if
+// there is none.
+func (mux *UDPMux) hasConn(ufrag string, isIPv6 bool) *muxedConnection {
+	mux.mx.Lock()
+	defer mux.mx.Unlock()
+
+	return mux.ufragMap[ufragConnKey{ufrag: ufrag, isIPv6: isIPv6}]
+}
+
+// getOrCreateConn returns the connection for ufrag and the address family. A
+// new connection writes its packets on socket.
+func (mux *UDPMux) getOrCreateConn(ufrag string, isIPv6 bool, socket net.PacketConn, addr net.Addr) (created bool, _ *muxedConnection) {
+	key := ufragConnKey{ufrag: ufrag, isIPv6: isIPv6}
+
+	mux.mx.Lock()
+	defer mux.mx.Unlock()
+
+	return mux.getOrCreateConnLocked(key, socket, addr)
+}
+
+var (
+	errNotPinnedAddr = errors.New("connection is pinned to a different address")
+	errRemovedConn   = errors.New("connection was removed")
+)
+
+// getOrCreateConnForRemote is like getOrCreateConn, but for addresses we received
+// a STUN binding request from. It returns errNotPinnedAddr if the connection is
+// pinned to a different address, and errRemovedConn if it was recently removed
+// with RemoveConn.
+func (mux *UDPMux) getOrCreateConnForRemote(ufrag string, isIPv6 bool, socket net.PacketConn, addr net.Addr) (created bool, _ *muxedConnection, _ error) {
 	key := ufragConnKey{ufrag: ufrag, isIPv6: isIPv6}
 
 	mux.mx.Lock()
 	defer mux.mx.Unlock()
 
+	if pinned, ok := mux.pinnedAddrs[key]; ok && pinned != addrKey(addr) {
+		return false, nil, errNotPinnedAddr
+	}
+	if mux.isRemovedConnLocked(key, time.Now()) {
+		return false, nil, errRemovedConn
+	}
+	created, conn := mux.getOrCreateConnLocked(key, socket, addr)
+	return created, conn, nil
+}
+
+// getOrCreateConnLocked must be called with mx held.
+func (mux *UDPMux) getOrCreateConnLocked(key ufragConnKey, socket net.PacketConn, addr net.Addr) (created bool, _ *muxedConnection) {
 	if conn, ok := mux.ufragMap[key]; ok {
-		mux.addrMap[addr.String()] = conn
+		mux.addrMap[addrKey(addr)] = conn
 		mux.ufragAddrMap[key] = append(mux.ufragAddrMap[key], addr)
 		return false, conn
 	}
 
-	conn := newMuxedConnection(mux, func() { mux.RemoveConnByUfrag(ufrag) })
+	var conn *muxedConnection
+	conn = newMuxedConnection(mux, key.ufrag, socket, func() { mux.removeConn(key, conn) })
 	mux.ufragMap[key] = conn
-	mux.addrMap[addr.String()] = conn
+	mux.addrMap[addrKey(addr)] = conn
 	mux.ufragAddrMap[key] = append(mux.ufragAddrMap[key], addr)
 	return true, conn
 }
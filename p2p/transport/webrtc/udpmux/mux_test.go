@@ -1,14 +1,18 @@
 package udpmux
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/pion/stun"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/net/ipv4"
 )
 
 func getSTUNBindingRequest(ufrag string) *stun.Message {
@@ -182,6 +186,105 @@ func TestRemoveConnByUfrag(t *testing.T) {
 	}
 }
 
+func TestRemoveConn(t *testing.T) {
+	dropped := make(chan string, 1)
+	c := newFakePacketConn()
+	m, err := NewUDPMuxWithOptions(c, WithUnknownUfragHandler(func(ufrag string, _ net.Addr, _ []byte) {
+		dropped <- ufrag
+	}))
+	require.NoError(t, err)
+	m.Start()
+	defer m.Close()
+
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1234}
+	addr6 := &net.UDPAddr{IP: net.ParseIP("::1"), Port: 1234}
+	conn, err := m.GetConn("a", addr)
+	require.NoError(t, err)
+	conn6, err := m.GetConn("a", addr6)
+	require.NoError(t, err)
+
+	require.NoError(t, m.RemoveConn("a", false))
+	require.Nil(t, m.hasConn("a", false))
+	require.ErrorIs(t, m.RemoveConn("a", false), ErrConnNotFound)
+	_, _, err = conn.ReadFrom(make([]byte, 10))
+	require.Error(t, err)
+
+	// the connection for the other address family is not affected
+	require.Same(t, conn6, m.hasConn("a", true))
+
+	// late binding requests for the removed connection are dropped
+	c.packets <- fakePacket{buf: getSTUNBindingRequest("a").Raw, addr: addr}
+	select {
+	case ufrag := <-dropped:
+		require.Equal(t, "a", ufrag)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the binding request to be dropped")
+	}
+	require.Nil(t, m.hasConn("a", false))
+}
+
+func TestRemoveConnConcurrentPackets(t *testing.T) {
+	c := newFakePacketConn()
+	m := NewUDPMux(c)
+	m.Start()
+	defer m.Close()
+
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1234}
+	for i := 0; i < 100; i++ {
+		_, err := m.GetConn("a", addr)
+		require.NoError(t, err)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for j := 0; j < 10; j++ {
+				c.packets <- fakePacket{buf: getSTUNBindingRequest("a").Raw, addr: addr}
+			}
+		}()
+		require.NoError(t, m.RemoveConn("a", false))
+		<-done
+		require.Empty(t, m.queue)
+	}
+}
+
+func TestRemoveConnBindingRequest(t *testing.T) {
+	c := newFakePacketConn()
+	m := NewUDPMux(c)
+	m.Start()
+	defer m.Close()
+
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1234}
+	_, err := m.GetConn("a", addr)
+	require.NoError(t, err)
+	require.NoError(t, m.RemoveConn("a", false))
+
+	// A late binding request for the removed ufrag doesn't create a new
+	// connection. The read loop processes packets in order, so the candidate
+	// for b is only accepted after the request for a was handled.
+	c.packets <- fakePacket{buf: getSTUNBindingRequest("a").Raw, addr: addr}
+	c.packets <- fakePacket{buf: getSTUNBindingRequest("b").Raw, addr: &net.UDPAddr{IP: net.IPv4(5, 6, 7, 8), Port: 1234}}
+	cand, err := m.Accept(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "b", cand.Ufrag)
+	require.Nil(t, m.hasConn("a", false))
+
+	// Once the removal expired, binding requests create a new connection again.
+	m.mx.Lock()
+	m.pruneRemovedConnsLocked(time.Now().Add(removedConnTimeout))
+	m.mx.Unlock()
+	c.packets <- fakePacket{buf: getSTUNBindingRequest("a").Raw, addr: addr}
+	cand, err = m.Accept(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "a", cand.Ufrag)
+
+	// GetConn replaces a removed connection right away.
+	require.NoError(t, m.RemoveConn("a", false))
+	_, err = m.GetConn("a", addr)
+	require.NoError(t, err)
+	require.NotNil(t, m.hasConn("a", false))
+	require.Empty(t, m.removedConns)
+}
+
 func TestMuxedConnection(t *testing.T) {
 	c := newPacketConn(t)
 	m := NewUDPMux(c)
@@ -246,3 +349,1097 @@ func TestMuxedConnection(t *testing.T) {
 	}
 	require.Empty(t, addrUfragMap)
 }
+
+func TestMuxedConnectionDone(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1234}
+	requireDone := func(t *testing.T, conn net.PacketConn) {
+		t.Helper()
+		select {
+		case <-conn.(*muxedConnection).Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the done channel to be closed")
+		}
+	}
+
+	t.Run("close", func(t *testing.T) {
+		m := NewUDPMux(newFakePacketConn())
+		m.Start()
+		defer m.Close()
+
+		conn, err := m.GetConn("a", addr)
+		require.NoError(t, err)
+		select {
+		case <-conn.(*muxedConnection).Done():
+			t.Fatal("done channel closed before the connection was closed")
+		default:
+		}
+		require.NoError(t, conn.Close())
+		requireDone(t, conn)
+		// closing again doesn't panic
+		require.NoError(t, conn.Close())
+		requireDone(t, conn)
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		m, err := NewUDPMuxWithOptions(newFakePacketConn(), WithConnIdleTimeout(100*time.Millisecond))
+		require.NoError(t, err)
+		m.Start()
+		defer m.Close()
+
+		conn, err := m.GetConn("a", addr)
+		require.NoError(t, err)
+		requireDone(t, conn)
+	})
+
+	t.Run("mux closed", func(t *testing.T) {
+		m := NewUDPMux(newFakePacketConn())
+		m.Start()
+
+		conn, err := m.GetConn("a", addr)
+		require.NoError(t, err)
+		require.NoError(t, m.Close())
+		requireDone(t, conn)
+	})
+}
+
+type fakePacket struct {
+	buf  []byte
+	addr net.Addr
+	err  error
+}
+
+// fakePacketConn is a net.PacketConn that returns the packets sent on its
+// packets channel from ReadFrom. If a packet has an error set, ReadFrom
+// returns that error instead. If writes is set, written packets are sent on it.
+type fakePacketConn struct {
+	packets   chan fakePacket
+	writes    chan fakePacket
+	closed    chan struct{}
+	localAddr net.Addr
+}
+
+var _ net.PacketConn = &fakePacketConn{}
+
+func newFakePacketConn() *fakePacketConn {
+	return &fakePacketConn{
+		packets: make(chan fakePacket),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (c *fakePacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-c.packets:
+		if p.err != nil {
+			return 0, nil, p.err
+		}
+		return copy(b, p.buf), p.addr, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *fakePacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if c.writes != nil {
+		c.writes <- fakePacket{buf: append([]byte(nil), b...), addr: addr}
+	}
+	return len(b), nil
+}
+
+func (c *fakePacketConn) Close() error {
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+	return nil
+}
+
+func (c *fakePacketConn) LocalAddr() net.Addr {
+	if c.localAddr != nil {
+		return c.localAddr
+	}
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+}
+
+func (*fakePacketConn) SetDeadline(time.Time) error      { return nil }
+func (*fakePacketConn) SetReadDeadline(time.Time) error  { return nil }
+func (*fakePacketConn) SetWriteDeadline(time.Time) error { return nil }
+
+func TestUnknownUfragHandler(t *testing.T) {
+	type unknownPacket struct {
+		ufrag string
+		addr  net.Addr
+	}
+	unknown := make(chan unknownPacket, 1)
+	c := newFakePacketConn()
+	m, err := NewUDPMuxWithOptions(c, WithUnknownUfragHandler(func(ufrag string, remote net.Addr, _ []byte) {
+		unknown <- unknownPacket{ufrag: ufrag, addr: remote}
+	}))
+	require.NoError(t, err)
+	m.Start()
+	defer m.Close()
+
+	// Fill up the accept queue. The next new ufrag can't be matched to a connection.
+	for i := 0; i < cap(m.queue); i++ {
+		addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1000 + i}
+		c.packets <- fakePacket{buf: getSTUNBindingRequest(fmt.Sprintf("ufrag%d", i)).Raw, addr: addr}
+	}
+
+	// Packets that aren't binding requests are dropped without calling the handler.
+	other := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 5001}
+	c.packets <- fakePacket{buf: []byte("not a STUN packet"), addr: other}
+	resp, err := stun.Build(stun.BindingSuccess, stun.TransactionID)
+	require.NoError(t, err)
+	c.packets <- fakePacket{buf: resp.Raw, addr: other}
+	noUsername, err := stun.Build(stun.BindingRequest, stun.TransactionID)
+	require.NoError(t, err)
+	c.packets <- fakePacket{buf: noUsername.Raw, addr: other}
+
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 5000}
+	c.packets <- fakePacket{buf: getSTUNBindingRequest("unmatched").Raw, addr: addr}
+	select {
+	case p := <-unknown:
+		require.Equal(t, "unmatched", p.ufrag)
+		require.Equal(t, addr, p.addr)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the unknown ufrag handler to be called")
+	}
+}
+
+func TestConnIdleTimeout(t *testing.T) {
+	c := newPacketConn(t)
+	m, err := NewUDPMuxWithOptions(c, WithConnIdleTimeout(100*time.Millisecond))
+	require.NoError(t, err)
+	m.Start()
+	defer m.Close()
+
+	hasConn := func(ufrag string) bool {
+		m.mx.Lock()
+		defer m.mx.Unlock()
+		_, ok := m.ufragMap[ufragConnKey{ufrag: ufrag, isIPv6: false}]
+		return ok
+	}
+
+	remote := newPacketConn(t)
+	mc, err := m.GetConn("a", remote.LocalAddr())
+	require.NoError(t, err)
+	require.True(t, hasConn("a"))
+
+	require.Eventually(t, func() bool { return !hasConn("a") }, 5*time.Second, 10*time.Millisecond)
+	_, _, err = mc.ReadFrom(make([]byte, 100))
+	require.Error(t, err)
+
+	m.mx.Lock()
+	require.Empty(t, m.addrMap)
+	require.Empty(t, m.ufragAddrMap)
+	m.mx.Unlock()
+}
+
+func TestConnIdleTimeoutActiveConn(t *testing.T) {
+	c := newPacketConn(t)
+	m, err := NewUDPMuxWithOptions(c, WithConnIdleTimeout(200*time.Millisecond))
+	require.NoError(t, err)
+	m.Start()
+	defer m.Close()
+
+	remote := newPacketConn(t)
+	setupMapping(t, "a", remote, m)
+	_, err = m.Accept(context.Background())
+	require.NoError(t, err)
+	mc, err := m.GetConn("a", remote.LocalAddr())
+	require.NoError(t, err)
+
+	// keep the connection active for longer than the idle timeout
+	buf := make([]byte, 100)
+	for i := 0; i < 10; i++ {
+		_, err := remote.WriteTo([]byte("test"), c.LocalAddr())
+		require.NoError(t, err)
+		_, _, err = mc.ReadFrom(buf)
+		require.NoError(t, err)
+		time.Sleep(50 * time.Millisecond)
+	}
+	m.mx.Lock()
+	require.Len(t, m.ufragMap, 1)
+	m.mx.Unlock()
+}
+
+func TestConnIdleTimeoutNegative(t *testing.T) {
+	_, err := NewUDPMuxWithOptions(newFakePacketConn(), WithConnIdleTimeout(-time.Second))
+	require.Error(t, err)
+}
+
+func TestConns(t *testing.T) {
+	m := NewUDPMux(newFakePacketConn())
+	m.Start()
+	defer m.Close()
+	require.Empty(t, m.Conns())
+
+	v4Addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1234}
+	v6Addr := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}
+	_, err := m.GetConn("a", v4Addr)
+	require.NoError(t, err)
+	_, err = m.GetConn("a", v6Addr)
+	require.NoError(t, err)
+
+	require.ElementsMatch(t, []ConnInfo{
+		{Ufrag: "a", IsIPv6: false, Addrs: []net.Addr{v4Addr}},
+		{Ufrag: "a", IsIPv6: true, Addrs: []net.Addr{v6Addr}},
+	}, m.Conns())
+
+	m.RemoveConnByUfrag("a")
+	require.Empty(t, m.Conns())
+}
+
+func TestConnStats(t *testing.T) {
+	c := newFakePacketConn()
+	m := NewUDPMux(c)
+	m.Start()
+	defer m.Close()
+
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1000}
+	stunReq := getSTUNBindingRequest("a").Raw
+	c.packets <- fakePacket{buf: stunReq, addr: addr}
+	_, err := m.Accept(context.Background())
+	require.NoError(t, err)
+	conn, err := m.GetConn("a", addr)
+	require.NoError(t, err)
+	mc := conn.(interface{ Stats() ConnStats })
+
+	buf := make([]byte, 100)
+	for _, n := range []int{10, 20, 30} {
+		c.packets <- fakePacket{buf: make([]byte, n), addr: addr}
+	}
+	// the STUN binding request and the 3 packets
+	for i := 0; i < 4; i++ {
+		_, _, err := conn.ReadFrom(buf)
+		require.NoError(t, err)
+	}
+	for _, n := range []int{5, 15} {
+		_, err := conn.WriteTo(make([]byte, n), addr)
+		require.NoError(t, err)
+	}
+
+	expected := ConnStats{BytesRead: uint64(len(stunReq) + 60), BytesWritten: 20}
+	require.Equal(t, expected, mc.Stats())
+	conns := m.Conns()
+	require.Len(t, conns, 1)
+	require.Equal(t, expected, conns[0].Stats)
+}
+
+func TestGetConnContextCanceled(t *testing.T) {
+	m := NewUDPMux(newFakePacketConn())
+	m.Start()
+	defer m.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := m.GetConnContext(ctx, "a", &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1234})
+	require.ErrorIs(t, err, context.Canceled)
+	require.Empty(t, m.Conns())
+}
+
+func TestGetConnClosedMux(t *testing.T) {
+	m := NewUDPMux(newFakePacketConn())
+	m.Start()
+	require.NoError(t, m.Close())
+
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1234}
+	_, err := m.GetConnContext(context.Background(), "a", addr)
+	require.ErrorIs(t, err, ErrMuxClosed)
+	_, err = m.GetConn("a", addr)
+	require.ErrorIs(t, err, ErrMuxClosed)
+}
+
+func TestGetConnDuplicate(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1234}
+	addr6 := &net.UDPAddr{IP: net.ParseIP("::1"), Port: 1234}
+
+	t.Run("idempotent", func(t *testing.T) {
+		m := NewUDPMux(newFakePacketConn())
+		m.Start()
+		defer m.Close()
+
+		c1, err := m.GetConn("a", addr)
+		require.NoError(t, err)
+		c2, err := m.GetConn("a", addr)
+		require.NoError(t, err)
+		require.Same(t, c1, c2)
+		require.Len(t, m.Conns(), 1)
+	})
+
+	t.Run("reject duplicates", func(t *testing.T) {
+		m, err := NewUDPMuxWithOptions(newFakePacketConn(), WithRejectDuplicateConns())
+		require.NoError(t, err)
+		m.Start()
+		defer m.Close()
+
+		c1, err := m.GetConn("a", addr)
+		require.NoError(t, err)
+		_, err = m.GetConn("a", addr)
+		require.ErrorIs(t, err, ErrDuplicateConn)
+		_, err = m.GetConn("a", &net.UDPAddr{IP: net.IPv4(5, 6, 7, 8), Port: 1234})
+		require.ErrorIs(t, err, ErrDuplicateConn)
+		require.Len(t, m.Conns(), 1)
+
+		// the address family is part of the key
+		c2, err := m.GetConn("a", addr6)
+		require.NoError(t, err)
+		require.NotSame(t, c1, c2)
+
+		// the ufrag can be requested again once the connection is closed
+		require.NoError(t, c1.Close())
+		c3, err := m.GetConn("a", addr)
+		require.NoError(t, err)
+		require.NotSame(t, c1, c3)
+	})
+
+	t.Run("reject duplicates after STUN binding request", func(t *testing.T) {
+		c := newFakePacketConn()
+		m, err := NewUDPMuxWithOptions(c, WithRejectDuplicateConns())
+		require.NoError(t, err)
+		m.Start()
+		defer m.Close()
+
+		msg := getSTUNBindingRequest("a")
+		c.packets <- fakePacket{buf: msg.Raw, addr: addr}
+		cand, err := m.Accept(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, "a", cand.Ufrag)
+
+		// the connection created by the mux is returned by the first call
+		_, err = m.GetConn("a", addr)
+		require.NoError(t, err)
+		_, err = m.GetConn("a", addr)
+		require.ErrorIs(t, err, ErrDuplicateConn)
+	})
+}
+
+func TestIPv4MappedAddr(t *testing.T) {
+	c := newFakePacketConn()
+	m := NewUDPMux(c)
+	m.Start()
+	defer m.Close()
+
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4).To4(), Port: 1234}
+	conn, err := m.GetConn("a", addr)
+	require.NoError(t, err)
+
+	buf := make([]byte, 1500)
+	for _, mapped := range []*net.UDPAddr{
+		{IP: net.ParseIP("::ffff:1.2.3.4"), Port: 1234},
+		{IP: net.ParseIP("::ffff:1.2.3.4"), Port: 1234, Zone: "eth0"},
+	} {
+		require.Len(t, mapped.IP, net.IPv6len)
+		c.packets <- fakePacket{buf: []byte("foobar"), addr: mapped}
+		n, from, err := conn.ReadFrom(buf)
+		require.NoError(t, err)
+		require.Equal(t, "foobar", string(buf[:n]))
+		require.Equal(t, mapped, from)
+	}
+
+	// STUN binding requests from a mapped address map to the IPv4 connection
+	mapped := &net.UDPAddr{IP: net.ParseIP("::ffff:5.6.7.8"), Port: 1234, Zone: "eth0"}
+	c.packets <- fakePacket{buf: getSTUNBindingRequest("a").Raw, addr: mapped}
+	_, from, err := conn.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, mapped, from)
+	require.Nil(t, m.hasConn("a", true))
+
+	c.packets <- fakePacket{buf: []byte("foobar"), addr: &net.UDPAddr{IP: net.IPv4(5, 6, 7, 8).To4(), Port: 1234}}
+	n, _, err := conn.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, "foobar", string(buf[:n]))
+}
+
+func TestPinRemoteAddr(t *testing.T) {
+	for _, pin := range []bool{true, false} {
+		t.Run(fmt.Sprintf("pin=%t", pin), func(t *testing.T) {
+			var opts []Option
+			if pin {
+				opts = append(opts, WithPinRemoteAddr())
+			}
+			c := newFakePacketConn()
+			m, err := NewUDPMuxWithOptions(c, opts...)
+			require.NoError(t, err)
+			m.Start()
+			defer m.Close()
+
+			attacker := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1000}
+			remote := &net.UDPAddr{IP: net.IPv4(5, 6, 7, 8), Port: 2000}
+			// The attacker's binding request arrives first. It must not pin the
+			// connection to the attacker's address.
+			c.packets <- fakePacket{buf: getSTUNBindingRequest("a").Raw, addr: attacker}
+			_, err = m.Accept(context.Background())
+			require.NoError(t, err)
+			mc, err := m.GetConn("a", remote)
+			require.NoError(t, err)
+			c.packets <- fakePacket{buf: getSTUNBindingRequest("a").Raw, addr: remote}
+
+			buf := make([]byte, 100)
+			for _, addr := range []net.Addr{attacker, remote} {
+				_, from, err := mc.ReadFrom(buf)
+				require.NoError(t, err)
+				require.Equal(t, addr, from)
+			}
+
+			// ICE selected the candidate pair with the remote address
+			err = m.PinRemoteAddr("a", false, remote)
+			if !pin {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+
+			c.packets <- fakePacket{buf: getSTUNBindingRequest("a").Raw, addr: attacker}
+			c.packets <- fakePacket{buf: []byte("test"), addr: attacker}
+			c.packets <- fakePacket{buf: []byte("test"), addr: remote}
+
+			var from []net.Addr
+			numPackets := 3
+			if pin {
+				numPackets = 1
+			}
+			for i := 0; i < numPackets; i++ {
+				_, addr, err := mc.ReadFrom(buf)
+				require.NoError(t, err)
+				from = append(from, addr)
+			}
+			if pin {
+				require.Equal(t, []net.Addr{remote}, from)
+			} else {
+				require.Equal(t, []net.Addr{attacker, attacker, remote}, from)
+			}
+		})
+	}
+
+	t.Run("unknown connection", func(t *testing.T) {
+		m, err := NewUDPMuxWithOptions(newFakePacketConn(), WithPinRemoteAddr())
+		require.NoError(t, err)
+		defer m.Close()
+		err = m.PinRemoteAddr("a", false, &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1000})
+		require.ErrorIs(t, err, ErrConnNotFound)
+	})
+}
+
+func TestPacketFilter(t *testing.T) {
+	blocked := &net.UDPAddr{IP: net.IPv4(5, 6, 7, 8), Port: 2000}
+	var unknown int
+	var mu sync.Mutex
+	c := newFakePacketConn()
+	m, err := NewUDPMuxWithOptions(c,
+		WithPacketFilter(func(remote net.Addr, _ []byte) bool {
+			return remote.String() != blocked.String()
+		}),
+		WithUnknownUfragHandler(func(string, net.Addr, []byte) {
+			mu.Lock()
+			defer mu.Unlock()
+			unknown++
+		}))
+	require.NoError(t, err)
+	m.Start()
+	defer m.Close()
+
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1000}
+	c.packets <- fakePacket{buf: getSTUNBindingRequest("a").Raw, addr: addr}
+	_, err = m.Accept(context.Background())
+	require.NoError(t, err)
+	mc, err := m.GetConn("a", addr)
+	require.NoError(t, err)
+
+	// packets from the blocked address are dropped, even with a known ufrag
+	c.packets <- fakePacket{buf: getSTUNBindingRequest("a").Raw, addr: blocked}
+	c.packets <- fakePacket{buf: []byte("blocked"), addr: blocked}
+	c.packets <- fakePacket{buf: getSTUNBindingRequest("b").Raw, addr: blocked}
+	c.packets <- fakePacket{buf: []byte("test"), addr: addr}
+
+	buf := make([]byte, 100)
+	_, from, err := mc.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, addr, from)
+	n, from, err := mc.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, addr, from)
+	require.Equal(t, "test", string(buf[:n]))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = m.Accept(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	mu.Lock()
+	defer mu.Unlock()
+	require.Zero(t, unknown)
+}
+
+// batchingPacketConn is a fakePacketConn that supports batched writes. It
+// counts the write calls, and blocks the first write until unblock is closed.
+// Writes to failAddr fail, like sendmmsg, WriteBatch stops at the first
+// message that can't be written.
+type batchingPacketConn struct {
+	*fakePacketConn
+	started  chan struct{}
+	unblock  chan struct{}
+	failAddr net.Addr
+
+	mu         sync.Mutex
+	writeCalls int
+	written    []string
+}
+
+func newBatchingPacketConn() *batchingPacketConn {
+	return &batchingPacketConn{
+		fakePacketConn: newFakePacketConn(),
+		started:        make(chan struct{}),
+		unblock:        make(chan struct{}),
+	}
+}
+
+func (c *batchingPacketConn) write(bufs ...[]byte) {
+	c.mu.Lock()
+	c.writeCalls++
+	first := c.writeCalls == 1
+	for _, b := range bufs {
+		c.written = append(c.written, string(b))
+	}
+	c.mu.Unlock()
+	if first {
+		close(c.started)
+		<-c.unblock
+	}
+}
+
+func (c *batchingPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if c.failAddr != nil && addr.String() == c.failAddr.String() {
+		c.write()
+		return 0, errors.New("write failed")
+	}
+	c.write(b)
+	return len(b), nil
+}
+
+func (c *batchingPacketConn) WriteBatch(ms []ipv4.Message, _ int) (int, error) {
+	bufs := make([][]byte, 0, len(ms))
+	for _, m := range ms {
+		if c.failAddr != nil && m.Addr.String() == c.failAddr.String() {
+			break
+		}
+		bufs = append(bufs, m.Buffers[0])
+	}
+	c.write(bufs...)
+	if len(bufs) == 0 {
+		return 0, errors.New("write failed")
+	}
+	return len(bufs), nil
+}
+
+func (c *batchingPacketConn) stats() (writeCalls int, written []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writeCalls, append([]string(nil), c.written...)
+}
+
+func TestPacketIntegrity(t *testing.T) {
+	c := newFakePacketConn()
+	m := NewUDPMux(c)
+	m.Start()
+	defer m.Close()
+
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1000}
+	c.packets <- fakePacket{buf: getSTUNBindingRequest("a").Raw, addr: addr}
+	_, err := m.Accept(context.Background())
+	require.NoError(t, err)
+	mc, err := m.GetConn("a", addr)
+	require.NoError(t, err)
+	buf := make([]byte, ReceiveBufSize)
+	_, _, err = mc.ReadFrom(buf)
+	require.NoError(t, err)
+
+	// The mux reads all packets into the same buffer, queued packets must not
+	// be overwritten by later ones.
+	const numPackets = 100
+	packet := func(i int) []byte {
+		return bytes.Repeat([]byte{byte(i)}, 100+i)
+	}
+	for i := 0; i < numPackets; i++ {
+		c.packets <- fakePacket{buf: packet(i), addr: addr}
+	}
+	for i := 0; i < numPackets; i++ {
+		n, _, err := mc.ReadFrom(buf)
+		require.NoError(t, err)
+		require.Equal(t, packet(i), buf[:n])
+	}
+}
+
+func BenchmarkReadLoop(b *testing.B) {
+	c := newFakePacketConn()
+	m := NewUDPMux(c)
+	m.Start()
+	defer m.Close()
+
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1000}
+	c.packets <- fakePacket{buf: getSTUNBindingRequest("a").Raw, addr: addr}
+	if _, err := m.Accept(context.Background()); err != nil {
+		b.Fatal(err)
+	}
+	mc, err := m.GetConn("a", addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	buf := make([]byte, ReceiveBufSize)
+	if _, _, err := mc.ReadFrom(buf); err != nil {
+		b.Fatal(err)
+	}
+
+	packet := fakePacket{buf: make([]byte, 1200), addr: addr}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.packets <- packet
+		if _, _, err := mc.ReadFrom(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestWriteBatching(t *testing.T) {
+	const numPackets = 6
+	expected := make([]string, 0, numPackets)
+	for i := 0; i < numPackets; i++ {
+		expected = append(expected, fmt.Sprintf("packet %d", i))
+	}
+
+	for _, batching := range []bool{true, false} {
+		t.Run(fmt.Sprintf("batching=%t", batching), func(t *testing.T) {
+			c := newBatchingPacketConn()
+			m, err := NewUDPMuxWithOptions(c, WithWriteBatching(batching, 16))
+			require.NoError(t, err)
+			m.Start()
+			defer m.Close()
+
+			addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1000}
+			mc, err := m.GetConn("a", addr)
+			require.NoError(t, err)
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				// the first write blocks, so that the others are queued
+				_, err := mc.WriteTo([]byte(expected[0]), addr)
+				require.NoError(t, err)
+				<-c.started
+				for _, p := range expected[1:] {
+					_, err := mc.WriteTo([]byte(p), addr)
+					require.NoError(t, err)
+				}
+			}()
+			<-c.started
+			if batching {
+				// writes return once the packet is queued
+				<-done
+			}
+			close(c.unblock)
+			<-done
+
+			require.Eventually(t, func() bool {
+				_, written := c.stats()
+				return len(written) == numPackets
+			}, 5*time.Second, 10*time.Millisecond)
+			writeCalls, written := c.stats()
+			require.Equal(t, expected, written)
+			if batching {
+				require.Equal(t, 2, writeCalls)
+			} else {
+				require.Equal(t, numPackets, writeCalls)
+			}
+		})
+	}
+}
+
+func TestWriteBatchingFailedPacket(t *testing.T) {
+	c := newBatchingPacketConn()
+	c.failAddr = &net.UDPAddr{IP: net.IPv4(5, 6, 7, 8), Port: 1000}
+	m, err := NewUDPMuxWithOptions(c, WithWriteBatching(true, 16))
+	require.NoError(t, err)
+	m.Start()
+	defer m.Close()
+
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1000}
+	mc, err := m.GetConn("a", addr)
+	require.NoError(t, err)
+	failing, err := m.GetConn("b", c.failAddr)
+	require.NoError(t, err)
+
+	// the first write blocks, so that the others are written in one batch
+	_, err = mc.WriteTo([]byte("packet 0"), addr)
+	require.NoError(t, err)
+	<-c.started
+	_, err = mc.WriteTo([]byte("packet 1"), addr)
+	require.NoError(t, err)
+	_, err = failing.WriteTo([]byte("failing"), c.failAddr)
+	require.NoError(t, err)
+	_, err = mc.WriteTo([]byte("packet 2"), addr)
+	require.NoError(t, err)
+	close(c.unblock)
+
+	// the packets queued after the failing one are still written
+	expected := []string{"packet 0", "packet 1", "packet 2"}
+	require.Eventually(t, func() bool {
+		_, written := c.stats()
+		return len(written) == len(expected)
+	}, 5*time.Second, 10*time.Millisecond)
+	_, written := c.stats()
+	require.Equal(t, expected, written)
+}
+
+func TestWriteBatchingFallback(t *testing.T) {
+	// fakePacketConn doesn't support batched writes
+	c := newFakePacketConn()
+	c.writes = make(chan fakePacket, 10)
+	m, err := NewUDPMuxWithOptions(c, WithWriteBatching(true, 16))
+	require.NoError(t, err)
+	m.Start()
+	defer m.Close()
+
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1000}
+	mc, err := m.GetConn("a", addr)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := mc.WriteTo([]byte(fmt.Sprintf("packet %d", i)), addr)
+		require.NoError(t, err)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case p := <-c.writes:
+			require.Equal(t, fmt.Sprintf("packet %d", i), string(p.buf))
+			require.Equal(t, addr, p.addr)
+		case <-time.After(5 * time.Second):
+			t.Fatal("packet not written")
+		}
+	}
+}
+
+func TestWriteBatchingUDP(t *testing.T) {
+	m, err := NewUDPMuxWithOptions(newPacketConn(t), WithWriteBatching(true, 16))
+	require.NoError(t, err)
+	m.Start()
+	defer m.Close()
+
+	remote := newPacketConn(t)
+	mc, err := m.GetConn("a", remote.LocalAddr())
+	require.NoError(t, err)
+	const numPackets = 20
+	for i := 0; i < numPackets; i++ {
+		_, err := mc.WriteTo([]byte(fmt.Sprintf("packet %d", i)), remote.LocalAddr())
+		require.NoError(t, err)
+	}
+
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 100)
+	for i := 0; i < numPackets; i++ {
+		n, _, err := remote.ReadFrom(buf)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("packet %d", i), string(buf[:n]))
+	}
+}
+
+func TestWriteBatchingDualStack(t *testing.T) {
+	socket, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv6unspecified})
+	if err != nil {
+		t.Skipf("IPv6 not supported: %s", err)
+	}
+	defer socket.Close()
+	m, err := NewUDPMuxWithOptions(socket, WithWriteBatching(true, 16))
+	require.NoError(t, err)
+	defer m.Close()
+
+	// the dual-stack socket sends to an IPv4 address
+	remote := newPacketConn(t)
+	port := socket.LocalAddr().(*net.UDPAddr).Port
+	mc, err := m.GetConn("a", remote.LocalAddr())
+	require.NoError(t, err)
+	// queue the packets before starting the mux, so that they're written in batches
+	const numPackets = 20
+	for i := 0; i < numPackets; i++ {
+		_, err := mc.WriteTo([]byte(fmt.Sprintf("packet %d", i)), remote.LocalAddr())
+		require.NoError(t, err)
+	}
+	m.Start()
+
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 100)
+	for i := 0; i < numPackets; i++ {
+		n, from, err := remote.ReadFrom(buf)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("packet %d", i), string(buf[:n]))
+		require.Equal(t, port, from.(*net.UDPAddr).Port)
+	}
+}
+
+func TestWriteBatchingInvalidSize(t *testing.T) {
+	_, err := NewUDPMuxWithOptions(newFakePacketConn(), WithWriteBatching(true, 0))
+	require.Error(t, err)
+	_, err = NewUDPMuxWithOptions(newFakePacketConn(), WithWriteBatching(false, 0))
+	require.NoError(t, err)
+}
+
+func TestCloseKeepConn(t *testing.T) {
+	socket := newPacketConn(t)
+	m := NewUDPMux(socket)
+	m.Start()
+
+	remote := newPacketConn(t)
+	mc, err := m.GetConn("a", remote.LocalAddr())
+	require.NoError(t, err)
+	require.NoError(t, m.CloseKeepConn())
+
+	_, _, err = mc.ReadFrom(make([]byte, 100))
+	require.Error(t, err)
+	_, err = m.GetConn("b", remote.LocalAddr())
+	require.ErrorIs(t, err, ErrMuxClosed)
+	// closing again doesn't close the socket
+	require.NoError(t, m.Close())
+
+	// the socket is still usable, without a read deadline
+	_, err = remote.WriteTo([]byte("hello"), socket.LocalAddr())
+	require.NoError(t, err)
+	type result struct {
+		n   int
+		err error
+	}
+	read := make(chan result, 1)
+	buf := make([]byte, 100)
+	go func() {
+		n, _, err := socket.ReadFrom(buf)
+		read <- result{n: n, err: err}
+	}()
+	select {
+	case r := <-read:
+		require.NoError(t, r.err)
+		require.Equal(t, "hello", string(buf[:r.n]))
+	case <-time.After(5 * time.Second):
+		t.Fatal("socket read timed out")
+	}
+
+	_, err = socket.WriteTo([]byte("world"), remote.LocalAddr())
+	require.NoError(t, err)
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := remote.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, "world", string(buf[:n]))
+}
+
+func TestReadErrorHandler(t *testing.T) {
+	errs := make(chan error, 1)
+	continueReading := make(chan bool, 1)
+	c := newFakePacketConn()
+	m, err := NewUDPMuxWithOptions(c, WithReadErrorHandler(func(err error) bool {
+		errs <- err
+		return <-continueReading
+	}))
+	require.NoError(t, err)
+	m.Start()
+	defer m.Close()
+
+	readErr := errors.New("transient error")
+	c.packets <- fakePacket{err: readErr}
+	require.ErrorIs(t, <-errs, readErr)
+	continueReading <- true
+
+	// the mux should still process packets
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1234}
+	c.packets <- fakePacket{buf: getSTUNBindingRequest("a").Raw, addr: addr}
+	cand, err := m.Accept(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "a", cand.Ufrag)
+
+	readErr = errors.New("permanent error")
+	c.packets <- fakePacket{err: readErr}
+	require.ErrorIs(t, <-errs, readErr)
+	continueReading <- false
+
+	// the mux should close itself
+	select {
+	case <-c.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the mux to close the socket")
+	}
+	_, err = m.Accept(context.Background())
+	require.Error(t, err)
+	_, err = m.GetConn("b", addr)
+	require.ErrorIs(t, err, ErrMuxClosed)
+}
+
+func TestReadErrorStopsReading(t *testing.T) {
+	c := newFakePacketConn()
+	m := NewUDPMux(c)
+	m.Start()
+	defer m.Close()
+
+	c.packets <- fakePacket{err: errors.New("read error")}
+	// without a handler, the read loop exits on the first error
+	select {
+	case c.packets <- fakePacket{buf: getSTUNBindingRequest("a").Raw}:
+		t.Fatal("expected the read loop to have exited")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestReadBufferSize(t *testing.T) {
+	_, err := NewUDPMuxWithOptions(newFakePacketConn(), WithReadBufferSize(minReceiveBufSize-1))
+	require.Error(t, err)
+
+	const size = 4000
+	c := newFakePacketConn()
+	m, err := NewUDPMuxWithOptions(c, WithReadBufferSize(size))
+	require.NoError(t, err)
+	m.Start()
+	defer m.Close()
+
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1234}
+	c.packets <- fakePacket{buf: getSTUNBindingRequest("a").Raw, addr: addr}
+	_, err = m.Accept(context.Background())
+	require.NoError(t, err)
+	mc, err := m.GetConn("a", addr)
+	require.NoError(t, err)
+	buf := make([]byte, 2*size)
+	_, _, err = mc.ReadFrom(buf) // STUN binding request
+	require.NoError(t, err)
+
+	msg := make([]byte, size)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	c.packets <- fakePacket{buf: msg, addr: addr}
+	n, _, err := mc.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, msg, buf[:n])
+}
+
+type mockMetricsTracer struct {
+	mx          sync.Mutex
+	queueLength map[string]int
+	dropped     map[string]int
+}
+
+var _ MetricsTracer = &mockMetricsTracer{}
+
+func newMockMetricsTracer() *mockMetricsTracer {
+	return &mockMetricsTracer{
+		queueLength: make(map[string]int),
+		dropped:     make(map[string]int),
+	}
+}
+
+func (t *mockMetricsTracer) QueueLength(ufrag string, n int) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	t.queueLength[ufrag] = n
+}
+
+func (t *mockMetricsTracer) DroppedPacket(ufrag string) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	t.dropped[ufrag]++
+}
+
+func (t *mockMetricsTracer) get(ufrag string) (queueLength, dropped int) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	return t.queueLength[ufrag], t.dropped[ufrag]
+}
+
+func TestMetricsTracer(t *testing.T) {
+	tracer := newMockMetricsTracer()
+	c := newFakePacketConn()
+	m, err := NewUDPMuxWithOptions(c, WithMetricsTracer(tracer))
+	require.NoError(t, err)
+	m.Start()
+	defer m.Close()
+
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1234}
+	c.packets <- fakePacket{buf: getSTUNBindingRequest("a").Raw, addr: addr}
+	_, err = m.Accept(context.Background())
+	require.NoError(t, err)
+	mc, err := m.GetConn("a", addr)
+	require.NoError(t, err)
+
+	// Don't read from the connection, so that its queue fills up.
+	// The STUN binding request is already queued.
+	for i := 0; i < queueLen+2; i++ {
+		c.packets <- fakePacket{buf: []byte("test"), addr: addr}
+	}
+	require.Eventually(t, func() bool {
+		queueLength, dropped := tracer.get("a")
+		return queueLength == queueLen && dropped == 3
+	}, 5*time.Second, 10*time.Millisecond)
+
+	_, _, err = mc.ReadFrom(make([]byte, 100))
+	require.NoError(t, err)
+	queueLength, _ := tracer.get("a")
+	require.Equal(t, queueLen-1, queueLength)
+
+	require.NoError(t, mc.Close())
+	queueLength, dropped := tracer.get("a")
+	require.Zero(t, queueLength)
+	require.Equal(t, 3, dropped)
+}
+
+func TestMultiUDPMux(t *testing.T) {
+	sockets := make([]*fakePacketConn, 2)
+	for i := range sockets {
+		sockets[i] = newFakePacketConn()
+		sockets[i].localAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000 + i}
+		sockets[i].writes = make(chan fakePacket, 1)
+	}
+	m, err := NewMultiUDPMux([]net.PacketConn{sockets[0], sockets[1]})
+	require.NoError(t, err)
+	m.Start()
+	defer m.Close()
+	require.Equal(t, []net.Addr{sockets[0].localAddr, sockets[1].localAddr}, m.GetListenAddresses())
+
+	ufrags := []string{"a", "b"}
+	remotes := []*net.UDPAddr{
+		{IP: net.IPv4(1, 2, 3, 4), Port: 1000},
+		{IP: net.IPv4(1, 2, 3, 4), Port: 2000},
+	}
+	for i, socket := range sockets {
+		socket.packets <- fakePacket{buf: getSTUNBindingRequest(ufrags[i]).Raw, addr: remotes[i]}
+		c, err := m.Accept(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, Candidate{Ufrag: ufrags[i], Addr: remotes[i]}, c)
+	}
+
+	for i, socket := range sockets {
+		conn, err := m.GetConn(ufrags[i], remotes[i])
+		require.NoError(t, err)
+		require.Equal(t, socket.localAddr, conn.LocalAddr())
+
+		// the binding request
+		buf := make([]byte, 1500)
+		_, addr, err := conn.ReadFrom(buf)
+		require.NoError(t, err)
+		require.Equal(t, remotes[i], addr)
+
+		// packets from the remote are routed to the connection
+		socket.packets <- fakePacket{buf: []byte("hello"), addr: remotes[i]}
+		n, addr, err := conn.ReadFrom(buf)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(buf[:n]))
+		require.Equal(t, remotes[i], addr)
+
+		// writes go out on the socket the connection was received on
+		_, err = conn.WriteTo([]byte("world"), remotes[i])
+		require.NoError(t, err)
+		select {
+		case p := <-socket.writes:
+			require.Equal(t, "world", string(p.buf))
+			require.Equal(t, remotes[i], p.addr)
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected a write on the originating socket")
+		}
+		require.Empty(t, sockets[1-i].writes)
+	}
+
+	_, err = NewMultiUDPMux(nil)
+	require.Error(t, err)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"net"
+	"sync/atomic"
 	"time"
 
 	pool "github.com/libp2p/go-buffer-pool"
@@ -28,38 +29,83 @@ type muxedConnection struct {
 	onClose func()
 	queue   chan packet
 	mux     *UDPMux
+	ufrag   string
+	// socket is the mux socket the connection writes its packets on
+	socket net.PacketConn
+	// requested is set once the connection is returned from GetConn. It is
+	// guarded by the mux's lock.
+	requested bool
+
+	// lastActivity is the time, in unix nanoseconds, at which the connection
+	// was created or last received a packet
+	lastActivity atomic.Int64
+
+	// bytesRead and bytesWritten count the bytes of the packets queued for
+	// the connection and written by it
+	bytesRead    atomic.Uint64
+	bytesWritten atomic.Uint64
+}
+
+// ConnStats holds the byte counters of a connection of the mux.
+type ConnStats struct {
+	// BytesRead is the number of bytes received for the connection. It
+	// doesn't include packets dropped because the connection's receive queue
+	// was full.
+	BytesRead uint64
+	// BytesWritten is the number of bytes written by the connection.
+	BytesWritten uint64
 }
 
 var _ net.PacketConn = &muxedConnection{}
 
-func newMuxedConnection(mux *UDPMux, onClose func()) *muxedConnection {
+func newMuxedConnection(mux *UDPMux, ufrag string, socket net.PacketConn, onClose func()) *muxedConnection {
 	ctx, cancel := context.WithCancel(mux.ctx)
-	return &muxedConnection{
+	c := &muxedConnection{
 		ctx:     ctx,
 		cancel:  cancel,
 		queue:   make(chan packet, queueLen),
 		onClose: onClose,
 		mux:     mux,
+		ufrag:   ufrag,
+		socket:  socket,
 	}
+	c.lastActivity.Store(time.Now().UnixNano())
+	return c
 }
 
+// Push queues a copy of the packet in buf received from addr.
 func (c *muxedConnection) Push(buf []byte, addr net.Addr) error {
 	select {
 	case <-c.ctx.Done():
 		return errors.New("closed")
 	default:
 	}
+	c.lastActivity.Store(time.Now().UnixNano())
+	// The caller reuses buf, so queue a copy.
+	b := pool.Get(len(buf))
+	copy(b, buf)
 	select {
-	case c.queue <- packet{buf: buf, addr: addr}:
+	case c.queue <- packet{buf: b, addr: addr}:
+		c.bytesRead.Add(uint64(len(buf)))
+		c.mux.metricsTracer.QueueLength(c.ufrag, len(c.queue))
 		return nil
 	default:
+		pool.Put(b)
+		c.mux.metricsTracer.DroppedPacket(c.ufrag)
 		return errors.New("queue full")
 	}
 }
 
+// LastActivity returns the time at which the connection was created or last
+// received a packet.
+func (c *muxedConnection) LastActivity() time.Time {
+	return time.Unix(0, c.lastActivity.Load())
+}
+
 func (c *muxedConnection) ReadFrom(buf []byte) (int, net.Addr, error) {
 	select {
 	case p := <-c.queue:
+		c.mux.metricsTracer.QueueLength(c.ufrag, len(c.queue))
 		n := copy(buf, p.buf) // This might discard parts of the packet, if p is too short
 		if n < len(p.buf) {
 			log.Debugf("short read, had %d, read %d", len(p.buf), n)
@@ -72,7 +118,21 @@ func (c *muxedConnection) ReadFrom(buf []byte) (int, net.Addr, error) {
 }
 
 func (c *muxedConnection) WriteTo(p []byte, addr net.Addr) (n int, err error) {
-	return c.mux.writeTo(p, addr)
+	if b := c.mux.writeBatchers[c.socket]; b != nil {
+		n, err = b.WriteTo(c.mux.ctx, p, addr)
+	} else {
+		n, err = c.socket.WriteTo(p, addr)
+	}
+	c.bytesWritten.Add(uint64(n))
+	return n, err
+}
+
+// Stats returns the connection's byte counters.
+func (c *muxedConnection) Stats() ConnStats {
+	return ConnStats{
+		BytesRead:    c.bytesRead.Load(),
+		BytesWritten: c.bytesWritten.Load(),
+	}
 }
 
 func (c *muxedConnection) Close() error {
@@ -89,12 +149,19 @@ func (c *muxedConnection) Close() error {
 		case p := <-c.queue:
 			pool.Put(p.buf)
 		default:
+			c.mux.metricsTracer.QueueLength(c.ufrag, 0)
 			return nil
 		}
 	}
 }
 
-func (c *muxedConnection) LocalAddr() net.Addr { return c.mux.socket.LocalAddr() }
+// Done returns a channel that is closed when the connection is closed, either
+// by Close, by the mux closing it as idle, or by the mux shutting down.
+func (c *muxedConnection) Done() <-chan struct{} {
+	return c.ctx.Done()
+}
+
+func (c *muxedConnection) LocalAddr() net.Addr { return c.socket.LocalAddr() }
 
 func (*muxedConnection) SetDeadline(t time.Time) error {
 	// no deadline is desired here
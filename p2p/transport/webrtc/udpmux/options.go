@@ -0,0 +1,145 @@
+package udpmux
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Option configures a UDPMux.
+type Option func(*UDPMux) error
+
+// UnknownUfragHandler is called for STUN binding requests that the mux drops
+// because no connection is registered for their ufrag. packet is the binding
+// request. The packet buffer is reused after the handler returns, so it must
+// not be retained.
+type UnknownUfragHandler func(ufrag string, remote net.Addr, packet []byte)
+
+// WithUnknownUfragHandler sets a handler that is invoked for every well-formed
+// STUN binding request the mux drops because no connection is registered for
+// its ufrag: because the accept queue is full, or because the connection was
+// removed with RemoveConn. Other packets that can't be routed, like non-STUN
+// packets from unknown addresses, are dropped without calling the handler.
+// This is useful for debugging ICE failures. By default such requests are
+// dropped silently.
+func WithUnknownUfragHandler(h UnknownUfragHandler) Option {
+	return func(mux *UDPMux) error {
+		mux.unknownUfragHandler = h
+		return nil
+	}
+}
+
+// ReadErrorHandler is called when reading from the mux's socket fails. It
+// returns whether the mux should keep reading from the socket.
+type ReadErrorHandler func(err error) (continueReading bool)
+
+// WithReadErrorHandler sets a handler that is called on every error returned
+// when reading from the socket. If the handler returns false, the mux stops
+// reading and closes itself. The handler should return false for permanent
+// errors, such as net.ErrClosed, otherwise the mux will spin on the failing
+// socket. By default, the mux stops reading on the first error without closing.
+func WithReadErrorHandler(h ReadErrorHandler) Option {
+	return func(mux *UDPMux) error {
+		mux.onReadError = h
+		return nil
+	}
+}
+
+// WithConnIdleTimeout closes connections that haven't received a packet for
+// the given duration and removes them from the mux. This cleans up ufrags
+// that were allocated but never completed ICE. A zero duration, the default,
+// disables the idle timeout.
+func WithConnIdleTimeout(d time.Duration) Option {
+	return func(mux *UDPMux) error {
+		if d < 0 {
+			return errors.New("idle timeout must not be negative")
+		}
+		mux.connIdleTimeout = d
+		return nil
+	}
+}
+
+// WithPinRemoteAddr enables pinning connections to a remote address with
+// PinRemoteAddr. Once a connection is pinned, packets from any other address
+// are dropped, which prevents an off-path attacker who learned the ufrag from
+// injecting packets. Pinning breaks ICE roaming, so it is disabled by default.
+func WithPinRemoteAddr() Option {
+	return func(mux *UDPMux) error {
+		mux.pinRemoteAddr = true
+		return nil
+	}
+}
+
+// WithReadBufferSize sets the size of the buffer used to receive packets from
+// the socket. Packets larger than the buffer are truncated. It defaults to
+// ReceiveBufSize.
+func WithReadBufferSize(size int) Option {
+	return func(mux *UDPMux) error {
+		if size < minReceiveBufSize {
+			return fmt.Errorf("read buffer size must be at least %d bytes, got %d", minReceiveBufSize, size)
+		}
+		mux.receiveBufSize = size
+		return nil
+	}
+}
+
+// WithMetricsTracer sets the tracer used to report the state of the
+// connections' receive queues.
+func WithMetricsTracer(t MetricsTracer) Option {
+	return func(mux *UDPMux) error {
+		if t == nil {
+			return errors.New("metrics tracer must not be nil")
+		}
+		mux.metricsTracer = t
+		return nil
+	}
+}
+
+// WithRejectDuplicateConns makes GetConn return ErrDuplicateConn when called
+// again for a ufrag and address family it already returned a connection for.
+// This lets callers detect ufrag collisions. By default, GetConn returns the
+// existing connection.
+func WithRejectDuplicateConns() Option {
+	return func(mux *UDPMux) error {
+		mux.rejectDuplicates = true
+		return nil
+	}
+}
+
+// PacketFilter decides whether the mux routes a packet received from remote.
+// The packet buffer is reused after the filter returns, so it must not be
+// retained.
+type PacketFilter func(remote net.Addr, packet []byte) bool
+
+// WithPacketFilter sets a filter that is applied to every packet before it is
+// routed to a connection. Packets the filter rejects are dropped, without
+// being passed to the unknown ufrag handler. This allows applying custom
+// validation, such as enforcing an allowlist of remote addresses. By default
+// all packets are routed.
+func WithPacketFilter(f PacketFilter) Option {
+	return func(mux *UDPMux) error {
+		mux.packetFilter = f
+		return nil
+	}
+}
+
+// WithWriteBatching enables coalescing the packets written by the mux's
+// connections. Packets are queued and written by a per-socket goroutine, which
+// writes up to maxBatch queued packets at once, with a single system call on
+// platforms that support it and one WriteTo call per packet otherwise. Since
+// writes are asynchronous, write errors are not returned to the connections.
+// Batching is disabled by default.
+func WithWriteBatching(enabled bool, maxBatch int) Option {
+	return func(mux *UDPMux) error {
+		if !enabled {
+			mux.writeBatchSize = 0
+			return nil
+		}
+		if maxBatch < 1 {
+			return fmt.Errorf("max write batch size must be positive, got %d", maxBatch)
+		}
+		mux.writeBatchSize = maxBatch
+		return nil
+	}
+}